@@ -0,0 +1,82 @@
+package milter
+
+import (
+	"log"
+)
+
+// ActionWriter writes the modification actions of a Modifier. The server
+// writes them to the MTA; other implementations can record them in unit
+// tests, forward them in a proxy or count them.
+type ActionWriter interface {
+	WriteAction(msg *Message) error
+}
+
+// ActionWriterFunc is an ActionWriter calling a function.
+type ActionWriterFunc func(msg *Message) error
+
+// WriteAction calls f(msg).
+func (f ActionWriterFunc) WriteAction(msg *Message) error {
+	return f(msg)
+}
+
+// ActionRecorder is an ActionWriter recording the actions written to it.
+type ActionRecorder struct {
+	Messages []*Message
+}
+
+var _ ActionWriter = (*ActionRecorder)(nil)
+
+// WriteAction records msg.
+func (r *ActionRecorder) WriteAction(msg *Message) error {
+	r.Messages = append(r.Messages, &Message{Code: msg.Code, Data: append([]byte(nil), msg.Data...)})
+	return nil
+}
+
+// ModifyActions decodes the recorded actions.
+func (r *ActionRecorder) ModifyActions() ([]ModifyAction, error) {
+	acts := make([]ModifyAction, 0, len(r.Messages))
+	for _, msg := range r.Messages {
+		act, err := parseModifyAct(&Message{Code: msg.Code, Data: msg.Data}, NULTruncate)
+		if err != nil {
+			return nil, err
+		}
+		acts = append(acts, *act)
+	}
+	return acts, nil
+}
+
+// NewModifier returns a Modifier writing its modification actions to w,
+// e.g. an ActionRecorder to unit test the Body callback of a filter. The
+// Modifier is at the end of message stage and has no message data.
+func NewModifier(w ActionWriter) *Modifier {
+	return &Modifier{
+		writer:   w,
+		stage:    CodeEOB,
+		bodySize: -1,
+		logf:     log.Printf,
+	}
+}
+
+// WithActionWriter returns a copy of m writing its modification actions to w,
+// e.g. to let a wrapping Milter inspect or filter the modifications of the
+// wrapped one. The writer of m can be retrieved with ActionWriter to forward
+// actions to it.
+func (m *Modifier) WithActionWriter(w ActionWriter) *Modifier {
+	mod := *m
+	mod.writer = w
+	return &mod
+}
+
+// ActionWriter returns the writer of the modification actions of m.
+func (m *Modifier) ActionWriter() ActionWriter {
+	return m.writer
+}
+
+// actionWriter wraps the writer of the modification actions of a Modifier
+// with Server.ActionWriter, if set.
+func (m *milterSession) actionWriter(w ActionWriter) ActionWriter {
+	if m.server.ActionWriter == nil {
+		return w
+	}
+	return m.server.ActionWriter(w)
+}
@@ -0,0 +1,74 @@
+package milter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewModifier(t *testing.T) {
+	var rec ActionRecorder
+	m := NewModifier(&rec)
+	if err := m.AddHeader("X-Test", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddRecipient("to@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	acts, err := rec.ModifyActions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ModifyAction{
+		{Code: ActAddHeader, HeaderName: "X-Test", HeaderValue: "1"},
+		{Code: ActAddRcpt, Rcpt: "<to@example.org>"},
+	}
+	if !reflect.DeepEqual(acts, expected) {
+		t.Fatalf("Wrong modify actions: %+v", acts)
+	}
+}
+
+func TestServer_ActionWriter(t *testing.T) {
+	var count int
+	mm := MockMilter{
+		BodyResp: RespAccept,
+		BodyMod: func(m *Modifier) {
+			m.AddHeader("X-A", "1")
+			// hide the modifications of a nested filter
+			var rec ActionRecorder
+			m.WithActionWriter(&rec).AddHeader("X-B", "1")
+			if len(rec.Messages) != 1 {
+				t.Errorf("Wrong amount of recorded actions: %v", len(rec.Messages))
+			}
+			m.AddHeader("X-C", "1")
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Actions: OptAddHeader,
+		ActionWriter: func(w ActionWriter) ActionWriter {
+			return ActionWriterFunc(func(msg *Message) error {
+				count++
+				return w.WriteAction(msg)
+			})
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptAddHeader,
+	})
+	defer session.Close()
+
+	modifyActs, _, err := session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modifyActs) != 2 || modifyActs[0].HeaderName != "X-A" || modifyActs[1].HeaderName != "X-C" {
+		t.Fatalf("Wrong modify actions: %+v", modifyActs)
+	}
+	if count != 2 {
+		t.Fatalf("Wrong amount of counted actions: %v", count)
+	}
+}
@@ -0,0 +1,153 @@
+package milter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// HeaderField is a single header field of a message.
+type HeaderField struct {
+	Key   string
+	Value string
+}
+
+// MessageState is the envelope and content of a message, as seen by an MTA
+// applying the modify actions returned by a milter.
+type MessageState struct {
+	From     string
+	FromArgs []string
+	Rcpts    []string
+
+	// Header fields, in order.
+	Header []HeaderField
+	Body   io.Reader
+
+	// Quarantine reason, if the message was quarantined.
+	Quarantine string
+}
+
+// ApplyFailure describes a modify action that could not be applied.
+type ApplyFailure struct {
+	Action ModifyAction
+	Err    error
+}
+
+// ApplyReport describes the outcome of ApplyModifyActions.
+type ApplyReport struct {
+	// Actions applied cleanly.
+	Applied []ModifyAction
+	// Actions that could not be applied.
+	Failed []ApplyFailure
+}
+
+// Err returns an error summarizing the failures, or nil if all actions were
+// applied.
+func (r *ApplyReport) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("milter: %v modify actions failed, first: %w", len(r.Failed), r.Failed[0].Err)
+}
+
+var (
+	// ErrHeaderNotFound is reported when a header field to change or delete
+	// does not exist, by ApplyModifyActions and Modifier.
+	ErrHeaderNotFound = errors.New("milter: header field not found")
+	// ErrRcptNotFound is reported when a recipient to remove does not exist.
+	ErrRcptNotFound = errors.New("milter: apply: recipient not found")
+)
+
+// ApplyModifyActions applies modify actions to msg, following sendmail
+// semantics. Actions failing to apply are skipped and reported, so that the
+// caller can decide whether to deliver, tempfail or quarantine the message.
+func ApplyModifyActions(msg *MessageState, acts []ModifyAction) *ApplyReport {
+	report := &ApplyReport{}
+	var body []io.Reader
+	for _, act := range acts {
+		var err error
+		switch act.Code {
+		case ActChangeFrom:
+			msg.From = strings.Trim(act.From, "<>")
+			msg.FromArgs = act.FromArgs
+		case ActAddRcpt:
+			msg.Rcpts = append(msg.Rcpts, strings.Trim(act.Rcpt, "<>"))
+		case ActDelRcpt:
+			err = msg.delRcpt(strings.Trim(act.Rcpt, "<>"))
+		case ActAddHeader:
+			msg.Header = append(msg.Header, HeaderField{act.HeaderName, act.HeaderValue})
+		case ActInsertHeader:
+			msg.insertHeader(int(act.HeaderIndex), act.HeaderName, act.HeaderValue)
+		case ActChangeHeader:
+			err = msg.changeHeader(int(act.HeaderIndex), act.HeaderName, act.HeaderValue)
+		case ActReplBody:
+			body = append(body, bytes.NewReader(act.Body))
+		case ActQuarantine:
+			msg.Quarantine = act.Reason
+		default:
+			err = fmt.Errorf("milter: apply: unsupported modify action: %v", act.Code)
+		}
+
+		if err != nil {
+			report.Failed = append(report.Failed, ApplyFailure{Action: act, Err: err})
+		} else {
+			report.Applied = append(report.Applied, act)
+		}
+	}
+	if body != nil {
+		msg.Body = io.MultiReader(body...)
+	}
+	return report
+}
+
+func (msg *MessageState) delRcpt(rcpt string) error {
+	for i, r := range msg.Rcpts {
+		if strings.EqualFold(r, rcpt) {
+			msg.Rcpts = append(msg.Rcpts[:i], msg.Rcpts[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrRcptNotFound, rcpt)
+}
+
+// insertHeader inserts a field at the specified position, 0 being the top.
+func (msg *MessageState) insertHeader(index int, name, value string) {
+	if index > len(msg.Header) {
+		index = len(msg.Header)
+	}
+	msg.Header = append(msg.Header, HeaderField{})
+	copy(msg.Header[index+1:], msg.Header[index:])
+	msg.Header[index] = HeaderField{name, value}
+}
+
+// changeHeader changes the index-th field named name, index being 1-based.
+// An empty value deletes the field. If there are less than index fields, a
+// new one is appended.
+func (msg *MessageState) changeHeader(index int, name, value string) error {
+	if index < 1 {
+		return fmt.Errorf("milter: apply: invalid header index: %v", index)
+	}
+	n := 0
+	for i, f := range msg.Header {
+		if !strings.EqualFold(f.Key, name) {
+			continue
+		}
+		n++
+		if n != index {
+			continue
+		}
+		if value == "" {
+			msg.Header = append(msg.Header[:i], msg.Header[i+1:]...)
+		} else {
+			msg.Header[i].Value = value
+		}
+		return nil
+	}
+	if value == "" {
+		return fmt.Errorf("%w: %v #%v", ErrHeaderNotFound, name, index)
+	}
+	msg.Header = append(msg.Header, HeaderField{name, value})
+	return nil
+}
@@ -0,0 +1,47 @@
+package milter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestApplyModifyActions(t *testing.T) {
+	msg := MessageState{
+		From:  "from@example.org",
+		Rcpts: []string{"to1@example.org", "to2@example.org"},
+		Header: []HeaderField{
+			{"From", "from@example.org"},
+			{"Subject", "hello"},
+		},
+	}
+	report := ApplyModifyActions(&msg, []ModifyAction{
+		{Code: ActChangeHeader, HeaderIndex: 1, HeaderName: "Subject", HeaderValue: "***SPAM***"},
+		{Code: ActChangeHeader, HeaderIndex: 2, HeaderName: "Subject", HeaderValue: ""},
+		{Code: ActInsertHeader, HeaderIndex: 0, HeaderName: "X-First", HeaderValue: "1"},
+		{Code: ActDelRcpt, Rcpt: "<to1@example.org>"},
+		{Code: ActAddRcpt, Rcpt: "<to3@example.org>"},
+	})
+
+	if len(report.Applied) != 4 {
+		t.Fatal("Wrong amount of applied actions:", len(report.Applied))
+	}
+	if len(report.Failed) != 1 || !errors.Is(report.Failed[0].Err, ErrHeaderNotFound) {
+		t.Fatalf("Wrong failures: %+v", report.Failed)
+	}
+	if report.Err() == nil {
+		t.Fatal("Expected an error")
+	}
+
+	expectedHeader := []HeaderField{
+		{"X-First", "1"},
+		{"From", "from@example.org"},
+		{"Subject", "***SPAM***"},
+	}
+	if !reflect.DeepEqual(msg.Header, expectedHeader) {
+		t.Fatalf("Wrong header: %+v", msg.Header)
+	}
+	if expected := []string{"to2@example.org", "to3@example.org"}; !reflect.DeepEqual(msg.Rcpts, expected) {
+		t.Fatalf("Wrong recipients: %v", msg.Rcpts)
+	}
+}
@@ -0,0 +1,87 @@
+package milter
+
+import (
+	"time"
+)
+
+// AuditSink receives a record of the actions and modifications sent to the
+// MTA for each message, e.g. to write them to append-only storage and be
+// able to prove what the filter altered.
+//
+// Audit is called from the session goroutine once the message is complete
+// or aborted. Actions sent for the connection before the first message, such
+// as the response to the connect command, are reported in a separate record.
+type AuditSink interface {
+	Audit(rec *AuditRecord)
+}
+
+// AuditRecord lists the actions and modifications sent to the MTA for a
+// message, in order. It must not be modified.
+type AuditRecord struct {
+	// Filter identifies the filter, see Server.Name.
+	Filter    string
+	SessionID string
+	// QueueID is the queue ID of the message ("i" macro), empty if the MTA
+	// didn't send it.
+	QueueID string
+	Entries []AuditEntry
+}
+
+// AuditEntry is an action or a modification sent to the MTA. Either Action
+// or Modification is set.
+type AuditEntry struct {
+	Time time.Time
+	// Stage is the command the action or modification was sent for.
+	Stage        Code
+	Action       *Action
+	Modification *ModifyAction
+}
+
+// auditResponse records the response to a command, if Server.Audit is set.
+// Negotiation responses and self-test sessions are not recorded.
+func (m *milterSession) auditResponse(code Code, msg *Message) {
+	if m.server.Audit == nil || m.selfTest || code == CodeOptNeg {
+		return
+	}
+	msg = &Message{Code: msg.Code, Data: append([]byte(nil), msg.Data...)}
+	act, err := parseAction(msg, NULTruncate)
+	if err != nil {
+		act = &Action{Code: ActionCode(msg.Code)}
+	}
+	m.addAuditEntry(AuditEntry{Stage: code, Action: act})
+}
+
+// auditModification records a modification sent at end of message, if
+// Server.Audit is set.
+func (m *milterSession) auditModification(code ModifyActCode, data []byte) {
+	if m.server.Audit == nil || m.selfTest {
+		return
+	}
+	msg := &Message{Code: byte(code), Data: append([]byte(nil), data...)}
+	act, err := parseModifyAct(msg, NULTruncate)
+	if err != nil {
+		act = &ModifyAction{Code: code}
+	}
+	m.addAuditEntry(AuditEntry{Stage: CodeEOB, Modification: act})
+}
+
+func (m *milterSession) addAuditEntry(e AuditEntry) {
+	if m.audit == nil {
+		m.audit = &AuditRecord{Filter: m.server.Name, SessionID: m.id}
+	}
+	if id := m.macros.get("i"); id != "" {
+		m.audit.QueueID = id
+	}
+	e.Time = m.server.now()
+	m.audit.Entries = append(m.audit.Entries, e)
+}
+
+// flushAudit passes the pending audit record to Server.Audit.
+func (m *milterSession) flushAudit() {
+	if m.audit == nil {
+		return
+	}
+	rec := m.audit
+	m.audit = nil
+	m.server.Audit.Audit(rec)
+}
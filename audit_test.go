@@ -0,0 +1,102 @@
+package milter
+
+import (
+	"testing"
+)
+
+type chanAuditSink chan *AuditRecord
+
+func (s chanAuditSink) Audit(rec *AuditRecord) {
+	s <- rec
+}
+
+func TestServer_Audit(t *testing.T) {
+	mm := MockMilter{
+		ConnResp: RespContinue,
+		MailResp: RespContinue,
+		RcptResp: RespContinue,
+		BodyResp: RespAccept,
+		BodyMod: func(m *Modifier) {
+			m.AddHeader("X-Audit", "1")
+			m.Quarantine("suspicious")
+		},
+	}
+	sink := make(chanAuditSink, 10)
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Actions: OptAddHeader | OptQuarantine,
+		Name:    "test-filter",
+		Audit:   sink,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptAddHeader | OptQuarantine,
+	})
+	defer session.Close()
+
+	if _, err := session.Conn("mx.example.org", FamilyInet, 25, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Macros(CodeMail, "i", "ABCDEF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Rcpt("to@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.EndResult(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := <-sink
+	if len(conn.Entries) != 1 || conn.Entries[0].Stage != CodeConn || conn.Entries[0].Action.Code != ActContinue {
+		t.Fatalf("Wrong connection record: %+v", conn)
+	}
+
+	rec := <-sink
+	if rec.Filter != "test-filter" || rec.SessionID == "" || rec.QueueID != "ABCDEF" {
+		t.Fatalf("Wrong record: %+v", rec)
+	}
+	type entry struct {
+		stage  Code
+		action ActionCode
+		modify ModifyActCode
+	}
+	var entries []entry
+	for _, e := range rec.Entries {
+		if e.Time.IsZero() {
+			t.Error("Missing entry time")
+		}
+		var got entry
+		got.stage = e.Stage
+		if e.Action != nil {
+			got.action = e.Action.Code
+		}
+		if e.Modification != nil {
+			got.modify = e.Modification.Code
+		}
+		entries = append(entries, got)
+	}
+	expected := []entry{
+		{stage: CodeMail, action: ActContinue},
+		{stage: CodeRcpt, action: ActContinue},
+		{stage: CodeEOB, modify: ActAddHeader},
+		{stage: CodeEOB, modify: ActQuarantine},
+		{stage: CodeEOB, action: ActAccept},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Wrong entries: %+v", entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Errorf("Entry %v: got %+v, expected %+v", i, entries[i], expected[i])
+		}
+	}
+	if m := rec.Entries[2].Modification; m.HeaderName != "X-Audit" || m.HeaderValue != "1" {
+		t.Errorf("Wrong header modification: %+v", m)
+	}
+}
@@ -0,0 +1,123 @@
+package milter
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrHandshakeFailed is returned when the peer fails the authentication
+// handshake.
+var ErrHandshakeFailed = errors.New("milter: handshake: authentication failed")
+
+// Handshake is an authentication exchange performed on a connection before
+// milter negotiation, for deployments that need to authenticate the peer but
+// cannot use TLS client certificates.
+//
+// The same value is meant to be configured on both sides: the server runs
+// ServerHandshake on accepted connections and the client runs ClientHandshake
+// on new connections.
+type Handshake interface {
+	ServerHandshake(conn net.Conn) error
+	ClientHandshake(conn net.Conn) error
+}
+
+// SharedSecretHandshake is a Handshake proving knowledge of a shared secret
+// on both sides with a challenge-response exchange: the server sends a random
+// nonce, the client replies with its own nonce and an HMAC-SHA256 of both
+// keyed with the secret, and the server proves knowledge of the secret in
+// turn with an HMAC of both nonces. The MTA can thus tell a genuine filter
+// from an impostor.
+type SharedSecretHandshake struct {
+	Secret []byte
+
+	// Timeout for the whole exchange. Zero means no timeout.
+	Timeout time.Duration
+}
+
+var _ Handshake = (*SharedSecretHandshake)(nil)
+
+const handshakeNonceSize = 32
+
+// Labels binding the proofs to the side sending them, so that a proof cannot
+// be reflected back to its sender.
+const (
+	handshakeClientLabel = "milter client"
+	handshakeServerLabel = "milter server"
+)
+
+func (h *SharedSecretHandshake) setDeadline(conn net.Conn) func() {
+	if h.Timeout == 0 {
+		return func() {}
+	}
+	conn.SetDeadline(time.Now().Add(h.Timeout))
+	return func() {
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+func (h *SharedSecretHandshake) mac(label string, serverNonce, clientNonce []byte) []byte {
+	mac := hmac.New(sha256.New, h.Secret)
+	mac.Write([]byte(label))
+	mac.Write(serverNonce)
+	mac.Write(clientNonce)
+	return mac.Sum(nil)
+}
+
+// ServerHandshake implements Handshake.
+func (h *SharedSecretHandshake) ServerHandshake(conn net.Conn) error {
+	defer h.setDeadline(conn)()
+
+	serverNonce := make([]byte, handshakeNonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(serverNonce); err != nil {
+		return err
+	}
+
+	reply := make([]byte, handshakeNonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	clientNonce, proof := reply[:handshakeNonceSize], reply[handshakeNonceSize:]
+	if !hmac.Equal(proof, h.mac(handshakeClientLabel, serverNonce, clientNonce)) {
+		return ErrHandshakeFailed
+	}
+	_, err := conn.Write(h.mac(handshakeServerLabel, serverNonce, clientNonce))
+	return err
+}
+
+// ClientHandshake implements Handshake.
+func (h *SharedSecretHandshake) ClientHandshake(conn net.Conn) error {
+	defer h.setDeadline(conn)()
+
+	serverNonce := make([]byte, handshakeNonceSize)
+	if _, err := io.ReadFull(conn, serverNonce); err != nil {
+		return err
+	}
+	clientNonce := make([]byte, handshakeNonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+	reply := append(clientNonce, h.mac(handshakeClientLabel, serverNonce, clientNonce)...)
+	if _, err := conn.Write(reply); err != nil {
+		return err
+	}
+
+	// The server closes the connection if our proof is wrong
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrHandshakeFailed
+	} else if err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, h.mac(handshakeServerLabel, serverNonce, clientNonce)) {
+		return ErrHandshakeFailed
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package milter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message"
+	msgtextproto "github.com/emersion/go-message/textproto"
+)
+
+// ErrBodyNotBuffered is returned by Modifier.BodyReader if Server.BufferBody
+// is not set.
+var ErrBodyNotBuffered = errors.New("milter: body not buffered")
+
+// Default size of the body kept in memory before spilling to disk.
+const defaultBodyMemoryLimit = 1024 * 1024
+
+// bodyBuffer buffers the body of the current message, in memory up to a
+// limit and then in a temporary file.
+type bodyBuffer struct {
+	limit int
+	files *tempFiles
+
+	mem  bytes.Buffer
+	file *TempFile
+	size int64
+	err  error
+}
+
+func newBodyBuffer(limit int, files *tempFiles) *bodyBuffer {
+	if limit == 0 {
+		limit = defaultBodyMemoryLimit
+	}
+	return &bodyBuffer{limit: limit, files: files}
+}
+
+func (b *bodyBuffer) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.file == nil && b.mem.Len()+len(p) > b.limit {
+		b.file, b.err = b.files.Create()
+		if b.err == nil {
+			_, b.err = b.file.Write(b.mem.Bytes())
+		}
+		b.mem.Reset()
+		if b.err != nil {
+			return 0, b.err
+		}
+	}
+
+	var n int
+	if b.file != nil {
+		n, b.err = b.file.Write(p)
+	} else {
+		n, _ = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, b.err
+}
+
+// Reader returns a reader over the whole buffered body.
+func (b *bodyBuffer) Reader() (io.Reader, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.file != nil {
+		return io.NewSectionReader(b.file.f, 0, b.size), nil
+	}
+	return bytes.NewReader(b.mem.Bytes()), nil
+}
+
+// Reset discards the buffered body. The temporary file is removed with the
+// other temporary files of the message.
+func (b *bodyBuffer) Reset() {
+	b.mem.Reset()
+	b.file = nil
+	b.size = 0
+	b.err = nil
+}
+
+// BodyReader returns a reader over the complete body of the message, at end
+// of message. Server.BufferBody must be set. The body is incomplete if
+// BodyChunk returned RespSkip and the MTA supports skipping.
+func (m *Modifier) BodyReader() (io.Reader, error) {
+	if m.body == nil {
+		return nil, ErrBodyNotBuffered
+	}
+	return m.body.Reader()
+}
+
+// MessageReader returns a reader over the complete message at end of
+// message: the header fields in the order they were received, followed by
+// the body. Server.BufferBody must be set. Line endings are CRLF.
+func (m *Modifier) MessageReader() (io.Reader, error) {
+	body, err := m.BodyReader()
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr bytes.Buffer
+	for _, f := range m.headers {
+		hdr.WriteString(rawHeaderField(f, m.protocol))
+	}
+	hdr.WriteString("\r\n")
+	return io.MultiReader(&hdr, body), nil
+}
+
+// rawHeaderField formats a header field as received by the MTA, including
+// the trailing CRLF.
+func rawHeaderField(f HeaderField, protocol OptProtocol) string {
+	value := f.Value
+	// the MTA strips the space following the colon, unless
+	// OptHeaderLeadingSpace is negotiated
+	if protocol&OptHeaderLeadingSpace == 0 {
+		value = " " + value
+	}
+	value = strings.ReplaceAll(value, "\r\n", "\n")
+	value = strings.ReplaceAll(value, "\n", "\r\n")
+	return f.Key + ":" + value + "\r\n"
+}
+
+// orderedHeader returns the header fields as a textproto.Header, in the
+// order they were received and with their original casing.
+func orderedHeader(fields []HeaderField, protocol OptProtocol) msgtextproto.Header {
+	var h msgtextproto.Header
+	// AddRaw prepends the field to the header
+	for i := len(fields) - 1; i >= 0; i-- {
+		h.AddRaw([]byte(rawHeaderField(fields[i], protocol)))
+	}
+	return h
+}
+
+// Entity parses the complete message at end of message, see MessageReader.
+// As with message.Read, an error for which message.IsUnknownCharset or
+// message.IsUnknownEncoding returns true can be ignored, the entity is
+// still usable.
+func (m *Modifier) Entity() (*message.Entity, error) {
+	r, err := m.MessageReader()
+	if err != nil {
+		return nil, err
+	}
+	return message.Read(r)
+}
@@ -0,0 +1,80 @@
+package milter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"text/template"
+)
+
+// ErrUnknownReason is returned by ReplyCatalog when a reason is not
+// registered.
+var ErrUnknownReason = errors.New("milter: reply catalog: unknown reason")
+
+// ReplyCatalog maps internal policy reasons to SMTP replies, so that the
+// wording of rejections can be managed in a single place and shared between
+// filters.
+//
+// ReplyCatalog must not be modified once in use.
+type ReplyCatalog struct {
+	replies map[string]*catalogReply
+}
+
+type catalogReply struct {
+	code     int
+	enhanced string
+	text     *template.Template
+}
+
+// Add registers the SMTP reply for reason. code must be a 4xx or 5xx SMTP
+// code, enhanced is an optional enhanced status code such as "5.7.1" and text
+// is a text/template executed with the data passed to Response.
+func (c *ReplyCatalog) Add(reason string, code int, enhanced, text string) error {
+	if code < 400 || code > 599 {
+		return fmt.Errorf("milter: reply catalog: invalid SMTP code for %q: %v", reason, code)
+	}
+	if enhanced != "" && !validEnhancedCode(code/100, enhanced) {
+		return fmt.Errorf("milter: reply catalog: invalid enhanced status code for %q: %q", reason, enhanced)
+	}
+	tmpl, err := template.New(reason).Parse(text)
+	if err != nil {
+		return fmt.Errorf("milter: reply catalog: %w", err)
+	}
+	if c.replies == nil {
+		c.replies = make(map[string]*catalogReply)
+	}
+	c.replies[reason] = &catalogReply{code: code, enhanced: enhanced, text: tmpl}
+	return nil
+}
+
+// Reply returns the SMTP code and text registered for reason, with the
+// enhanced status code prepended to the text.
+func (c *ReplyCatalog) Reply(reason string, data interface{}) (int, string, error) {
+	r, ok := c.replies[reason]
+	if !ok {
+		return 0, "", fmt.Errorf("%w: %q", ErrUnknownReason, reason)
+	}
+	var buf bytes.Buffer
+	if r.enhanced != "" {
+		buf.WriteString(r.enhanced + " ")
+	}
+	if err := r.text.Execute(&buf, data); err != nil {
+		return 0, "", fmt.Errorf("milter: reply catalog: %w", err)
+	}
+	return r.code, buf.String(), nil
+}
+
+// Response returns a milter response carrying the SMTP reply registered for
+// reason.
+func (c *ReplyCatalog) Response(reason string, data interface{}) (Response, error) {
+	code, text, err := c.Reply(reason, data)
+	if err != nil {
+		return nil, err
+	}
+	reply := strconv.Itoa(code) + " " + text
+	if err := checkReply(0, reply); err != nil {
+		return nil, err
+	}
+	return NewResponseStr(byte(ActReplyCode), reply), nil
+}
@@ -0,0 +1,32 @@
+package milter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplyCatalog(t *testing.T) {
+	var c ReplyCatalog
+	if err := c.Add("spam", 550, "5.7.1", "Message rejected as spam (score {{.}})"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("bad", 250, "", "OK"); err == nil {
+		t.Fatal("Expected error for non-failure SMTP code")
+	}
+
+	resp, err := c.Response("spam", 12.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := resp.Response()
+	if ActionCode(msg.Code) != ActReplyCode {
+		t.Fatal("Unexpected code:", msg.Code)
+	}
+	if s := string(msg.Data); s != "550 5.7.1 Message rejected as spam (score 12.5)\x00" {
+		t.Fatalf("Wrong reply: %q", s)
+	}
+
+	if _, err := c.Response("virus", nil); !errors.Is(err, ErrUnknownReason) {
+		t.Fatalf("Expected ErrUnknownReason, got %v", err)
+	}
+}
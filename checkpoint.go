@@ -0,0 +1,77 @@
+package milter
+
+import (
+	"time"
+)
+
+// SessionState is a checkpoint of the negotiated options and envelope of a
+// server session.
+type SessionState struct {
+	ID      string
+	Start   time.Time
+	Version uint32
+
+	Actions  OptAction
+	Protocol OptProtocol
+
+	// InMessage is set if a message was in progress when the checkpoint was
+	// taken, with the following envelope.
+	InMessage bool
+	QueueID   string
+	From      string
+	Rcpts     []string
+}
+
+// SessionStore persists checkpoints of the sessions of a server, typically to
+// disk. After a crash or restart, the checkpoints left in the store describe
+// the sessions that were interrupted, which allows proxies and filters to
+// report or tempfail the messages that were in flight.
+//
+// Checkpoints are saved after negotiation and whenever the envelope changes,
+// and deleted when the session ends normally. SessionStore methods are called
+// concurrently by different sessions.
+type SessionStore interface {
+	Save(st *SessionState) error
+	Delete(id string) error
+}
+
+// checkpoint saves the session state after a command changing it
+func (m *milterSession) checkpoint(code Code) {
+	store := m.server.SessionStore
+	if store == nil || m.selfTest {
+		return
+	}
+	switch code {
+	case CodeOptNeg, CodeMail, CodeRcpt, CodeEOB, CodeAbort, CodeQuitNewConn:
+	default:
+		return
+	}
+
+	st := &SessionState{
+		ID:       m.id,
+		Start:    m.start,
+		Version:  m.version,
+		Actions:  m.actions,
+		Protocol: m.protocol,
+	}
+	// the session is still in the message until the response to EOB is
+	// written
+	if m.inMessage() && code != CodeEOB {
+		st.InMessage = true
+		st.QueueID = m.macros.get("i")
+		st.From = m.envFrom
+		st.Rcpts = append([]string(nil), m.envRcpts...)
+	}
+	if err := store.Save(st); err != nil {
+		m.logf("Error saving session checkpoint: %v", err)
+	}
+}
+
+// deleteCheckpoint removes the session state once the session is over
+func (m *milterSession) deleteCheckpoint() {
+	if store := m.server.SessionStore; store != nil && !m.selfTest {
+		if err := store.Delete(m.id); err != nil {
+			m.logf("Error deleting session checkpoint: %v", err)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package milter
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 	"time"
 
@@ -14,6 +17,32 @@ import (
 
 var ErrUnsupportedMilterVersion = fmt.Errorf("milter: negotiate: unsupported milter version")
 
+// ErrNegotiationPolicy is returned when the peer does not satisfy the minimum
+// protocol version or required actions.
+var ErrNegotiationPolicy = errors.New("milter: negotiate: peer does not satisfy negotiation policy")
+
+// NegotiationError is returned when option negotiation fails, on the client
+// and the server side. It carries the raw options offered by the peer, so
+// that failures can tell which side is outdated.
+type NegotiationError struct {
+	// Underlying error, e.g. ErrUnsupportedMilterVersion or
+	// ErrNegotiationPolicy.
+	Err error
+
+	// Options offered by the peer.
+	Version  uint32
+	Actions  OptAction
+	Protocol OptProtocol
+}
+
+func (err *NegotiationError) Error() string {
+	return fmt.Sprintf("%v (peer version %v, actions 0x%x, protocol 0x%x)", err.Err, err.Version, uint32(err.Actions), uint32(err.Protocol))
+}
+
+func (err *NegotiationError) Unwrap() error {
+	return err.Err
+}
+
 // Client is a wrapper for managing milter connections.
 //
 // Currently, it just creates new connections using provided Dialer.
@@ -27,12 +56,116 @@ type Dialer interface {
 	Dial(network string, addr string) (net.Conn, error)
 }
 
+// AbortPolicy controls when ClientSession.Close and ClientSession.Reset send
+// Abort to the milter.
+type AbortPolicy int
+
+const (
+	// AbortMidMessage sends Abort only if a message is in progress, that is
+	// Mail was called and the message was not concluded by End or a terminal
+	// action. Rejecting a single recipient doesn't conclude the message.
+	AbortMidMessage AbortPolicy = iota
+	// AbortAlways always sends Abort.
+	AbortAlways
+	// AbortNever never sends Abort.
+	AbortNever
+)
+
+// BudgetPolicy controls what happens when a milter exceeds the modify action
+// budget of ClientOptions.
+type BudgetPolicy int
+
+const (
+	// BudgetDrop drops the excess modify actions. ClientSession.BudgetExceeded
+	// reports whether actions were dropped.
+	BudgetDrop BudgetPolicy = iota
+	// BudgetFail makes End fail with ErrBudgetExceeded.
+	BudgetFail
+)
+
+// ErrBudgetExceeded is returned by End when the milter exceeds the modify
+// action budget and BudgetFail is used.
+var ErrBudgetExceeded = errors.New("milter: modify action budget exceeded")
+
 type ClientOptions struct {
 	Dialer       Dialer
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	ActionMask   OptAction
 	ProtocolMask OptProtocol
+
+	// NULPolicy controls how strings with embedded or missing NUL characters
+	// received from the milter are handled.
+	NULPolicy NULPolicy
+
+	// MaxPacketSize is the maximum size in bytes of packets accepted from the
+	// milter. Larger packets fail with *PacketSizeError. Zero means 1 MiB,
+	// a negative value disables the limit.
+	MaxPacketSize int
+
+	// By default, once the milter returns a terminal action (anything but
+	// ActContinue or ActSkip) for a header field, end of headers or body
+	// chunk, Abort is sent automatically and the remaining header and body
+	// calls of the message return that action without contacting the milter.
+	//
+	// DiagnosticMode disables this: all header fields and body chunks are
+	// sent anyway and Header and BodyReadFrom report the first terminal action.
+	// Some milters may misbehave when receiving data after a terminal action.
+	DiagnosticMode bool
+
+	// AbortPolicy controls when Close and Reset send Abort. Some milters
+	// misbehave when receiving Abort after a completed message, others
+	// require it.
+	AbortPolicy AbortPolicy
+
+	// Handshake, if set, is performed on new connections before milter
+	// negotiation.
+	Handshake Handshake
+
+	// TLSConfig, if set, secures connections to the milter with TLS. If
+	// ServerName is empty, it defaults to the host of the milter address.
+	// Set Certificates for mutual TLS.
+	TLSConfig *tls.Config
+
+	// MinVersion is the minimum protocol version the milter must support.
+	// Zero means any version.
+	MinVersion uint32
+	// RequiredActions lists actions the milter must request. Sessions not
+	// satisfying MinVersion or RequiredActions fail with ErrNegotiationPolicy
+	// instead of silently operating with reduced capability.
+	RequiredActions OptAction
+
+	// FallbackV2, if set, makes the client retry negotiation once with a new
+	// connection if the milter rejects the options offered, by closing the
+	// connection, replying with an error or supporting an older version. The
+	// retry offers protocol version 2 and the v2 actions and protocol options
+	// only, for compatibility with ancient milters.
+	FallbackV2 bool
+
+	// ProfilerLabels, if set, makes End run with runtime/pprof labels naming
+	// the milter address ("milter.peer") and the stage ("milter.stage"), so
+	// that profiles can be attributed to milters. The labels of the calling
+	// goroutine are replaced for the duration of the call.
+	ProfilerLabels bool
+
+	// Extensions, if set, decodes vendor-specific modify actions.
+	Extensions *Extensions
+
+	// MaxModifyActions caps the number of modify actions accepted per message,
+	// not counting replacement body chunks. Zero means no limit.
+	MaxModifyActions int
+	// MaxReplacementBody caps the total size in bytes of the replacement
+	// body accepted per message. Once exceeded, the body replacement is
+	// dropped entirely rather than truncated. Zero means no limit.
+	MaxReplacementBody int
+	// BudgetPolicy controls what happens when MaxModifyActions or
+	// MaxReplacementBody is exceeded.
+	BudgetPolicy BudgetPolicy
+
+	// NoRcptPolicy controls what happens when the modify actions of the
+	// milter would leave a message without recipients. It applies to
+	// ClientSession.EndResult and Transaction.Replay.
+	NoRcptPolicy NoRcptPolicy
 }
 
 var defaultOptions = ClientOptions{
@@ -76,21 +209,94 @@ func (c *Client) Session() (*ClientSession, error) {
 		readTimeout:           c.opts.ReadTimeout,
 		writeTimeout:          c.opts.WriteTimeout,
 		clientProtocolVersion: 6,
+		nulPolicy:             c.opts.NULPolicy,
+		maxPacketSize:         maxPacketSize(c.opts.MaxPacketSize),
+		diagnosticMode:        c.opts.DiagnosticMode,
+		abortPolicy:           c.opts.AbortPolicy,
+		maxModifyActs:         c.opts.MaxModifyActions,
+		maxReplBody:           c.opts.MaxReplacementBody,
+		budgetPolicy:          c.opts.BudgetPolicy,
+		noRcptPolicy:          c.opts.NoRcptPolicy,
+		profilerLabels:        c.opts.ProfilerLabels,
+		extensions:            c.opts.Extensions,
 	}
 
 	// TODO(foxcpp): Connection pooling.
 
+	if err := c.connect(s); err != nil {
+		return nil, err
+	}
+	if err := s.negotiate(c.opts.ActionMask, c.opts.ProtocolMask); err != nil {
+		s.conn.Close()
+		if !c.opts.FallbackV2 {
+			return nil, err
+		}
+		// retry once with a new connection and a conservative feature set
+		s.clientProtocolVersion = 2
+		if err := c.connect(s); err != nil {
+			return nil, err
+		}
+		if err := s.negotiate(c.opts.ActionMask&v2ActionMask, c.opts.ProtocolMask&v2ProtocolMask); err != nil {
+			s.conn.Close()
+			return nil, err
+		}
+	}
+	if s.clientProtocolVersion < c.opts.MinVersion {
+		s.Close()
+		return nil, s.negotiationError(fmt.Errorf("%w: version %v < %v", ErrNegotiationPolicy, s.clientProtocolVersion, c.opts.MinVersion))
+	}
+	if missing := c.opts.RequiredActions &^ s.ActionOpts; missing != 0 {
+		s.Close()
+		return nil, s.negotiationError(fmt.Errorf("%w: missing actions 0x%x", ErrNegotiationPolicy, uint32(missing)))
+	}
+
+	return s, nil
+}
+
+// connect dials a new connection for s and performs the handshake.
+func (c *Client) connect(s *ClientSession) error {
 	conn, err := c.opts.Dialer.Dial(c.network, c.address)
 	if err != nil {
-		return nil, fmt.Errorf("milter: session create: %w", err)
+		return fmt.Errorf("milter: session create: %w", err)
+	}
+
+	if c.opts.TLSConfig != nil {
+		conn, err = c.tlsHandshake(conn)
+		if err != nil {
+			return fmt.Errorf("milter: session create: %w", err)
+		}
 	}
 
 	s.conn = conn
-	if err := s.negotiate(c.opts.ActionMask, c.opts.ProtocolMask); err != nil {
-		return nil, err
+	if c.opts.Handshake != nil {
+		if err := c.opts.Handshake.ClientHandshake(conn); err != nil {
+			conn.Close()
+			return fmt.Errorf("milter: session create: %w", err)
+		}
 	}
+	return nil
+}
 
-	return s, nil
+// tlsHandshake secures conn with TLS. It closes conn on error.
+func (c *Client) tlsHandshake(conn net.Conn) (net.Conn, error) {
+	config := c.opts.TLSConfig
+	if config.ServerName == "" && !config.InsecureSkipVerify && c.network != "unix" {
+		host, _, err := net.SplitHostPort(c.address)
+		if err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	tc := tls.Client(conn, config)
+	if c.opts.ReadTimeout != 0 {
+		tc.SetDeadline(time.Now().Add(c.opts.ReadTimeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
 }
 
 func (c *Client) Close() error {
@@ -107,12 +313,44 @@ type ClientSession struct {
 	// Bitmask of negotiated protocol options.
 	ProtocolOpts OptProtocol
 
-	needAbort bool
+	// Macros requested by the milter for each stage, if OptSetSymList was
+	// negotiated. The MTA should only send the listed macros.
+	MacroRequests map[Code][]string
+
+	needAbort   bool
+	abortPolicy AbortPolicy
 
 	readTimeout  time.Duration
 	writeTimeout time.Duration
 	// Milter client version. Can be downgraded during negotiation
 	clientProtocolVersion uint32
+	// Protocol version offered by the milter.
+	milterVersion uint32
+
+	nulPolicy     NULPolicy
+	maxPacketSize uint32
+
+	// queueID is the last value sent for the "i" macro, for MilterError.
+	queueID string
+
+	diagnosticMode bool
+
+	maxModifyActs  int
+	maxReplBody    int
+	budgetPolicy   BudgetPolicy
+	budgetExceeded bool
+
+	noRcptPolicy NoRcptPolicy
+
+	profilerLabels bool
+
+	extensions *Extensions
+	// Terminal action received for the data of the current message.
+	terminalAct *Action
+	// Recipients of the current message accepted by the milter.
+	rcpts []string
+	// Recipients of the current message rejected by the milter.
+	rejectedRcpts []RcptRejection
 }
 
 // negotiate exchanges OPTNEG messages with the milter and sets s.mask to the
@@ -128,11 +366,11 @@ func (s *ClientSession) negotiate(actionMask OptAction, protoMask OptProtocol) e
 	binary.BigEndian.PutUint32(msg.Data[8:], uint32(protoMask))
 
 	if err := writePacket(s.conn, msg, s.writeTimeout); err != nil {
-		return fmt.Errorf("milter: negotiate: optneg write: %w", err)
+		return s.stageError(CodeOptNeg, "write", err)
 	}
-	msg, err := readPacket(s.conn, s.readTimeout)
+	msg, err := readPacket(s.conn, s.readTimeout, s.maxPacketSize)
 	if err != nil {
-		return fmt.Errorf("milter: negotiate: optneg read: %w", err)
+		return s.stageError(CodeOptNeg, "read", err)
 	}
 	if Code(msg.Code) != CodeOptNeg {
 		return fmt.Errorf("milter: negotiate: unexpected code: %v", rune(msg.Code))
@@ -142,27 +380,44 @@ func (s *ClientSession) negotiate(actionMask OptAction, protoMask OptProtocol) e
 	}
 
 	milterVersion := binary.BigEndian.Uint32(msg.Data[:4])
+	s.milterVersion = milterVersion
 	milterActionMask := binary.BigEndian.Uint32(msg.Data[4:])
 	s.ActionOpts = OptAction(milterActionMask)
 	milterProtoMask := binary.BigEndian.Uint32(msg.Data[8:])
 	s.ProtocolOpts = OptProtocol(milterProtoMask)
 
+	if s.ActionOpts&OptSetSymList != 0 {
+		s.MacroRequests, err = parseMacroRequests(msg.Data[12:], s.nulPolicy)
+		if err != nil {
+			return err
+		}
+	}
+
 	// If milter advertises lower protocol version than we support, try to downgrade.
 	if milterVersion < s.clientProtocolVersion {
 		// Only downgrade if both sides support the same actions and protocols.
 		// The lowest supported milterVersion is 2.
-		if milterVersion >= 2 && actionMask&0x3f == actionMask && protoMask&0x7f == protoMask {
+		if milterVersion >= 2 && actionMask&v2ActionMask == actionMask && protoMask&v2ProtocolMask == protoMask {
 			s.clientProtocolVersion = milterVersion
 		} else {
-			return ErrUnsupportedMilterVersion
+			return s.negotiationError(ErrUnsupportedMilterVersion)
 		}
 	}
 
-	s.needAbort = true
-
 	return nil
 }
 
+// negotiationError wraps err in a *NegotiationError with the options
+// offered by the milter.
+func (s *ClientSession) negotiationError(err error) error {
+	return &NegotiationError{
+		Err:      err,
+		Version:  s.milterVersion,
+		Actions:  s.ActionOpts,
+		Protocol: s.ProtocolOpts,
+	}
+}
+
 // ProtocolOption checks whether the option is set in negotiated options, that
 // is, requested by both sides.
 func (s *ClientSession) ProtocolOption(opt OptProtocol) bool {
@@ -186,9 +441,14 @@ func (s *ClientSession) Macros(code Code, kv ...string) error {
 	for _, str := range kv {
 		msg.Data = appendCString(msg.Data, str)
 	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i] == "i" || kv[i] == "{i}" {
+			s.queueID = kv[i+1]
+		}
+	}
 
 	if err := writePacket(s.conn, msg, s.writeTimeout); err != nil {
-		return fmt.Errorf("milter: macros: %w", err)
+		return s.stageError(CodeMacro, "write", err)
 	}
 
 	return nil
@@ -211,41 +471,41 @@ type Action struct {
 
 func (s *ClientSession) readAction() (*Action, error) {
 	for {
-		msg, err := readPacket(s.conn, s.readTimeout)
+		msg, err := readPacket(s.conn, s.readTimeout, s.maxPacketSize)
 		if err != nil {
-			return nil, fmt.Errorf("action read: %w", err)
+			return nil, err
 		}
 		if msg.Code == 'p' /* progress */ {
 			continue
 		}
-		if ActionCode(msg.Code) != ActContinue {
-			s.needAbort = false
-		}
 
-		return parseAction(msg)
+		return parseAction(msg, s.nulPolicy)
 	}
 }
 
-func parseAction(msg *Message) (*Action, error) {
+func parseAction(msg *Message, nulPolicy NULPolicy) (*Action, error) {
 	act := &Action{
 		Code: ActionCode(msg.Code),
 	}
 	var err error
 
 	switch ActionCode(msg.Code) {
-	case ActAccept, ActContinue, ActDiscard, ActReject, ActTempFail:
+	case ActAccept, ActContinue, ActDiscard, ActReject, ActTempFail, ActSkip:
 	case ActReplyCode:
 		if len(msg.Data) <= 4 {
-			return nil, fmt.Errorf("action read: unexpected data length: %v", len(msg.Data))
+			return nil, fmt.Errorf("unexpected data length: %v", len(msg.Data))
 		}
 		act.SMTPCode, err = strconv.Atoi(string(msg.Data[:3]))
 		if err != nil {
-			return nil, fmt.Errorf("action read: malformed SMTP code: %v", msg.Data[:3])
+			return nil, fmt.Errorf("malformed SMTP code: %v", msg.Data[:3])
 		}
 		// There is 0x20 (' ') in between.
-		act.SMTPText = readCString(msg.Data[4:])
+		act.SMTPText, err = nulPolicy.readString(msg.Data[4:])
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
 	default:
-		return nil, fmt.Errorf("action read: unexpected code: %v", msg.Code)
+		return nil, fmt.Errorf("unexpected code: %v", msg.Code)
 	}
 
 	return act, nil
@@ -272,13 +532,13 @@ func (s *ClientSession) Conn(hostname string, family ProtoFamily, port uint16, a
 	}
 
 	if err := writePacket(s.conn, msg, s.writeTimeout); err != nil {
-		return nil, fmt.Errorf("milter: conn: %w", err)
+		return nil, s.stageError(CodeConn, "write", err)
 	}
 
 	if !s.ProtocolOption(OptNoConnReply) {
 		act, err := s.readAction()
 		if err != nil {
-			return nil, fmt.Errorf("milter: conn: %w", err)
+			return nil, s.stageError(CodeConn, "read", err)
 		}
 		return act, nil
 	}
@@ -301,13 +561,13 @@ func (s *ClientSession) Helo(helo string) (*Action, error) {
 	}
 
 	if err := writePacket(s.conn, msg, s.writeTimeout); err != nil {
-		return nil, fmt.Errorf("milter: helo: %w", err)
+		return nil, s.stageError(CodeHelo, "write", err)
 	}
 
 	if !s.ProtocolOption(OptNoHeloReply) {
 		act, err := s.readAction()
 		if err != nil {
-			return nil, fmt.Errorf("milter: helo: %w", err)
+			return nil, s.stageError(CodeHelo, "read", err)
 		}
 		return act, nil
 	}
@@ -315,6 +575,11 @@ func (s *ClientSession) Helo(helo string) (*Action, error) {
 }
 
 func (s *ClientSession) Mail(sender string, esmtpArgs []string) (*Action, error) {
+	s.terminalAct = nil
+	s.needAbort = true
+	s.rcpts = nil
+	s.rejectedRcpts = nil
+
 	if s.ProtocolOpts&OptNoMailFrom != 0 {
 		return &Action{Code: ActContinue}, nil
 	}
@@ -329,13 +594,17 @@ func (s *ClientSession) Mail(sender string, esmtpArgs []string) (*Action, error)
 	}
 
 	if err := writePacket(s.conn, msg, s.writeTimeout); err != nil {
-		return nil, fmt.Errorf("milter: mail: %w", err)
+		return nil, s.stageError(CodeMail, "write", err)
 	}
 
 	if !s.ProtocolOption(OptNoMailReply) {
 		act, err := s.readAction()
 		if err != nil {
-			return nil, fmt.Errorf("milter: mail: %w", err)
+			return nil, s.stageError(CodeMail, "read", err)
+		}
+		if act.Code != ActContinue && act.Code != ActSkip {
+			// the milter is done with this message
+			s.needAbort = false
 		}
 		return act, nil
 	}
@@ -343,6 +612,20 @@ func (s *ClientSession) Mail(sender string, esmtpArgs []string) (*Action, error)
 }
 
 func (s *ClientSession) Rcpt(rcpt string, esmtpArgs []string) (*Action, error) {
+	act, err := s.rcpt(rcpt, esmtpArgs)
+	if err != nil {
+		return nil, err
+	}
+	switch act.Code {
+	case ActContinue, ActAccept, ActSkip:
+		s.rcpts = append(s.rcpts, rcpt)
+	case ActReject, ActTempFail, ActReplyCode:
+		s.rejectedRcpts = append(s.rejectedRcpts, RcptRejection{Addr: rcpt, Action: act})
+	}
+	return act, nil
+}
+
+func (s *ClientSession) rcpt(rcpt string, esmtpArgs []string) (*Action, error) {
 	if s.ProtocolOpts&OptNoRcptTo != 0 {
 		return &Action{Code: ActContinue}, nil
 	}
@@ -357,13 +640,38 @@ func (s *ClientSession) Rcpt(rcpt string, esmtpArgs []string) (*Action, error) {
 	}
 
 	if err := writePacket(s.conn, msg, s.writeTimeout); err != nil {
-		return nil, fmt.Errorf("milter: rcpt: %w", err)
+		return nil, s.stageError(CodeRcpt, "write", err)
 	}
 
 	if !s.ProtocolOption(OptNoRcptReply) {
 		act, err := s.readAction()
 		if err != nil {
-			return nil, fmt.Errorf("milter: rcpt: %w", err)
+			return nil, s.stageError(CodeRcpt, "read", err)
+		}
+		return act, nil
+	}
+	return &Action{Code: ActContinue}, nil
+}
+
+// Unknown sends an SMTP command not recognized by the MTA to the milter.
+func (s *ClientSession) Unknown(cmd string) (*Action, error) {
+	if s.ProtocolOpts&OptNoUnknown != 0 {
+		return &Action{Code: ActContinue}, nil
+	}
+
+	msg := &Message{
+		Code: byte(CodeUnknown),
+		Data: appendCString(nil, cmd),
+	}
+
+	if err := writePacket(s.conn, msg, s.writeTimeout); err != nil {
+		return nil, s.stageError(CodeUnknown, "write", err)
+	}
+
+	if !s.ProtocolOption(OptNoUnknownReply) {
+		act, err := s.readAction()
+		if err != nil {
+			return nil, s.stageError(CodeUnknown, "read", err)
 		}
 		return act, nil
 	}
@@ -379,6 +687,9 @@ func (s *ClientSession) HeaderField(key, value string) (*Action, error) {
 	if s.ProtocolOpts&OptNoHeaders != 0 {
 		return &Action{Code: ActContinue}, nil
 	}
+	if act := s.stoppedAction(); act != nil {
+		return act, nil
+	}
 
 	msg := &Message{
 		Code: byte(CodeHeader),
@@ -387,15 +698,15 @@ func (s *ClientSession) HeaderField(key, value string) (*Action, error) {
 	msg.Data = appendCString(msg.Data, value)
 
 	if err := writePacket(s.conn, msg, s.writeTimeout); err != nil {
-		return nil, fmt.Errorf("milter: header field: %w", err)
+		return nil, s.stageError(CodeHeader, "write", err)
 	}
 
 	if !s.ProtocolOption(OptNoHeaderReply) {
 		act, err := s.readAction()
 		if err != nil {
-			return nil, fmt.Errorf("milter: header field: %w", err)
+			return nil, s.stageError(CodeHeader, "read", err)
 		}
-		return act, nil
+		return s.checkTerminal(act)
 	}
 	return &Action{Code: ActContinue}, nil
 }
@@ -407,25 +718,30 @@ func (s *ClientSession) HeaderEnd() (*Action, error) {
 	if s.ProtocolOpts&OptNoEOH != 0 {
 		return &Action{Code: ActContinue}, nil
 	}
+	if act := s.stoppedAction(); act != nil {
+		return act, nil
+	}
 
 	if err := writePacket(s.conn, &Message{
 		Code: byte(CodeEOH),
 	}, s.writeTimeout); err != nil {
-		return nil, fmt.Errorf("milter: header end: %w", err)
+		return nil, s.stageError(CodeEOH, "write", err)
 	}
 
 	if !s.ProtocolOption(OptNoEOHReply) {
 		act, err := s.readAction()
 		if err != nil {
-			return nil, fmt.Errorf("milter: header end: %w", err)
+			return nil, s.stageError(CodeEOH, "read", err)
 		}
-		return act, nil
+		return s.checkTerminal(act)
 	}
 	return &Action{Code: ActContinue}, nil
 }
 
 // Header sends each field from textproto.Header followed by EOH unless
 // header messages are disabled during negotiation.
+//
+// Sending stops at the first terminal action, unless DiagnosticMode is set.
 func (s *ClientSession) Header(hdr textproto.Header) (*Action, error) {
 	for f := hdr.Fields(); f.Next(); {
 		act, err := s.HeaderField(f.Key(), f.Value())
@@ -433,12 +749,19 @@ func (s *ClientSession) Header(hdr textproto.Header) (*Action, error) {
 			return nil, err
 		}
 
-		if act.Code != ActContinue {
+		if act.Code != ActContinue && !s.diagnosticMode {
 			return act, nil
 		}
 	}
 
-	return s.HeaderEnd()
+	act, err := s.HeaderEnd()
+	if err != nil {
+		return nil, err
+	}
+	if s.terminalAct != nil {
+		return s.terminalAct, nil
+	}
+	return act, nil
 }
 
 // BodyChunk sends a single body chunk to the milter.
@@ -453,24 +776,28 @@ func (s *ClientSession) BodyChunk(chunk []byte) (*Action, error) {
 		return &Action{Code: ActContinue}, nil
 	}
 
+	if act := s.stoppedAction(); act != nil {
+		return act, nil
+	}
+
 	// Callers tend to be irresponsible... /s
 	if len(chunk) > MaxBodyChunk {
-		return nil, fmt.Errorf("milter: body chunk: too big body chunk: %v", len(chunk))
+		return nil, s.stageError(CodeBody, "", fmt.Errorf("too big body chunk: %v", len(chunk)))
 	}
 
 	if err := writePacket(s.conn, &Message{
 		Code: byte(CodeBody),
 		Data: chunk,
 	}, s.writeTimeout); err != nil {
-		return nil, fmt.Errorf("milter: body chunk: %w", err)
+		return nil, s.stageError(CodeBody, "write", err)
 	}
 
 	if !s.ProtocolOption(OptNoBodyReply) {
 		act, err := s.readAction()
 		if err != nil {
-			return nil, fmt.Errorf("milter: body chunk: %w", err)
+			return nil, s.stageError(CodeBody, "read", err)
 		}
-		return act, nil
+		return s.checkTerminal(act)
 	}
 	return &Action{Code: ActContinue}, nil
 }
@@ -503,21 +830,57 @@ func (s *ClientSession) BodyReadFrom(r io.Reader) ([]ModifyAction, *Action, erro
 		if act.Code == ActSkip {
 			break
 		}
-		if act.Code != ActContinue {
+		if act.Code != ActContinue && !s.diagnosticMode {
 			return nil, act, nil
 		}
 	}
 
-	return s.End()
+	terminalAct := s.terminalAct
+	modifyActs, act, err := s.End()
+	if err != nil {
+		return nil, nil, err
+	}
+	if terminalAct != nil {
+		return modifyActs, terminalAct, nil
+	}
+	return modifyActs, act, nil
+}
+
+// stoppedAction returns the terminal action received for the data of the
+// current message, if further data should not be sent.
+func (s *ClientSession) stoppedAction() *Action {
+	if s.diagnosticMode {
+		return nil
+	}
+	return s.terminalAct
+}
+
+// checkTerminal records act if it terminates the current message and sends
+// Abort to the milter, unless in diagnostic mode.
+func (s *ClientSession) checkTerminal(act *Action) (*Action, error) {
+	if act.Code == ActContinue || act.Code == ActSkip || s.terminalAct != nil {
+		return act, nil
+	}
+	s.terminalAct = act
+	if !s.diagnosticMode {
+		if err := s.Abort(); err != nil {
+			return nil, err
+		}
+	}
+	return act, nil
 }
 
 type ModifyAction struct {
 	Code ModifyActCode
 
+	// Position of the action in the milter reply, starting at 0.
+	Seq int
+
 	// Recipient to add/remove if Code == ActAddRcpt or ActDelRcpt.
 	Rcpt string
 
-	// New envelope sender if Code = ActChangeFrom.
+	// New envelope sender if Code = ActChangeFrom. It is NullSender for the
+	// null sender, see IsNullSender.
 	From string
 
 	// ESMTP arguments for envelope sender if Code = ActChangeFrom.
@@ -543,25 +906,41 @@ type ModifyAction struct {
 
 	// Quarantine reason if Code == ActQuarantine.
 	Reason string
+
+	// Decoded payload if Code is a vendor-specific action registered in
+	// ClientOptions.Extensions.
+	Extension interface{}
+}
+
+// IsNullSender reports whether act changes the envelope sender to the null
+// sender.
+func (act *ModifyAction) IsNullSender() bool {
+	return act.Code == ActChangeFrom && act.From == NullSender
 }
 
-func parseModifyAct(msg *Message) (*ModifyAction, error) {
+func parseModifyAct(msg *Message, nulPolicy NULPolicy) (*ModifyAction, error) {
 	act := &ModifyAction{
 		Code: ModifyActCode(msg.Code),
 	}
+	var err error
 
 	switch ModifyActCode(msg.Code) {
 	case ActAddRcpt, ActDelRcpt:
-		act.Rcpt = readCString(msg.Data)
+		act.Rcpt, err = nulPolicy.readString(msg.Data)
 	case ActQuarantine:
-		act.Reason = readCString(msg.Data)
+		act.Reason, err = nulPolicy.readString(msg.Data)
 	case ActReplBody:
 		act.Body = msg.Data
 	case ActChangeFrom:
-		argv := bytes.Split(msg.Data, []byte{0x00})
-		act.From = string(argv[0])
-		for _, arg := range argv[1:] {
-			act.FromArgs = append(act.FromArgs, string(arg))
+		var argv []string
+		argv, err = nulPolicy.decodeCStrings(msg.Data)
+		if len(argv) != 0 {
+			act.From = argv[0]
+			act.FromArgs = argv[1:]
+		}
+		// Some milters send an empty sender for the null sender.
+		if act.From == "" {
+			act.From = NullSender
 		}
 	case ActChangeHeader, ActInsertHeader:
 		if len(msg.Data) < 4 {
@@ -572,28 +951,31 @@ func parseModifyAct(msg *Message) (*ModifyAction, error) {
 		msg.Data = msg.Data[4:]
 		fallthrough
 	case ActAddHeader:
-		// TODO: Change readCString to return last index.
-		act.HeaderName = readCString(msg.Data)
 		nul := bytes.IndexByte(msg.Data, 0x00)
 		if nul == -1 {
 			return nil, fmt.Errorf("read modify action: missing NUL delimiter")
 		}
-		if nul == len(msg.Data) {
-			return nil, fmt.Errorf("read modify action: missing header value")
-		}
-		act.HeaderValue = readCString(msg.Data[nul+1:])
+		act.HeaderName = string(msg.Data[:nul])
+		act.HeaderValue, err = nulPolicy.readString(msg.Data[nul+1:])
 	default:
 		return nil, fmt.Errorf("read modify action: unexpected message code: %v", msg.Code)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("read modify action: %w", err)
+	}
 
 	return act, nil
 }
 
 func (s *ClientSession) readModifyActs() (modifyActs []ModifyAction, act *Action, err error) {
+	s.budgetExceeded = false
+	numActs, replBodySize := 0, 0
+	dropBody := false
+	seq := 0
 	for {
-		msg, err := readPacket(s.conn, s.readTimeout)
+		msg, err := readPacket(s.conn, s.readTimeout, s.maxPacketSize)
 		if err != nil {
-			return nil, nil, fmt.Errorf("action read: %w", err)
+			return nil, nil, err
 		}
 		if msg.Code == 'p' /* progress */ {
 			continue
@@ -602,38 +984,144 @@ func (s *ClientSession) readModifyActs() (modifyActs []ModifyAction, act *Action
 		switch ModifyActCode(msg.Code) {
 		case ActAddRcpt, ActDelRcpt, ActReplBody, ActChangeHeader, ActInsertHeader,
 			ActAddHeader, ActChangeFrom, ActQuarantine:
-			modifyAct, err := parseModifyAct(msg)
+			modifyAct, err := parseModifyAct(msg, s.nulPolicy)
 			if err != nil {
 				return nil, nil, err
 			}
+			modifyAct.Seq = seq
+			seq++
+			// Keep reading until the final action to stay in sync.
+			if modifyAct.Code == ActReplBody {
+				replBodySize += len(modifyAct.Body)
+				if s.maxReplBody != 0 && replBodySize > s.maxReplBody {
+					dropBody = true
+				}
+				if dropBody {
+					s.budgetExceeded = true
+					continue
+				}
+			} else if !s.takeModifyAct(&numActs) {
+				continue
+			}
 			modifyActs = append(modifyActs, *modifyAct)
 		default:
-			act, err = parseAction(msg)
+			if dec := s.extensions.modifyAction(ModifyActCode(msg.Code)); dec != nil {
+				ext, err := dec(msg.Data)
+				if err != nil {
+					return nil, nil, fmt.Errorf("read modify action: %w", err)
+				}
+				if s.takeModifyAct(&numActs) {
+					modifyActs = append(modifyActs, ModifyAction{
+						Code:      ModifyActCode(msg.Code),
+						Seq:       seq,
+						Extension: ext,
+					})
+				}
+				seq++
+				continue
+			}
+
+			act, err = parseAction(msg, s.nulPolicy)
 			if err != nil {
 				return nil, nil, err
 			}
 
+			if s.budgetExceeded && s.budgetPolicy == BudgetFail {
+				return nil, nil, ErrBudgetExceeded
+			}
+			if dropBody {
+				// Don't let the MTA apply a truncated body
+				modifyActs = removeModifyActs(modifyActs, ActReplBody)
+			}
 			return modifyActs, act, nil
 		}
 	}
 }
 
+// takeModifyAct counts a modify action against MaxModifyActions, n being the
+// amount of actions accepted so far. It reports whether the action fits in
+// the budget.
+func (s *ClientSession) takeModifyAct(n *int) bool {
+	if s.maxModifyActs != 0 && *n >= s.maxModifyActs {
+		s.budgetExceeded = true
+		return false
+	}
+	*n++
+	return true
+}
+
+func removeModifyActs(acts []ModifyAction, code ModifyActCode) []ModifyAction {
+	kept := acts[:0]
+	for _, act := range acts {
+		if act.Code != code {
+			kept = append(kept, act)
+		}
+	}
+	return kept
+}
+
+// modifyActOrder is the order in which SortModifyActions groups modify
+// actions, following the order in which sendmail applies them.
+var modifyActOrder = map[ModifyActCode]int{
+	ActChangeFrom:   0,
+	ActAddRcpt:      1,
+	ActDelRcpt:      2,
+	ActAddHeader:    3,
+	ActInsertHeader: 4,
+	ActChangeHeader: 5,
+	ActReplBody:     6,
+	ActQuarantine:   7,
+}
+
+// SortModifyActions sorts modify actions by type in the order sendmail
+// applies them: envelope sender, added then removed recipients, added,
+// inserted then changed header fields, body replacement and finally
+// quarantine. Actions of the same type keep their relative order from the
+// milter reply.
+func SortModifyActions(acts []ModifyAction) {
+	sort.SliceStable(acts, func(i, j int) bool {
+		return modifyActOrder[acts[i].Code] < modifyActOrder[acts[j].Code]
+	})
+}
+
+// BudgetExceeded reports whether modify actions were dropped by the last End
+// call because the milter exceeded MaxModifyActions or MaxReplacementBody.
+func (s *ClientSession) BudgetExceeded() bool {
+	return s.budgetExceeded
+}
+
 // End sends the EOB message and resets session back to the state before Mail
-// call. The same ClientSession can be used to check another message arrived
+// call.
+//
+// Modify actions are returned in the order they were sent by the milter, see
+// SortModifyActions to group them by type. The same ClientSession can be used to check another message arrived
 // within the same SMTP connection (Helo and Conn information is preserved).
 //
 // Close should be called to conclude session.
-func (s *ClientSession) End() ([]ModifyAction, *Action, error) {
+func (s *ClientSession) End() (modifyActs []ModifyAction, act *Action, err error) {
+	s.doWithLabels("eom", func() {
+		modifyActs, act, err = s.end()
+	})
+	return modifyActs, act, err
+}
+
+func (s *ClientSession) end() ([]ModifyAction, *Action, error) {
+	if act := s.stoppedAction(); act != nil {
+		return nil, act, nil
+	}
+	s.terminalAct = nil
+
 	if err := writePacket(s.conn, &Message{
 		Code: byte(CodeEOB),
 	}, s.writeTimeout); err != nil {
-		return nil, nil, fmt.Errorf("milter: end: %w", err)
+		return nil, nil, s.stageError(CodeEOB, "write", err)
 	}
 
 	modifyActs, act, err := s.readModifyActs()
 	if err != nil {
-		return nil, nil, fmt.Errorf("milter: end: %w", err)
+		return nil, nil, s.stageError(CodeEOB, "read", err)
 	}
+	s.needAbort = false
 
 	return modifyActs, act, nil
 }
@@ -643,23 +1131,78 @@ func (s *ClientSession) End() ([]ModifyAction, *Action, error) {
 // This is called for an unexpected end to an email outside the milters
 // control.
 func (s *ClientSession) Abort() error {
-	return writePacket(s.conn, &Message{
+	s.needAbort = false
+	if err := writePacket(s.conn, &Message{
 		Code: byte(CodeAbort),
-	}, s.writeTimeout)
+	}, s.writeTimeout); err != nil {
+		return s.stageError(CodeAbort, "write", err)
+	}
+	return nil
+}
+
+// NeedAbort reports whether a message is in progress, that is whether Close
+// and Reset would send Abort under AbortMidMessage.
+func (s *ClientSession) NeedAbort() bool {
+	return s.needAbort
+}
+
+// Reset concludes the current message, sending Abort as configured by
+// ClientOptions.AbortPolicy. The session can then be used for the next
+// message.
+func (s *ClientSession) Reset() error {
+	s.terminalAct = nil
+	if !s.shouldAbort() {
+		return nil
+	}
+	if err := s.Abort(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *ClientSession) shouldAbort() bool {
+	switch s.abortPolicy {
+	case AbortAlways:
+		return true
+	case AbortNever:
+		return false
+	default:
+		return s.needAbort
+	}
+}
+
+// QuitNewConn ends the current milter connection while keeping the
+// underlying socket open: the milter discards its connection state and the
+// session can be reused starting with Conn, without negotiating again.
+//
+// The milter must support protocol version 6.
+func (s *ClientSession) QuitNewConn() error {
+	if s.shouldAbort() {
+		_ = s.Abort()
+	}
+	s.terminalAct = nil
+
+	if err := writePacket(s.conn, &Message{
+		Code: byte(CodeQuitNewConn),
+	}, s.writeTimeout); err != nil {
+		return s.stageError(CodeQuitNewConn, "write", err)
+	}
+	return nil
 }
 
 // Close releases resources associated with the session.
 //
-// If there a milter sequence in progress - it is aborted.
+// If there a milter sequence in progress - it is aborted, as configured by
+// ClientOptions.AbortPolicy.
 func (s *ClientSession) Close() error {
-	if s.needAbort {
+	if s.shouldAbort() {
 		_ = s.Abort()
 	}
 
 	if err := writePacket(s.conn, &Message{
 		Code: byte(CodeQuit),
 	}, s.writeTimeout); err != nil {
-		return fmt.Errorf("milter: close: %w", err)
+		return s.stageError(CodeQuit, "write", err)
 	}
 	return s.conn.Close()
 }
@@ -2,10 +2,15 @@ package milter
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"net"
 	nettextproto "net/textproto"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 )
@@ -255,17 +260,20 @@ func TestMilterClient_UsualFlow(t *testing.T) {
 	expected := []ModifyAction{
 		{
 			Code:        ActAddHeader,
+			Seq:         0,
 			HeaderName:  "X-Bad",
 			HeaderValue: "very",
 		},
 		{
 			Code:        ActChangeHeader,
+			Seq:         1,
 			HeaderIndex: 1,
 			HeaderName:  "Subject",
 			HeaderValue: "***SPAM***",
 		},
 		{
 			Code:   ActQuarantine,
+			Seq:    2,
 			Reason: "very bad message",
 		},
 	}
@@ -283,6 +291,7 @@ func TestMilterClient_AbortFlow(t *testing.T) {
 		HeloMod: func(m *Modifier) {
 			macros = m.Macros
 		},
+		MailResp: RespContinue,
 		AbortMod: func(m *Modifier) {
 			macros = m.Macros
 		},
@@ -348,6 +357,12 @@ func TestMilterClient_AbortFlow(t *testing.T) {
 		t.Fatal("Wrong tls_version macro value:", v)
 	}
 
+	if err := session.Macros(CodeMail, "i", "ABCDEF"); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	act, err = session.Mail("from@example.org", nil)
+	assertAction(act, err, ActContinue)
+
 	err = session.Abort()
 	if err != nil {
 		t.Fatal(err)
@@ -358,12 +373,16 @@ func TestMilterClient_AbortFlow(t *testing.T) {
 		t.Fatal("Wrong tls_version macro value: ", v)
 	}
 
+	// Connection-scoped macros survive the abort, message-scoped ones don't
 	act, err = session.Helo("repeated_helo_host")
 	assertAction(act, err, ActContinue)
 	if mm.HeloValue != "repeated_helo_host" {
 		t.Fatal("Wrong helo value:", mm.HeloValue)
 	}
-	if len(macros["tls_version"]) != 0 {
+	if v := macros["tls_version"]; v != "very old" {
+		t.Fatal("Wrong tls_version macro value:", v)
+	}
+	if _, ok := macros["i"]; ok {
 		t.Fatal("Unexpected macro data:", macros)
 	}
 }
@@ -371,26 +390,90 @@ func TestMilterClient_AbortFlow(t *testing.T) {
 // TestMilterClient_ImpossibleClientDowngrade tests that the client does not downgrade to v2
 // in case of a v6 bit set in the ActionMask.
 func TestMilterClient_ImpossibleClientDowngrade(t *testing.T) {
-	mm := MockMilter{
-		ConnResp:      RespContinue,
-		HeloResp:      RespContinue,
-		MailResp:      RespContinue,
-		RcptResp:      RespContinue,
-		HdrResp:       RespContinue,
-		HdrsResp:      RespContinue,
-		BodyChunkResp: RespContinue,
-		BodyResp:      RespContinue,
-		BodyMod: func(m *Modifier) {
-			m.AddHeader("X-Bad", "very")
-			m.ChangeHeader(1, "Subject", "***SPAM***")
-			m.Quarantine("very bad message")
-		},
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer local.Close()
+
+	// Fake a milter only supporting v2.
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := readPacket(conn, 0, 0); err != nil {
+			return
+		}
+		data := make([]byte, 4*3)
+		binary.BigEndian.PutUint32(data, 2)
+		binary.BigEndian.PutUint32(data[4:], uint32(OptAddHeader|OptChangeHeader))
+		writePacket(conn, &Message{Code: byte(CodeOptNeg), Data: data}, 0)
+		readPacket(conn, 0, 0)
+	}()
+
+	cl := NewClientWithOptions("tcp", local.Addr().String(), ClientOptions{
+		// OptChangeFrom is only supported by a server with v6, but this server only supports v2.
+		// This should provoke a downgrade error.
+		ActionMask: OptAddHeader | OptChangeFrom,
+	})
+	defer cl.Close()
+	_, err = cl.Session()
+	if !errors.Is(err, ErrUnsupportedMilterVersion) {
+		t.Fatalf("Expected ErrUnsupportedMilterVersion, got %v", err)
+	}
+	var negErr *NegotiationError
+	if !errors.As(err, &negErr) || negErr.Version != 2 || negErr.Actions != OptAddHeader|OptChangeHeader {
+		t.Fatalf("Wrong negotiation error: %#v", err)
+	}
+}
+
+func TestMilterClient_MinVersion(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	// Fake a milter only supporting v2.
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := readPacket(conn, 0, 0); err != nil {
+			return
+		}
+		data := make([]byte, 4*3)
+		binary.BigEndian.PutUint32(data, 2)
+		binary.BigEndian.PutUint32(data[4:], uint32(OptAddHeader))
+		writePacket(conn, &Message{Code: byte(CodeOptNeg), Data: data}, 0)
+		readPacket(conn, 0, 0)
+	}()
+
+	cl := NewClientWithOptions("tcp", local.Addr().String(), ClientOptions{
+		ActionMask: OptAddHeader,
+		MinVersion: 6,
+	})
+	defer cl.Close()
+	_, err = cl.Session()
+	if !errors.Is(err, ErrNegotiationPolicy) {
+		t.Fatalf("Expected ErrNegotiationPolicy, got %v", err)
+	}
+	var negErr *NegotiationError
+	if !errors.As(err, &negErr) || negErr.Version != 2 {
+		t.Fatalf("Wrong negotiation error: %#v", err)
+	}
+}
+
+func TestMilterClient_RequiredActions(t *testing.T) {
 	s := Server{
 		NewMilter: func() Milter {
-			return &mm
+			return NoOpMilter{}
 		},
-		Actions: OptAddHeader | OptChangeHeader,
+		Actions: OptAddHeader,
 	}
 	defer s.Close()
 	local, err := net.Listen("tcp", "127.0.0.1:0")
@@ -400,13 +483,360 @@ func TestMilterClient_ImpossibleClientDowngrade(t *testing.T) {
 	go s.Serve(local)
 
 	cl := NewClientWithOptions("tcp", local.Addr().String(), ClientOptions{
-		// OptChangeFrom is only supported by a server with v6, but this server only supports v2.
-		// This should provoke a downgrade error.
-		ActionMask: OptAddHeader | OptChangeFrom,
+		ReadTimeout:     time.Second,
+		WriteTimeout:    time.Second,
+		ActionMask:      OptAddHeader | OptQuarantine,
+		RequiredActions: OptQuarantine,
 	})
 	defer cl.Close()
 	_, err = cl.Session()
-	if err != ErrUnsupportedMilterVersion {
-		t.Fatalf("Expected ErrUnsupportedMilterVersion, got %v", err)
+	if !errors.Is(err, ErrNegotiationPolicy) {
+		t.Fatalf("Expected ErrNegotiationPolicy, got %v", err)
+	}
+	var negErr *NegotiationError
+	if !errors.As(err, &negErr) || negErr.Actions != OptAddHeader {
+		t.Fatalf("Wrong negotiation error: %#v", err)
+	}
+}
+
+func TestMilterClient_FallbackV2(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	// Fake an ancient milter closing the connection on unknown versions.
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			msg, err := readPacket(conn, 0, 0)
+			if err != nil || binary.BigEndian.Uint32(msg.Data) != 2 {
+				conn.Close()
+				continue
+			}
+			data := make([]byte, 4*3)
+			binary.BigEndian.PutUint32(data, 2)
+			binary.BigEndian.PutUint32(data[4:], uint32(OptAddHeader))
+			writePacket(conn, &Message{Code: byte(CodeOptNeg), Data: data}, 0)
+			readPacket(conn, 0, 0)
+			conn.Close()
+		}
+	}()
+
+	opts := ClientOptions{
+		ActionMask: OptAddHeader | OptChangeFrom,
+	}
+	cl := NewClientWithOptions("tcp", local.Addr().String(), opts)
+	defer cl.Close()
+	if _, err := cl.Session(); err == nil {
+		t.Fatal("Expected negotiation to fail without fallback")
+	}
+
+	opts.FallbackV2 = true
+	cl = NewClientWithOptions("tcp", local.Addr().String(), opts)
+	defer cl.Close()
+	session, err := cl.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if session.ActionOpts != OptAddHeader {
+		t.Fatalf("Wrong actions: 0x%x", session.ActionOpts)
+	}
+}
+
+// rejectingMilter records the calls it receives, rejecting messages at the
+// header field named rejectHeader.
+type rejectingMilter struct {
+	NoOpMilter
+	rejectHeader string
+
+	mu      sync.Mutex
+	headers []string
+	chunks  int
+	aborts  chan struct{}
+}
+
+func newRejectingMilter(rejectHeader string) *rejectingMilter {
+	return &rejectingMilter{rejectHeader: rejectHeader, aborts: make(chan struct{}, 10)}
+}
+
+func (rm *rejectingMilter) Header(name, value string, m *Modifier) (Response, error) {
+	rm.mu.Lock()
+	rm.headers = append(rm.headers, name)
+	rm.mu.Unlock()
+	if name == rm.rejectHeader {
+		return RespReject, nil
+	}
+	return RespContinue, nil
+}
+
+func (rm *rejectingMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	rm.mu.Lock()
+	rm.chunks++
+	rm.mu.Unlock()
+	return RespContinue, nil
+}
+
+func (rm *rejectingMilter) Abort(m *Modifier) error {
+	rm.aborts <- struct{}{}
+	return nil
+}
+
+// waitAbort reports whether Abort was received within a short delay.
+func (rm *rejectingMilter) waitAbort() bool {
+	select {
+	case <-rm.aborts:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func testTerminalHeader(t *testing.T, diagnosticMode bool) (*rejectingMilter, *Action) {
+	rm := newRejectingMilter("X-Bad")
+	s := Server{
+		NewMilter: func() Milter {
+			return rm
+		},
+	}
+	t.Cleanup(func() { s.Close() })
+	session := startTestSession(t, &s, ClientOptions{DiagnosticMode: diagnosticMode})
+	t.Cleanup(func() { session.Close() })
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	var hdr textproto.Header
+	hdr.Add("X-After", "1")
+	hdr.Add("X-Bad", "1")
+	hdr.Add("X-Before", "1")
+	act, err := session.Header(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActReject {
+		t.Fatal("Expected reject, got", act.Code)
+	}
+	_, act, err = session.BodyReadFrom(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActReject {
+		t.Fatal("Expected reject, got", act.Code)
+	}
+	return rm, act
+}
+
+func TestClientSession_TerminalAction(t *testing.T) {
+	rm, _ := testTerminalHeader(t, false)
+	if !rm.waitAbort() {
+		t.Fatal("Abort not sent after terminal action")
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if !reflect.DeepEqual(rm.headers, []string{"X-Before", "X-Bad"}) {
+		t.Fatal("Wrong header fields sent:", rm.headers)
+	}
+	if rm.chunks != 0 {
+		t.Fatal("Body sent after terminal action")
+	}
+}
+
+func TestClientSession_DiagnosticMode(t *testing.T) {
+	rm, _ := testTerminalHeader(t, true)
+	if rm.waitAbort() {
+		t.Fatal("Abort sent in diagnostic mode")
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if !reflect.DeepEqual(rm.headers, []string{"X-Before", "X-Bad", "X-After"}) {
+		t.Fatal("Wrong header fields sent:", rm.headers)
+	}
+	if rm.chunks != 1 {
+		t.Fatal("Body not sent in diagnostic mode")
+	}
+}
+
+type abortingRcptMilter struct {
+	rcptMilter
+	aborts chan struct{}
+}
+
+func (am abortingRcptMilter) Abort(m *Modifier) error {
+	am.aborts <- struct{}{}
+	return nil
+}
+
+func TestClientSession_AbortPolicy(t *testing.T) {
+	tests := []struct {
+		policy      AbortPolicy
+		midMessage  bool
+		afterEnd    bool
+		description string
+	}{
+		{AbortMidMessage, true, false, "AbortMidMessage"},
+		{AbortAlways, true, true, "AbortAlways"},
+		{AbortNever, false, false, "AbortNever"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			aborts := make(chan struct{}, 10)
+			s := Server{
+				NewMilter: func() Milter {
+					return abortingRcptMilter{aborts: aborts}
+				},
+			}
+			defer s.Close()
+			session := startTestSession(t, &s, ClientOptions{AbortPolicy: tc.policy})
+			defer session.Close()
+
+			waitAbort := func() bool {
+				select {
+				case <-aborts:
+					return true
+				case <-time.After(100 * time.Millisecond):
+					return false
+				}
+			}
+
+			if session.NeedAbort() {
+				t.Fatal("NeedAbort set before Mail")
+			}
+			if _, err := session.Mail("from@example.org", nil); err != nil {
+				t.Fatal(err)
+			}
+			act, err := session.Rcpt("bad@example.org", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act.Code != ActReject {
+				t.Fatal("Expected reject, got", act.Code)
+			}
+			if !session.NeedAbort() {
+				t.Fatal("NeedAbort cleared by a rejected recipient")
+			}
+			if err := session.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if aborted := waitAbort(); aborted != tc.midMessage {
+				t.Fatalf("Mid-message Reset: expected abort = %v", tc.midMessage)
+			}
+
+			if _, err := session.Mail("from@example.org", nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := session.End(); err != nil {
+				t.Fatal(err)
+			}
+			if session.NeedAbort() {
+				t.Fatal("NeedAbort set after End")
+			}
+			if err := session.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if aborted := waitAbort(); aborted != tc.afterEnd {
+				t.Fatalf("Reset after End: expected abort = %v", tc.afterEnd)
+			}
+		})
+	}
+}
+
+type budgetMilter struct {
+	NoOpMilter
+}
+
+func (budgetMilter) Body(m *Modifier) (Response, error) {
+	for _, name := range []string{"X-A", "X-B", "X-C"} {
+		if err := m.AddHeader(name, "1"); err != nil {
+			return nil, err
+		}
+	}
+	for _, chunk := range []string{"chunk 1\n", "chunk 2\n"} {
+		if err := m.ReplaceBody([]byte(chunk)); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.AddRecipient("<to@example.org>"); err != nil {
+		return nil, err
+	}
+	return RespAccept, nil
+}
+
+func TestClientSession_Budget(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     ClientOptions
+		expected []ModifyActCode
+		exceeded bool
+	}{
+		{
+			name:     "none",
+			expected: []ModifyActCode{ActAddHeader, ActAddHeader, ActAddHeader, ActReplBody, ActReplBody, ActAddRcpt},
+		},
+		{
+			name:     "actions",
+			opts:     ClientOptions{MaxModifyActions: 2},
+			expected: []ModifyActCode{ActAddHeader, ActAddHeader, ActReplBody, ActReplBody},
+			exceeded: true,
+		},
+		{
+			name:     "body",
+			opts:     ClientOptions{MaxReplacementBody: 10},
+			expected: []ModifyActCode{ActAddHeader, ActAddHeader, ActAddHeader, ActAddRcpt},
+			exceeded: true,
+		},
+		{
+			name:     "fail",
+			opts:     ClientOptions{MaxReplacementBody: 10, BudgetPolicy: BudgetFail},
+			exceeded: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := Server{
+				NewMilter: func() Milter {
+					return budgetMilter{}
+				},
+				Actions: OptAddHeader | OptChangeBody | OptAddRcpt,
+			}
+			defer s.Close()
+			session := startTestSession(t, &s, tc.opts)
+			defer session.Close()
+
+			// The session must stay usable after the budget is exceeded
+			for i := 0; i < 2; i++ {
+				if _, err := session.Mail("from@example.org", nil); err != nil {
+					t.Fatal(err)
+				}
+				acts, act, err := session.End()
+				if tc.opts.BudgetPolicy == BudgetFail {
+					if !errors.Is(err, ErrBudgetExceeded) {
+						t.Fatalf("Expected ErrBudgetExceeded, got %v", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if act.Code != ActAccept {
+					t.Fatal("Unexpected action:", act.Code)
+				}
+				var codes []ModifyActCode
+				for _, a := range acts {
+					codes = append(codes, a.Code)
+				}
+				if !reflect.DeepEqual(codes, tc.expected) {
+					t.Fatalf("Wrong modify actions: %q", codes)
+				}
+				if session.BudgetExceeded() != tc.exceeded {
+					t.Fatal("Wrong BudgetExceeded:", session.BudgetExceeded())
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,71 @@
+package milter
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// ConnInfo describes the connection of the MTA to the server.
+type ConnInfo struct {
+	// Listener which accepted the connection. It is nil for Server.SelfTest.
+	Listener   net.Listener
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// Credentials of the MTA process, for unix sockets on platforms
+	// supporting it. Nil otherwise.
+	PeerCred *PeerCred
+
+	// State of the TLS connection, e.g. to authorize the MTA by the
+	// certificate it presented. Nil if the connection isn't secured with
+	// TLS. The TLS handshake is completed before NewMilterWithConn is called.
+	TLS *tls.ConnectionState
+}
+
+// PeerCred are the credentials of the process on the other end of a unix
+// socket.
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
+}
+
+func newConnInfo(conn net.Conn, ln net.Listener) ConnInfo {
+	info := ConnInfo{
+		Listener:   ln,
+		LocalAddr:  conn.LocalAddr(),
+		RemoteAddr: conn.RemoteAddr(),
+	}
+	if uc, ok := conn.(*net.UnixConn); ok {
+		info.PeerCred = peerCred(uc)
+	}
+	return info
+}
+
+// tlsHandshake completes the TLS handshake of TLS connections, so that the
+// connection state is available in ConnInfo. The Milter is created again if
+// it depends on ConnInfo.
+func (m *milterSession) tlsHandshake() error {
+	wc, ok := m.conn.(*watchConn)
+	if !ok {
+		return nil
+	}
+	tc, ok := wc.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if d := timeout(m.server.ReadTimeout); d != 0 {
+		tc.SetDeadline(time.Now().Add(d))
+		defer tc.SetDeadline(time.Time{})
+	}
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	state := tc.ConnectionState()
+	m.connInfo.TLS = &state
+	if m.factory.withConn {
+		m.backend = m.factory.NewMilter(m.connInfo)
+	}
+	return nil
+}
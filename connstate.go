@@ -0,0 +1,59 @@
+package milter
+
+// ConnState is the state of an MTA connection, see Server.ConnState.
+type ConnState int
+
+const (
+	// StateNew is the state of a connection which was just accepted, before
+	// the TLS handshake, if any, and negotiation.
+	StateNew ConnState = iota
+	// StateNegotiated is the state of a connection once protocol options
+	// have been negotiated with the MTA.
+	StateNegotiated
+	// StateInMessage is the state of a connection processing a message,
+	// from the MAIL command to the end of message or abort.
+	StateInMessage
+	// StateIdle is the state of a connection between messages.
+	StateIdle
+	// StateClosed is the state of a closed connection. It is terminal.
+	StateClosed
+)
+
+var connStateNames = map[ConnState]string{
+	StateNew:        "new",
+	StateNegotiated: "negotiated",
+	StateInMessage:  "in-message",
+	StateIdle:       "idle",
+	StateClosed:     "closed",
+}
+
+func (s ConnState) String() string {
+	if name, ok := connStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// setState changes the state of the connection, calling Server.ConnState if
+// it changed. StateNew, the initial state, is always reported.
+func (m *milterSession) setState(state ConnState) {
+	if state == m.state && state != StateNew {
+		return
+	}
+	m.state = state
+	if m.server.ConnState != nil && !m.selfTest {
+		m.server.ConnState(m.connInfo, state)
+	}
+}
+
+// updateState updates the state of the connection after a command.
+func (m *milterSession) updateState(code Code) {
+	switch {
+	case m.inMessage():
+		m.setState(StateInMessage)
+	case m.state == StateInMessage:
+		m.setState(StateIdle)
+	case code == CodeOptNeg:
+		m.setState(StateNegotiated)
+	}
+}
@@ -0,0 +1,50 @@
+package milter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServer_ConnState(t *testing.T) {
+	states := make(chan ConnState, 10)
+	s := Server{
+		NewMilter: func() Milter {
+			return &MockMilter{
+				MailResp: RespContinue,
+				RcptResp: RespContinue,
+				BodyResp: RespAccept,
+			}
+		},
+		ConnState: func(conn ConnInfo, state ConnState) {
+			states <- state
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Rcpt("to@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := session.End(); err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+
+	var got []ConnState
+	for state := ConnState(-1); state != StateClosed; {
+		select {
+		case state = <-states:
+			got = append(got, state)
+		case <-time.After(time.Second):
+			t.Fatal("Connection not closed, states:", got)
+		}
+	}
+	expected := []ConnState{StateNew, StateNegotiated, StateInMessage, StateIdle, StateClosed}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Wrong states: %v, expected %v", got, expected)
+	}
+}
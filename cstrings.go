@@ -2,20 +2,13 @@ package milter
 
 import (
 	"bytes"
+	"errors"
 	"strings"
 )
 
 // NULL terminator
 const null = "\x00"
 
-// DecodeCStrings splits a C style strings into a Go slice
-func decodeCStrings(data []byte) []string {
-	if len(data) == 0 {
-		return nil
-	}
-	return strings.Split(strings.Trim(string(data), null), null)
-}
-
 // ReadCString reads and returns a C style string from []byte
 func readCString(data []byte) string {
 	pos := bytes.IndexByte(data, 0)
@@ -31,3 +24,75 @@ func appendCString(dest []byte, s string) []byte {
 	dest = append(dest, 0x00)
 	return dest
 }
+
+// NULPolicy controls how malformed C style strings received from the peer
+// are handled: strings with embedded NUL characters and strings missing the
+// NUL terminator.
+type NULPolicy int
+
+const (
+	// NULTruncate cuts strings at the first embedded NUL and accepts strings
+	// without terminator.
+	NULTruncate NULPolicy = iota
+	// NULReplace replaces embedded NULs with U+FFFD and accepts strings
+	// without terminator.
+	NULReplace
+	// NULReject fails to decode packets with embedded or missing NULs.
+	NULReject
+)
+
+// ErrMalformedString is returned when a string doesn't conform to NULReject.
+var ErrMalformedString = errors.New("milter: malformed C string")
+
+// readCString reads a C style string from the beginning of data and returns
+// it together with the rest of data.
+func (p NULPolicy) readCString(data []byte) (string, []byte, error) {
+	pos := bytes.IndexByte(data, 0)
+	if pos == -1 {
+		if p == NULReject {
+			return "", nil, ErrMalformedString
+		}
+		return string(data), nil, nil
+	}
+	return string(data[:pos]), data[pos+1:], nil
+}
+
+// readString reads a packet field consisting of a single C style string.
+func (p NULPolicy) readString(data []byte) (string, error) {
+	if len(data) == 0 || data[len(data)-1] != 0 {
+		if p == NULReject {
+			return "", ErrMalformedString
+		}
+	} else {
+		data = data[:len(data)-1]
+	}
+
+	pos := bytes.IndexByte(data, 0)
+	if pos == -1 {
+		return string(data), nil
+	}
+	switch p {
+	case NULReplace:
+		return strings.Replace(string(data), null, "�", -1), nil
+	case NULReject:
+		return "", ErrMalformedString
+	default:
+		return string(data[:pos]), nil
+	}
+}
+
+// decodeCStrings splits a packet field consisting of a list of C style
+// strings. Empty strings are preserved.
+func (p NULPolicy) decodeCStrings(data []byte) ([]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if data[len(data)-1] != 0 {
+		if p == NULReject {
+			return nil, ErrMalformedString
+		}
+	} else {
+		data = data[:len(data)-1]
+	}
+	return strings.Split(string(data), null), nil
+}
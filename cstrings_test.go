@@ -0,0 +1,46 @@
+package milter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNULPolicy_ReadString(t *testing.T) {
+	cases := []struct {
+		policy NULPolicy
+		data   string
+		value  string
+		err    error
+	}{
+		{NULTruncate, "helo\x00", "helo", nil},
+		{NULTruncate, "helo", "helo", nil},
+		{NULTruncate, "he\x00lo\x00", "he", nil},
+		{NULReplace, "he\x00lo\x00", "he�lo", nil},
+		{NULReject, "helo\x00", "helo", nil},
+		{NULReject, "helo", "", ErrMalformedString},
+		{NULReject, "he\x00lo\x00", "", ErrMalformedString},
+	}
+	for _, c := range cases {
+		value, err := c.policy.readString([]byte(c.data))
+		if err != c.err {
+			t.Errorf("%v %q: expected error %v, got %v", c.policy, c.data, c.err, err)
+		}
+		if value != c.value {
+			t.Errorf("%v %q: expected %q, got %q", c.policy, c.data, c.value, value)
+		}
+	}
+}
+
+func TestNULPolicy_DecodeCStrings(t *testing.T) {
+	values, err := NULTruncate.decodeCStrings([]byte("{i}\x00\x00j\x00host\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"{i}", "", "j", "host"}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected %q, got %q", expected, values)
+	}
+
+	if _, err := NULReject.decodeCStrings([]byte("j\x00host")); err != ErrMalformedString {
+		t.Fatalf("Expected ErrMalformedString, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package milter
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// ErrDecodeLimit is returned when decoded data exceeds the limits set in
+// DecodeOptions.
+var ErrDecodeLimit = errors.New("milter: decode: limit exceeded")
+
+// DecodeOptions controls the behavior of DecodePart.
+type DecodeOptions struct {
+	// Decompress gzip-compressed parts (Content-Type application/gzip or
+	// application/x-gzip).
+	Gzip bool
+
+	// Maximum size of the decoded data in bytes. Zero means no limit.
+	MaxSize int64
+
+	// Maximum ratio between decoded and encoded sizes. Zero means no limit.
+	// The ratio is only enforced once MinRatioSize bytes have been decoded.
+	MaxRatio float64
+
+	// Amount of decoded bytes after which MaxRatio is enforced. Defaults to
+	// 64 KiB.
+	MinRatioSize int64
+}
+
+// DecodePart returns a reader for the content of a MIME part with its
+// Content-Transfer-Encoding (base64 or quoted-printable) removed. If
+// opts.Gzip is set, gzip-compressed parts are decompressed as well.
+//
+// It is intended to be used on parts of the message obtained by walking the
+// body with go-message. Decompression bombs are guarded against by the size
+// and ratio limits in opts, reads fail with ErrDecodeLimit once they are
+// exceeded.
+func DecodePart(h textproto.Header, body io.Reader, opts *DecodeOptions) (io.Reader, error) {
+	if opts == nil {
+		opts = &DecodeOptions{}
+	}
+
+	encoded := &countingReader{r: body}
+	var r io.Reader = encoded
+
+	enc := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding")))
+	switch enc {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "", "7bit", "8bit", "binary":
+	default:
+		return nil, fmt.Errorf("milter: decode: unhandled transfer encoding: %v", enc)
+	}
+
+	if opts.Gzip {
+		mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		if mediaType == "application/gzip" || mediaType == "application/x-gzip" {
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, fmt.Errorf("milter: decode: %w", err)
+			}
+			r = zr
+		}
+	}
+
+	if opts.MaxSize == 0 && opts.MaxRatio == 0 {
+		return r, nil
+	}
+
+	minRatioSize := opts.MinRatioSize
+	if minRatioSize == 0 {
+		minRatioSize = 64 * 1024
+	}
+	return &limitedDecodeReader{
+		r:            r,
+		encoded:      encoded,
+		maxSize:      opts.MaxSize,
+		maxRatio:     opts.MaxRatio,
+		minRatioSize: minRatioSize,
+	}, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+type limitedDecodeReader struct {
+	r            io.Reader
+	encoded      *countingReader
+	decoded      int64
+	maxSize      int64
+	maxRatio     float64
+	minRatioSize int64
+}
+
+func (r *limitedDecodeReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.decoded += int64(n)
+	if r.maxSize != 0 && r.decoded > r.maxSize {
+		return 0, ErrDecodeLimit
+	}
+	if r.maxRatio != 0 && r.decoded > r.minRatioSize && r.encoded.n > 0 &&
+		float64(r.decoded)/float64(r.encoded.n) > r.maxRatio {
+		return 0, ErrDecodeLimit
+	}
+	return n, err
+}
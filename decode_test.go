@@ -0,0 +1,95 @@
+package milter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodePart(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		encoding string
+		body     string
+		expected string
+	}{
+		{"plain", "text/plain", "", "hello", "hello"},
+		{"base64", "text/plain", "base64", base64.StdEncoding.EncodeToString([]byte("hello")), "hello"},
+		{"quoted-printable", "text/plain", "Quoted-Printable", "caf=C3=A9=\r\n!", "café!"},
+		{"gzip", "application/gzip", "base64", base64.StdEncoding.EncodeToString(gzipData(t, []byte("hello"))), "hello"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var h textproto.Header
+			h.Set("Content-Type", tc.mimeType)
+			if tc.encoding != "" {
+				h.Set("Content-Transfer-Encoding", tc.encoding)
+			}
+			r, err := DecodePart(h, strings.NewReader(tc.body), &DecodeOptions{Gzip: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Fatalf("Wrong content: %q", b)
+			}
+		})
+	}
+}
+
+func TestDecodePart_Limits(t *testing.T) {
+	var h textproto.Header
+	h.Set("Content-Type", "application/gzip")
+	bomb := gzipData(t, make([]byte, 1024*1024))
+
+	tests := []struct {
+		name string
+		opts DecodeOptions
+	}{
+		{"size", DecodeOptions{Gzip: true, MaxSize: 1024}},
+		{"ratio", DecodeOptions{Gzip: true, MaxRatio: 10, MinRatioSize: 1024}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := DecodePart(h, bytes.NewReader(bomb), &tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, r); !errors.Is(err, ErrDecodeLimit) {
+				t.Fatalf("Expected ErrDecodeLimit, got %v", err)
+			}
+		})
+	}
+
+	r, err := DecodePart(h, bytes.NewReader(bomb), &DecodeOptions{Gzip: true, MaxSize: 2 * 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.Copy(ioutil.Discard, r); err != nil || n != 1024*1024 {
+		t.Fatalf("Unexpected result under limit: %v, %v", n, err)
+	}
+}
@@ -0,0 +1,59 @@
+package milter
+
+import (
+	"context"
+	"net"
+)
+
+// Enricher looks up data about the client IP when the MTA reports a new SMTP
+// connection, such as the GeoIP country or the ASN. The results are exposed
+// to the filter for the whole connection as pseudo-macros in
+// Modifier.Macros, so that policy rules can match on them like on macros
+// sent by the MTA.
+//
+// Keys should follow the macro naming convention, e.g. "{geoip_country}".
+// Macros sent by the MTA take precedence over pseudo-macros.
+type Enricher interface {
+	Enrich(ctx context.Context, addr net.IP) (map[string]string, error)
+}
+
+// EnricherFunc is an adapter to use an ordinary function as an Enricher.
+type EnricherFunc func(ctx context.Context, addr net.IP) (map[string]string, error)
+
+// Enrich implements Enricher.
+func (f EnricherFunc) Enrich(ctx context.Context, addr net.IP) (map[string]string, error) {
+	return f(ctx, addr)
+}
+
+// enrich runs the enrichers of the server for a new connection
+func (m *milterSession) enrich(addr net.IP) {
+	m.pseudoMacros = nil
+	if addr == nil {
+		return
+	}
+	for _, e := range m.server.Enrichers {
+		values, err := e.Enrich(m.context(), addr)
+		if err != nil {
+			m.logf("Error enriching connection from %v: %v", addr, err)
+			continue
+		}
+		for k, v := range values {
+			if m.pseudoMacros == nil {
+				m.pseudoMacros = make(map[string]string)
+			}
+			m.pseudoMacros[k] = v
+		}
+	}
+}
+
+// allMacros returns the macros sent by the MTA merged with the pseudo-macros
+// of the connection
+func (m *milterSession) allMacros() map[string]string {
+	macros := m.macros.all()
+	for k, v := range m.pseudoMacros {
+		if _, ok := macros[k]; !ok {
+			macros[k] = v
+		}
+	}
+	return macros
+}
@@ -0,0 +1,74 @@
+package milter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MilterError is an error of a milter session, returned by the methods of
+// ClientSession and passed to Server.ErrorHook. The underlying error, e.g. a
+// *WriteError, can be retrieved with errors.As.
+type MilterError struct {
+	// Stage is the command being processed, zero if the error occurred
+	// outside of a command, e.g. during the TLS handshake. Servers report
+	// read errors with the stage of the last command received.
+	Stage Code
+	// Op is "read" or "write" if the error occurred reading from or writing
+	// to the connection, empty otherwise.
+	Op string
+	// QueueID is the queue ID of the message ("i" macro), empty if unknown.
+	QueueID string
+	Err     error
+}
+
+func (err *MilterError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("milter: ")
+	if err.Stage != 0 {
+		sb.WriteString(stageName(err.Stage))
+		if err.QueueID != "" {
+			fmt.Fprintf(&sb, " (queue ID %v)", err.QueueID)
+		}
+		sb.WriteString(": ")
+	}
+	// avoid repeating the prefix of errors of this package, e.g. *WriteError
+	msg := strings.TrimPrefix(err.Err.Error(), "milter: ")
+	if err.Op != "" {
+		sb.WriteString(err.Op + ": ")
+		msg = strings.TrimPrefix(msg, err.Op+": ")
+	}
+	sb.WriteString(msg)
+	return sb.String()
+}
+
+func (err *MilterError) Unwrap() error {
+	return err.Err
+}
+
+// stageName returns the name of a command in error messages.
+func stageName(code Code) string {
+	switch code {
+	case CodeOptNeg:
+		return "negotiate"
+	case CodeMacro:
+		return "macros"
+	case CodeQuit:
+		return "close"
+	case CodeQuitNewConn:
+		return "quit new conn"
+	}
+	if name, ok := stageLabels[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("command %q", byte(code))
+}
+
+// stageError wraps an error of the command code.
+func (s *ClientSession) stageError(code Code, op string, err error) error {
+	return &MilterError{Stage: code, Op: op, QueueID: s.queueID, Err: err}
+}
+
+// stageError wraps an error terminating the session, for Server.ErrorHook.
+func (m *milterSession) stageError(op string, err error) error {
+	return &MilterError{Stage: m.stage, Op: op, QueueID: m.macros.get("i"), Err: err}
+}
@@ -0,0 +1,69 @@
+package milter
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMilterError(t *testing.T) {
+	for _, tc := range []struct {
+		err      *MilterError
+		expected string
+	}{
+		{&MilterError{Stage: CodeMail, Op: "read", Err: io.EOF}, "milter: mail: read: EOF"},
+		{&MilterError{Stage: CodeEOB, Op: "write", QueueID: "4F3xyz", Err: newWriteError(io.ErrClosedPipe, 0)}, "milter: eom (queue ID 4F3xyz): write: peer gone: io: read/write on closed pipe"},
+		{&MilterError{Err: ErrPeerNotAllowed}, ErrPeerNotAllowed.Error()},
+	} {
+		if s := tc.err.Error(); s != tc.expected {
+			t.Errorf("Error() = %q, want %q", s, tc.expected)
+		}
+	}
+}
+
+func TestMilterError_Session(t *testing.T) {
+	errCh := make(chan error, 1)
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		MaxPacketSize: 64,
+		ErrorHook: func(err error) {
+			errCh <- err
+		},
+		Logger: &testLogger{},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	defer session.Close()
+
+	if err := session.Macros(CodeMail, "i", "4F3xyz"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := session.Mail(strings.Repeat("a", 128)+"@example.org", nil)
+	var merr *MilterError
+	if !errors.As(err, &merr) {
+		t.Fatalf("Expected *MilterError, got %v", err)
+	}
+	if merr.Stage != CodeMail || merr.Op != "read" || merr.QueueID != "4F3xyz" {
+		t.Errorf("Wrong client error: %+v", merr)
+	}
+
+	select {
+	case err := <-errCh:
+		var sizeErr *PacketSizeError
+		if !errors.As(err, &merr) || !errors.As(err, &sizeErr) {
+			t.Fatalf("Expected *MilterError wrapping *PacketSizeError, got %v", err)
+		}
+		if merr.Op != "read" || merr.QueueID != "4F3xyz" {
+			t.Errorf("Wrong server error: %+v", merr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ErrorHook not called")
+	}
+}
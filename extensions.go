@@ -0,0 +1,30 @@
+package milter
+
+// ModifyActionDecoder decodes the payload of a vendor-specific modify action.
+type ModifyActionDecoder func(data []byte) (interface{}, error)
+
+// Extensions is a registry of vendor-specific modify action codes, allowing
+// clients to support protocol extensions without patching the package.
+// Servers handle vendor-specific commands with Server.HandleRaw.
+//
+// Extensions must not be modified once in use.
+type Extensions struct {
+	modifyActs map[ModifyActCode]ModifyActionDecoder
+}
+
+// RegisterModifyAction registers a client decoder for a modify action code
+// not recognized by the package. Decoded actions are returned with the
+// decoder result in ModifyAction.Extension.
+func (e *Extensions) RegisterModifyAction(code ModifyActCode, dec ModifyActionDecoder) {
+	if e.modifyActs == nil {
+		e.modifyActs = make(map[ModifyActCode]ModifyActionDecoder)
+	}
+	e.modifyActs[code] = dec
+}
+
+func (e *Extensions) modifyAction(code ModifyActCode) ModifyActionDecoder {
+	if e == nil {
+		return nil
+	}
+	return e.modifyActs[code]
+}
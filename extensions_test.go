@@ -0,0 +1,139 @@
+package milter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_HandleRaw(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+	}
+	var received string
+	s.HandleRaw('X', func(msg *Message, m *Modifier) (Response, error) {
+		received = string(msg.Data)
+		return RespContinue, nil
+	})
+	defer s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := writePacket(conn, &Message{Code: 'X', Data: []byte("hello")}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readPacket(conn, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ActionCode(msg.Code) != ActContinue {
+		t.Fatalf("Unexpected response: %c", msg.Code)
+	}
+	if received != "hello" {
+		t.Fatalf("Wrong data: %q", received)
+	}
+
+	// Unregistered codes close the session
+	if err := writePacket(conn, &Message{Code: 'Y'}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPacket(conn, time.Second, 0); err == nil {
+		t.Fatal("Expected the session to be closed")
+	}
+}
+
+func TestServer_OnUnknownMessage(t *testing.T) {
+	var received []byte
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		OnUnknownMessage: func(msg *Message) (Response, error) {
+			received = append(received, msg.Code)
+			if msg.Code == 'Y' {
+				return nil, nil
+			}
+			return RespContinue, nil
+		},
+	}
+	serverConn, conn := net.Pipe()
+	defer conn.Close()
+	go s.newSession(serverConn, nil).HandleMilterCommands()
+
+	for _, code := range []byte{'Y', 'X'} {
+		if err := writePacket(conn, &Message{Code: code}, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := readPacket(conn, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ActionCode(msg.Code) != ActContinue {
+		t.Fatalf("Unexpected response: %c", msg.Code)
+	}
+	if string(received) != "YX" {
+		t.Fatalf("Wrong commands received: %q", received)
+	}
+}
+
+type extensionMilter struct {
+	NoOpMilter
+}
+
+func (extensionMilter) Body(m *Modifier) (Response, error) {
+	if err := m.writer.WriteAction(&Message{Code: 'Z', Data: []byte("payload")}); err != nil {
+		return nil, err
+	}
+	if err := m.AddHeader("X-After", "1"); err != nil {
+		return nil, err
+	}
+	return RespAccept, nil
+}
+
+func TestClient_Extensions(t *testing.T) {
+	var ext Extensions
+	ext.RegisterModifyAction('Z', func(data []byte) (interface{}, error) {
+		return string(data), nil
+	})
+	s := Server{
+		NewMilter: func() Milter {
+			return extensionMilter{}
+		},
+		Actions: OptAddHeader,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{Extensions: &ext})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	acts, act, err := session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActAccept {
+		t.Fatal("Unexpected action:", act.Code)
+	}
+	if len(acts) != 2 {
+		t.Fatal("Wrong amount of modify actions:", len(acts))
+	}
+	if acts[0].Code != 'Z' || acts[0].Extension != "payload" || acts[0].Seq != 0 {
+		t.Fatalf("Wrong extension action: %+v", acts[0])
+	}
+	if acts[1].Code != ActAddHeader || acts[1].Seq != 1 {
+		t.Fatalf("Wrong header action: %+v", acts[1])
+	}
+}
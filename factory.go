@@ -0,0 +1,43 @@
+package milter
+
+// MilterFactory creates the Milter of new connections and messages, along
+// with the actions and protocol options requested from the MTA.
+type MilterFactory struct {
+	NewMilter func(conn ConnInfo) Milter
+	Actions   OptAction
+	Protocol  OptProtocol
+}
+
+// sessionFactory is the factory used by a session.
+type sessionFactory struct {
+	MilterFactory
+	// withConn is set if NewMilter uses the connection information, in which
+	// case the Milter is created again once the TLS handshake is complete.
+	withConn bool
+}
+
+// SetMilterFactory replaces Server.NewMilter, Server.NewMilterWithConn,
+// Server.Actions and Server.Protocol, which are ignored from then on. It can
+// be called while the server is running, e.g. to reload the configuration of
+// a daemon without dropping the connections of the MTAs: sessions started
+// before the call keep using the previous factory until they are closed.
+func (s *Server) SetMilterFactory(f MilterFactory) {
+	s.factory.Store(&sessionFactory{MilterFactory: f, withConn: true})
+}
+
+// milterFactory returns the factory of new sessions.
+func (s *Server) milterFactory() *sessionFactory {
+	if f, ok := s.factory.Load().(*sessionFactory); ok {
+		return f
+	}
+	if s.NewMilterWithConn != nil {
+		return &sessionFactory{
+			MilterFactory: MilterFactory{s.NewMilterWithConn, s.Actions, s.Protocol},
+			withConn:      true,
+		}
+	}
+	newMilter := s.NewMilter
+	return &sessionFactory{
+		MilterFactory: MilterFactory{func(ConnInfo) Milter { return newMilter() }, s.Actions, s.Protocol},
+	}
+}
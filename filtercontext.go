@@ -0,0 +1,68 @@
+package milter
+
+import (
+	"fmt"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// FilterContextHeader is the header field used by chained filters to pass
+// structured context to each other, for instance a spam score computed by a
+// filter and consumed by the next one.
+//
+// Each field carries the context of one filter, formatted as a MIME media
+// type with parameters:
+//
+//	X-Milter-Context: spamfilter; score=7.5; verdict=spam
+const FilterContextHeader = "X-Milter-Context"
+
+// AddFilterContext adds a FilterContextHeader field carrying values for the
+// named filter. Like other modifications, it must be called at end of
+// message.
+func (m *Modifier) AddFilterContext(filter string, values map[string]string) error {
+	v := mime.FormatMediaType(filter, values)
+	if v == "" {
+		return fmt.Errorf("milter: invalid filter context for %q", filter)
+	}
+	return m.AddHeader(FilterContextHeader, v)
+}
+
+// FilterContext returns the values passed by the named filter in the
+// FilterContextHeader fields of h, or nil if there are none.
+func FilterContext(h textproto.MIMEHeader, filter string) map[string]string {
+	for _, v := range h.Values(FilterContextHeader) {
+		name, params, err := mime.ParseMediaType(v)
+		if err == nil && name == filter {
+			return params
+		}
+	}
+	return nil
+}
+
+// FilterContextStripper is a Milter removing the FilterContextHeader fields
+// at end of message, before passing it on to the wrapped Milter. It is meant
+// to wrap the last filter of the chain, so that the context does not leak
+// into delivered messages. The OptChangeHeader action is required.
+type FilterContextStripper struct {
+	Passthrough
+}
+
+var _ Milter = FilterContextStripper{}
+
+func (fs FilterContextStripper) Body(m *Modifier) (Response, error) {
+	// Count the fields as the MTA does, from the fields as received.
+	n := 0
+	for _, f := range m.HeaderFields() {
+		if strings.EqualFold(f.Key, FilterContextHeader) {
+			n++
+		}
+	}
+	// Delete from the last field so that indexes stay valid.
+	for i := n; i > 0; i-- {
+		if err := m.ChangeHeader(i, FilterContextHeader, ""); err != nil {
+			return nil, err
+		}
+	}
+	return fs.Passthrough.Body(m)
+}
@@ -0,0 +1,54 @@
+package milter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func TestFilterContextStripper(t *testing.T) {
+	var values map[string]string
+	mm := MockMilter{
+		HdrResp:  RespContinue,
+		HdrsResp: RespContinue,
+		BodyResp: RespAccept,
+		BodyMod: func(m *Modifier) {
+			values = FilterContext(m.Headers, "spamfilter")
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return FilterContextStripper{Passthrough{&mm}}
+		},
+		Actions: OptChangeHeader,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptChangeHeader,
+	})
+	defer session.Close()
+
+	hdr := textproto.Header{}
+	hdr.Add(FilterContextHeader, "spamfilter; score=7.5")
+	hdr.Add("x-milter-context", "virusfilter; clean=yes")
+	if _, err := session.Header(hdr); err != nil {
+		t.Fatal(err)
+	}
+	modifyActs, _, err := session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(values, map[string]string{"score": "7.5"}) {
+		t.Fatal("Wrong filter context:", values)
+	}
+	if len(modifyActs) != 2 {
+		t.Fatal("Wrong amount of modify actions:", len(modifyActs))
+	}
+	for i, act := range modifyActs {
+		if act.Code != ActChangeHeader || act.HeaderValue != "" || act.HeaderIndex != uint32(2-i) {
+			t.Fatalf("Wrong modify action: %+v", act)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Package framework provides the scaffolding of milter daemons: command-line
+// flags and environment variables, TLS, signal handling, graceful shutdown,
+// logging and a metrics endpoint.
+//
+// A complete filter daemon looks like this:
+//
+//	type filter struct {
+//		milter.NoOpMilter
+//	}
+//
+//	func (filter) Body(m *milter.Modifier) (milter.Response, error) {
+//		if err := m.AddHeader("X-Filtered", "yes"); err != nil {
+//			return nil, err
+//		}
+//		return milter.RespAccept, nil
+//	}
+//
+//	func main() {
+//		framework.Main(&milter.Server{
+//			NewMilter: func() milter.Milter { return filter{} },
+//			Actions:   milter.OptAddHeader,
+//		})
+//	}
+//
+// and is started with e.g. "-listen inet:8891@127.0.0.1" or with the
+// MILTER_LISTEN environment variable set.
+package framework
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-milter"
+)
+
+// EnvPrefix is the prefix of the environment variables read by LoadEnv.
+const EnvPrefix = "MILTER_"
+
+// Config is the configuration of a milter daemon.
+type Config struct {
+	// Listen is the address to listen on, see ParseListen.
+	Listen string
+
+	// TLSCert and TLSKey are the paths to the PEM-encoded certificate and
+	// key of the server. If set, connections are secured with TLS.
+	TLSCert string
+	TLSKey  string
+	// TLSClientCA is the path to the PEM-encoded CA certificates used to
+	// verify the certificates of MTAs. If set, MTAs must present a
+	// certificate.
+	TLSClientCA string
+
+	// ReadTimeout and WriteTimeout override the timeouts of the server if
+	// not zero.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// ShutdownTimeout is how long messages in progress are waited for when
+	// shutting down. Zero means 30 seconds.
+	ShutdownTimeout time.Duration
+
+	// MetricsAddr is the TCP address of the HTTP metrics endpoint. If empty,
+	// it is disabled. The endpoint serves expvar variables on /debug/vars,
+	// a health check backed by milter.Server.SelfTest on /healthz and the
+	// statistics of the load shedder, if any, on /debug/milter/load.
+	MetricsAddr string
+}
+
+// RegisterFlags registers the command-line flags of the configuration.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to listen on, e.g. unix:/run/milter.sock or inet:8891@127.0.0.1")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "path to the TLS certificate")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "path to the TLS key")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "path to the CA certificates verifying MTA certificates")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "timeout reading commands from the MTA")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "timeout writing responses to the MTA")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time to wait for messages in progress when shutting down")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "address of the HTTP metrics endpoint")
+}
+
+// LoadEnv sets the flags of fs from the environment. The environment
+// variable of a flag is its name in upper case, prefixed with EnvPrefix and
+// with dashes replaced by underscores, e.g. MILTER_TLS_CERT for -tls-cert.
+// It must be called before parsing the command line, so that flags take
+// precedence.
+func LoadEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		v, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, v); setErr != nil {
+			err = fmt.Errorf("framework: invalid value %q for %v: %w", v, name, setErr)
+		}
+	})
+	return err
+}
+
+// ParseListen parses a listen address. The following forms are accepted:
+//
+//	unix:/path or local:/path  unix socket
+//	/path                      unix socket
+//	inet:port@host             TCP, as in sendmail and Postfix
+//	inet6:port@host            TCP over IPv6
+//	tcp:host:port              TCP, also tcp4 and tcp6
+//	host:port                  TCP
+func ParseListen(spec string) (network, addr string, err error) {
+	if strings.HasPrefix(spec, "/") {
+		return "unix", spec, nil
+	}
+	i := strings.IndexByte(spec, ':')
+	if i < 0 {
+		return "", "", fmt.Errorf("framework: invalid listen address %q", spec)
+	}
+	scheme, rest := spec[:i], spec[i+1:]
+	switch scheme {
+	case "unix", "local":
+		return "unix", rest, nil
+	case "inet", "inet6":
+		network = "tcp"
+		if scheme == "inet6" {
+			network = "tcp6"
+		}
+		port, host := rest, ""
+		if j := strings.IndexByte(rest, '@'); j >= 0 {
+			port, host = rest[:j], rest[j+1:]
+		}
+		return network, net.JoinHostPort(host, port), nil
+	case "tcp", "tcp4", "tcp6":
+		return scheme, rest, nil
+	}
+	if _, _, err := net.SplitHostPort(spec); err != nil {
+		return "", "", fmt.Errorf("framework: invalid listen address %q", spec)
+	}
+	return "tcp", spec, nil
+}
+
+// tlsConfig loads the TLS configuration, nil if TLS is disabled.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		if c.TLSClientCA != "" {
+			return nil, errors.New("framework: TLS client CA set without certificate")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("framework: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if c.TLSClientCA != "" {
+		b, err := ioutil.ReadFile(c.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("framework: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("framework: no certificate found in %v", c.TLSClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// metricsHandler returns the handler of the metrics endpoint.
+func metricsHandler(s *milter.Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.SelfTest(5 * time.Second); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if s.LoadShedder != nil {
+		mux.HandleFunc("/debug/milter/load", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s.LoadShedder.Stats())
+		})
+	}
+	return mux
+}
+
+// Run serves milter sessions with s until ctx is cancelled, then shuts the
+// server down gracefully. If s.Logger is nil, it is set to a
+// milter.QueueIDLogger.
+func Run(ctx context.Context, s *milter.Server, c *Config) error {
+	return run(ctx, context.Background(), s, c)
+}
+
+// run is like Run, but the graceful shutdown is cut short and the remaining
+// connections are closed once forceCtx is cancelled.
+func run(ctx, forceCtx context.Context, s *milter.Server, c *Config) error {
+	if c.Listen == "" {
+		return errors.New("framework: no listen address")
+	}
+	network, addr, err := ParseListen(c.Listen)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	if c.ReadTimeout != 0 {
+		s.ReadTimeout = c.ReadTimeout
+	}
+	if c.WriteTimeout != 0 {
+		s.WriteTimeout = c.WriteTimeout
+	}
+	if s.Logger == nil {
+		s.Logger = &milter.QueueIDLogger{}
+	}
+
+	var metrics *http.Server
+	if c.MetricsAddr != "" {
+		ln, err := net.Listen("tcp", c.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("framework: %w", err)
+		}
+		metrics = &http.Server{Handler: metricsHandler(s)}
+		go metrics.Serve(ln)
+		log.Printf("Serving metrics on %v", ln.Addr())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			done <- s.ListenAndServeTLS(network, addr, tlsConfig)
+		} else {
+			done <- s.ListenAndServe(network, addr)
+		}
+	}()
+	log.Printf("Listening on %v %v", network, addr)
+
+	select {
+	case err := <-done:
+		if metrics != nil {
+			metrics.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down")
+	timeout := c.ShutdownTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	shutdownCtx, cancel := context.WithTimeout(forceCtx, timeout)
+	defer cancel()
+	err = s.Shutdown(shutdownCtx)
+	if metrics != nil {
+		metrics.Shutdown(shutdownCtx)
+	}
+	if serveErr := <-done; serveErr != milter.ErrServerClosed && err == nil {
+		err = serveErr
+	}
+	return err
+}
+
+// Main parses the command line and the environment, see Config.RegisterFlags
+// and LoadEnv, and runs s until SIGINT or SIGTERM is received. A second
+// signal closes the remaining connections immediately. Main exits the process
+// on error.
+//
+// Flags of the daemon itself can be registered with the flag package before
+// calling Main.
+func Main(s *milter.Server) {
+	var c Config
+	c.RegisterFlags(flag.CommandLine)
+	if err := LoadEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	forceCtx, force := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+		<-sigs
+		log.Printf("Closing remaining connections")
+		force()
+	}()
+
+	if err := run(ctx, forceCtx, s, &c); err != nil {
+		log.Fatal(err)
+	}
+}
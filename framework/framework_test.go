@@ -0,0 +1,166 @@
+package framework
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-milter"
+)
+
+func TestParseListen(t *testing.T) {
+	for _, tc := range []struct {
+		spec, network, addr string
+	}{
+		{"unix:/run/milter.sock", "unix", "/run/milter.sock"},
+		{"local:/run/milter.sock", "unix", "/run/milter.sock"},
+		{"/run/milter.sock", "unix", "/run/milter.sock"},
+		{"inet:8891@127.0.0.1", "tcp", "127.0.0.1:8891"},
+		{"inet:8891", "tcp", ":8891"},
+		{"inet6:8891@::1", "tcp6", "[::1]:8891"},
+		{"tcp:127.0.0.1:8891", "tcp", "127.0.0.1:8891"},
+		{"tcp6:[::1]:8891", "tcp6", "[::1]:8891"},
+		{"127.0.0.1:8891", "tcp", "127.0.0.1:8891"},
+	} {
+		network, addr, err := ParseListen(tc.spec)
+		if err != nil {
+			t.Errorf("ParseListen(%q): %v", tc.spec, err)
+		} else if network != tc.network || addr != tc.addr {
+			t.Errorf("ParseListen(%q) = %q, %q, want %q, %q", tc.spec, network, addr, tc.network, tc.addr)
+		}
+	}
+
+	for _, spec := range []string{"", "milter", "foo:bar:baz"} {
+		if _, _, err := ParseListen(spec); err == nil {
+			t.Errorf("ParseListen(%q): expected error", spec)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var c Config
+	c.RegisterFlags(fs)
+
+	os.Setenv("MILTER_LISTEN", "inet:8891@127.0.0.1")
+	os.Setenv("MILTER_READ_TIMEOUT", "5s")
+	defer os.Unsetenv("MILTER_LISTEN")
+	defer os.Unsetenv("MILTER_READ_TIMEOUT")
+	if err := LoadEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse([]string{"-read-timeout", "10s"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != "inet:8891@127.0.0.1" {
+		t.Errorf("Wrong listen address: %q", c.Listen)
+	}
+	if c.ReadTimeout != 10*time.Second {
+		t.Errorf("Flag didn't take precedence: %v", c.ReadTimeout)
+	}
+
+	os.Setenv("MILTER_READ_TIMEOUT", "soon")
+	if err := LoadEnv(fs); err == nil {
+		t.Error("Expected error for invalid value")
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "milter-framework")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "milter.sock")
+
+	s := &milter.Server{
+		NewMilter: func() milter.Milter { return milter.NoOpMilter{} },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, s, &Config{Listen: "unix:" + path, ShutdownTimeout: time.Second})
+	}()
+
+	cl := milter.NewClientWithOptions("unix", path, milter.ClientOptions{})
+	var session *milter.ClientSession
+	for i := 0; i < 100; i++ {
+		if session, err = cl.Session(); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Helo("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Fatal("Expected the server to be closed")
+	}
+}
+
+func TestRun_Force(t *testing.T) {
+	dir, err := ioutil.TempDir("", "milter-framework")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "milter.sock")
+
+	s := &milter.Server{
+		NewMilter: func() milter.Milter { return milter.NoOpMilter{} },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	forceCtx, force := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, forceCtx, s, &Config{Listen: "unix:" + path, ShutdownTimeout: time.Minute})
+	}()
+
+	cl := milter.NewClientWithOptions("unix", path, milter.ClientOptions{})
+	var session *milter.ClientSession
+	for i := 0; i < 100; i++ {
+		if session, err = cl.Session(); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message in progress delays the shutdown
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatal("Run returned with a message in progress:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	force()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return once forced")
+	}
+	if _, err := session.Rcpt("to@example.org", nil); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+}
@@ -0,0 +1,57 @@
+package milter
+
+import (
+	"hash"
+)
+
+// bodyHasher computes a set of named hashes over the body chunks of the
+// current message.
+type bodyHasher struct {
+	newHashes map[string]func() hash.Hash
+	hashes    map[string]hash.Hash
+}
+
+func newBodyHasher(newHashes map[string]func() hash.Hash) *bodyHasher {
+	if len(newHashes) == 0 {
+		return nil
+	}
+	return &bodyHasher{newHashes: newHashes}
+}
+
+// Write feeds a body chunk to all hashes.
+func (h *bodyHasher) Write(chunk []byte) {
+	if h == nil {
+		return
+	}
+	if h.hashes == nil {
+		h.hashes = make(map[string]hash.Hash, len(h.newHashes))
+		for name, newHash := range h.newHashes {
+			h.hashes[name] = newHash()
+		}
+	}
+	for _, hh := range h.hashes {
+		hh.Write(chunk)
+	}
+}
+
+// Sums returns the hash values of the body data written so far.
+func (h *bodyHasher) Sums() map[string][]byte {
+	if h == nil {
+		return nil
+	}
+	// Make sure hashes of an empty body are reported too.
+	h.Write(nil)
+	sums := make(map[string][]byte, len(h.hashes))
+	for name, hh := range h.hashes {
+		sums[name] = hh.Sum(nil)
+	}
+	return sums
+}
+
+// Reset discards the state of all hashes.
+func (h *bodyHasher) Reset() {
+	if h == nil {
+		return
+	}
+	h.hashes = nil
+}
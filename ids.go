@@ -0,0 +1,33 @@
+package milter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// IDGenerator generates identifiers for server sessions.
+type IDGenerator interface {
+	NewID() string
+}
+
+// Clock provides the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type randomIDGenerator struct{}
+
+func (randomIDGenerator) NewID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,70 @@
+package milter
+
+import (
+	"sync"
+	"time"
+)
+
+// progressKeepAlive sends progress packets while the end of message callback
+// runs, see Server.ProgressInterval. Modification actions are written through
+// actionWriter, so that they are never interleaved with progress packets.
+type progressKeepAlive struct {
+	mu       sync.Mutex
+	stopCh   chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	err      error
+}
+
+func (m *milterSession) startKeepAlive(interval time.Duration) *progressKeepAlive {
+	k := &progressKeepAlive{
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(k.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-k.stopCh:
+				return
+			case <-ticker.C:
+			}
+			k.mu.Lock()
+			select {
+			case <-k.stopCh:
+				// the callback returned while an action was written
+				k.mu.Unlock()
+				return
+			default:
+			}
+			err := m.WritePacket(&Message{Code: 'p' /* progress */})
+			k.mu.Unlock()
+			if err != nil {
+				k.err = err
+				return
+			}
+		}
+	}()
+	return k
+}
+
+// actionWriter serializes the writes of w with progress packets.
+func (k *progressKeepAlive) actionWriter(w ActionWriter) ActionWriter {
+	return ActionWriterFunc(func(msg *Message) error {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		return w.WriteAction(msg)
+	})
+}
+
+// stop stops sending progress packets and waits until no packet is being
+// written. It returns the error which stopped the keep-alive early, if any.
+func (k *progressKeepAlive) stop() error {
+	k.stopOnce.Do(func() {
+		close(k.stopCh)
+	})
+	<-k.done
+	return k.err
+}
@@ -0,0 +1,61 @@
+package milter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_ProgressInterval(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return &MockMilter{
+				BodyResp: RespAccept,
+				BodyMod: func(m *Modifier) {
+					m.AddHeader("X-Before", "1")
+					time.Sleep(100 * time.Millisecond)
+					m.AddHeader("X-After", "1")
+				},
+			}
+		},
+		Actions:          OptAddHeader,
+		ProgressInterval: 20 * time.Millisecond,
+	}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	session := s.newSession(serverConn, nil)
+	go func() {
+		resp, err := session.Process(&Message{Code: byte(CodeEOB)})
+		if err != nil {
+			t.Error(err)
+		} else if err := session.WritePacket(resp.Response()); err != nil {
+			t.Error(err)
+		}
+		serverConn.Close()
+	}()
+
+	var codes []byte
+	for {
+		msg, err := readPacket(clientConn, time.Second, 0)
+		if err != nil {
+			break
+		}
+		codes = append(codes, msg.Code)
+	}
+
+	progress := 0
+	for i, code := range codes {
+		switch {
+		case code == 'p':
+			progress++
+		case i == 0 && code != byte(ActAddHeader):
+			t.Fatalf("Unexpected first packet: %q", codes)
+		}
+	}
+	if progress < 2 {
+		t.Fatalf("Expected progress packets while the callback runs: %q", codes)
+	}
+	if last := codes[len(codes)-1]; last != byte(ActAccept) {
+		t.Fatalf("Progress packet sent after the response: %q", codes)
+	}
+}
@@ -0,0 +1,64 @@
+package milter
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// stageLabels maps commands to the values of the "milter.stage" profiler
+// label
+var stageLabels = map[Code]string{
+	CodeConn:    "connect",
+	CodeHelo:    "helo",
+	CodeMail:    "mail",
+	CodeRcpt:    "rcpt",
+	CodeData:    "data",
+	CodeHeader:  "header",
+	CodeEOH:     "headers",
+	CodeBody:    "body",
+	CodeEOB:     "eom",
+	CodeAbort:   "abort",
+	CodeUnknown: "unknown",
+}
+
+// setSessionLabels sets the profiler labels of the session on the current
+// goroutine, if Server.ProfilerLabels is set.
+func (m *milterSession) setSessionLabels() {
+	if !m.server.ProfilerLabels {
+		return
+	}
+	peer := ""
+	if m.connInfo.RemoteAddr != nil {
+		peer = m.connInfo.RemoteAddr.String()
+	}
+	m.labelCtx = pprof.WithLabels(context.Background(), pprof.Labels(
+		"milter.session_id", m.id,
+		"milter.peer", peer,
+	))
+	pprof.SetGoroutineLabels(m.labelCtx)
+}
+
+// setStageLabels adds the stage of a command to the profiler labels of the
+// current goroutine. The returned function restores the session labels.
+func (m *milterSession) setStageLabels(code Code) func() {
+	stage, ok := stageLabels[code]
+	if m.labelCtx == nil || !ok {
+		return func() {}
+	}
+	pprof.SetGoroutineLabels(pprof.WithLabels(m.labelCtx, pprof.Labels("milter.stage", stage)))
+	return func() {
+		pprof.SetGoroutineLabels(m.labelCtx)
+	}
+}
+
+// doWithLabels runs f with the profiler labels of a client operation, if
+// ClientOptions.ProfilerLabels is set.
+func (s *ClientSession) doWithLabels(stage string, f func()) {
+	if !s.profilerLabels {
+		f()
+		return
+	}
+	pprof.Do(context.Background(), pprof.Labels("milter.peer", s.conn.RemoteAddr().String(), "milter.stage", stage), func(context.Context) {
+		f()
+	})
+}
@@ -0,0 +1,162 @@
+package milter
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ListenAndServe listens on the network address and serves milter sessions.
+//
+// For unix sockets, a stale socket file left behind by a previous process is
+// removed first, the file mode and owner are set to Server.UnixSocketMode,
+// UnixSocketOwner and UnixSocketGroup before the socket is reachable and the
+// socket file is removed when ListenAndServe returns.
+func (s *Server) ListenAndServe(network, addr string) error {
+	ln, err := s.listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// ListenAndServeTLS is like ListenAndServe, but connections are secured with
+// TLS. Set config.ClientAuth to verify MTA certificates, the certificates
+// presented are available in ConnInfo.TLS.
+func (s *Server) ListenAndServeTLS(network, addr string, config *tls.Config) error {
+	ln, err := s.listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(tls.NewListener(ln, config))
+}
+
+func (s *Server) listen(network, addr string) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	if err := removeStaleSocket(addr); err != nil {
+		return nil, err
+	}
+	if s.UnixSocketMode == 0 && s.UnixSocketOwner == "" && s.UnixSocketGroup == "" {
+		return net.Listen(network, addr)
+	}
+
+	uid, gid, err := lookupOwner(s.UnixSocketOwner, s.UnixSocketGroup)
+	if err != nil {
+		return nil, err
+	}
+	// Set the socket up under a temporary name and move it in place, so
+	// that it is never reachable with the wrong permissions.
+	tmp := fmt.Sprintf("%v.%v.tmp", addr, os.Getpid())
+	ln, err := net.Listen(network, tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := ln.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	err = func() error {
+		if s.UnixSocketMode != 0 {
+			if err := os.Chmod(tmp, s.UnixSocketMode); err != nil {
+				return err
+			}
+		}
+		if uid != -1 || gid != -1 {
+			if err := os.Chown(tmp, uid, gid); err != nil {
+				return err
+			}
+		}
+		return os.Rename(tmp, addr)
+	}()
+	if err != nil {
+		ul.Close()
+		os.Remove(tmp)
+		return nil, fmt.Errorf("milter: listen: %w", err)
+	}
+	return &unixListener{UnixListener: ul, path: addr}, nil
+}
+
+// unixListener removes its socket file when closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+// Addr returns the final path of the socket, rather than its temporary path.
+func (ln *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: ln.path, Net: "unix"}
+}
+
+func (ln *unixListener) Close() error {
+	err := ln.UnixListener.Close()
+	ln.once.Do(func() {
+		os.Remove(ln.path)
+	})
+	return err
+}
+
+// lookupOwner resolves the user and group names or IDs of
+// Server.UnixSocketOwner and Server.UnixSocketGroup. Empty names are
+// resolved to -1, leaving the owner or group unchanged.
+func lookupOwner(owner, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner != "" {
+		if uid, err = strconv.Atoi(owner); err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return 0, 0, fmt.Errorf("milter: listen: %w", err)
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return 0, 0, fmt.Errorf("milter: listen: invalid UID %q", u.Uid)
+			}
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, fmt.Errorf("milter: listen: %w", err)
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, fmt.Errorf("milter: listen: invalid GID %q", g.Gid)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// removeStaleSocket removes the unix socket at path if no process is
+// listening on it anymore.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("milter: listen: %w", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("milter: listen: %v exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("milter: listen: %v is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("milter: listen: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("milter: listen: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package milter
+
+import (
+	"fmt"
+	"net"
+)
+
+// serverListener is a listener being served.
+type serverListener struct {
+	net.Listener
+	// closed is set by CloseListener, protected by Server.mu.
+	closed bool
+}
+
+// addListener registers a listener being served. It returns nil if the
+// server is closed.
+func (s *Server) addListener(ln net.Listener) *serverListener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	sl := &serverListener{Listener: ln}
+	s.listeners = append(s.listeners, sl)
+	return sl
+}
+
+func (s *Server) removeListener(sl *serverListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.listeners {
+		if other == sl {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			break
+		}
+	}
+}
+
+// listenerClosed returns the error Serve returns if the listener was closed
+// on purpose, nil otherwise.
+func (s *Server) listenerClosed(sl *serverListener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.closed:
+		return ErrServerClosed
+	case sl.closed:
+		return ErrListenerClosed
+	}
+	return nil
+}
+
+// Addrs returns the addresses of the listeners being served, in the order
+// Serve was called.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, sl := range s.listeners {
+		addrs[i] = sl.Addr()
+	}
+	return addrs
+}
+
+// CloseListener closes the listener serving addr, as returned by Addrs,
+// without affecting the other listeners and the sessions in progress. Serve
+// returns ErrListenerClosed for this listener.
+func (s *Server) CloseListener(addr net.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sl := range s.listeners {
+		if a := sl.Addr(); a.Network() == addr.Network() && a.String() == addr.String() {
+			sl.closed = true
+			return sl.Close()
+		}
+	}
+	return fmt.Errorf("milter: no listener on %v %v", addr.Network(), addr)
+}
@@ -0,0 +1,92 @@
+package milter
+
+import (
+	"sync"
+)
+
+// LoadShedder switches a server into a mode where new messages are answered
+// with a temporary failure while the load of the filter is too high, so that
+// overloaded filters shed load gracefully instead of timing out.
+//
+// The load is reported by the filter, typically the length of a worker pool
+// or scanner queue. Shedding starts once the load reaches High and stops once
+// it falls back to Low, the gap between both preventing flapping.
+//
+// LoadShedder is safe for concurrent use.
+type LoadShedder struct {
+	High int64
+	Low  int64
+
+	mu       sync.Mutex
+	load     int64
+	shedding bool
+	stats    LoadStats
+}
+
+// LoadStats are metrics about a LoadShedder.
+type LoadStats struct {
+	// Current load.
+	Load int64
+	// Whether new messages are currently refused.
+	Shedding bool
+	// Number of times shedding started.
+	Transitions uint64
+	// Number of messages refused.
+	Refused uint64
+}
+
+// Add adds delta to the load.
+func (l *LoadShedder) Add(delta int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLocked(l.load + delta)
+}
+
+// Set sets the load.
+func (l *LoadShedder) Set(load int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLocked(load)
+}
+
+func (l *LoadShedder) setLocked(load int64) {
+	l.load = load
+	switch {
+	case !l.shedding && load >= l.High:
+		l.shedding = true
+		l.stats.Transitions++
+	case l.shedding && load <= l.Low:
+		l.shedding = false
+	}
+}
+
+// Shedding reports whether new messages are refused.
+func (l *LoadShedder) Shedding() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.shedding
+}
+
+// Stats returns metrics about the LoadShedder.
+func (l *LoadShedder) Stats() LoadStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.Load = l.load
+	stats.Shedding = l.shedding
+	return stats
+}
+
+// refuse reports whether a new message should be refused, and counts it if
+// so.
+func (l *LoadShedder) refuse() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shedding {
+		l.stats.Refused++
+	}
+	return l.shedding
+}
@@ -0,0 +1,85 @@
+package milter
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+)
+
+// Logger receives the log messages of the server: protocol errors, unknown
+// commands, handler failures and messages logged with Modifier.Logf.
+type Logger interface {
+	// Logf logs a message about a session. queueID is the queue ID of the
+	// current message from the "i" macro, it is empty if unknown. sessionID
+	// is empty for messages not related to a session.
+	Logf(sessionID, queueID string, format string, v ...interface{})
+}
+
+// QueueIDLogger is a logging adapter formatting messages in the
+// "queueid: message" convention used by Postfix, so that filter logs
+// interleave naturally with MTA logs. The queue ID is taken from the "i"
+// macro. To use it, set Server.Logger to &QueueIDLogger{}.
+type QueueIDLogger struct {
+	// Destination logger. If nil, the standard logger is used.
+	Logger *log.Logger
+}
+
+var _ Logger = (*QueueIDLogger)(nil)
+
+// Printf logs a message about the message with the specified queue ID. If
+// the queue ID is unknown, the message is logged without prefix.
+func (l *QueueIDLogger) Printf(queueID string, format string, v ...interface{}) {
+	l.output(queueID, fmt.Sprintf(format, v...))
+}
+
+// Logf implements Logger.
+func (l *QueueIDLogger) Logf(sessionID, queueID string, format string, v ...interface{}) {
+	l.output(queueID, fmt.Sprintf(format, v...))
+}
+
+func (l *QueueIDLogger) output(queueID, msg string) {
+	if queueID != "" {
+		msg = queueID + ": " + msg
+	}
+	depth := callerDepth()
+	if l.Logger != nil {
+		l.Logger.Output(depth, msg)
+	} else {
+		log.Output(depth, msg)
+	}
+}
+
+// loggingFuncs are the functions of this package forwarding log messages.
+var loggingFuncs = map[string]bool{
+	"github.com/emersion/go-milter.(*QueueIDLogger).Printf":  true,
+	"github.com/emersion/go-milter.(*QueueIDLogger).Logf":    true,
+	"github.com/emersion/go-milter.(*QueueIDLogger).output":  true,
+	"github.com/emersion/go-milter.(*Modifier).Logf":         true,
+	"github.com/emersion/go-milter.(*milterSession).logf":    true,
+	"github.com/emersion/go-milter.(*milterSession).logf-fm": true,
+	"github.com/emersion/go-milter.(*Server).logf":           true,
+}
+
+// callerDepth returns the call depth of the function which logged a message,
+// skipping the logging wrappers of this package, as expected by log.Output
+// when called by the caller of callerDepth.
+func callerDepth() int {
+	pcs := make([]uintptr, 16)
+	// Skip runtime.Callers and callerDepth
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	depth := 1
+	for {
+		frame, more := frames.Next()
+		if !loggingFuncs[frame.Function] || !more {
+			return depth
+		}
+		depth++
+	}
+}
+
+// Logf logs a message about the current message through Server.Logger, or
+// the standard logger if unset.
+func (m *Modifier) Logf(format string, v ...interface{}) {
+	m.logf(format, v...)
+}
@@ -0,0 +1,58 @@
+package milter
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type loggingMilter struct {
+	NoOpMilter
+}
+
+func (loggingMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	m.Logf("Connection from %v", host)
+	return RespContinue, nil
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestQueueIDLogger(t *testing.T) {
+	var buf syncBuffer
+	s := Server{
+		NewMilter: func() Milter {
+			return loggingMilter{}
+		},
+		Logger: &QueueIDLogger{Logger: log.New(&buf, "", log.Lshortfile)},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Conn("mail.example.com", FamilyInet, 25, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The caller of Modifier.Logf is reported, not the logging wrappers
+	if out := buf.String(); !strings.HasPrefix(out, "logging_test.go:") || !strings.Contains(out, "Connection from mail.example.com") {
+		t.Fatalf("Wrong log output: %q", out)
+	}
+}
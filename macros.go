@@ -0,0 +1,182 @@
+package milter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// macroStages maps commands to the stage identifiers used in SETSYMLIST
+// macro requests (SMFIM_*).
+var macroStages = map[Code]uint32{
+	CodeConn: 0, // SMFIM_CONNECT
+	CodeHelo: 1, // SMFIM_HELO
+	CodeMail: 2, // SMFIM_ENVFROM
+	CodeRcpt: 3, // SMFIM_ENVRCPT
+	CodeData: 4, // SMFIM_DATA
+	CodeEOB:  5, // SMFIM_EOM
+	CodeEOH:  6, // SMFIM_EOH
+}
+
+// appendMacroRequests appends the SETSYMLIST macro lists to an OPTNEG
+// response.
+func appendMacroRequests(data []byte, reqs map[Code][]string) ([]byte, error) {
+	codes := make([]Code, 0, len(reqs))
+	for code := range reqs {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return macroStages[codes[i]] < macroStages[codes[j]]
+	})
+
+	for _, code := range codes {
+		stage, ok := macroStages[code]
+		if !ok {
+			return nil, fmt.Errorf("milter: negotiate: cannot request macros for command %c", code)
+		}
+		data = append(data, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(data[len(data)-4:], stage)
+		data = appendCString(data, strings.Join(reqs[code], " "))
+	}
+	return data, nil
+}
+
+// parseMacroRequests parses the SETSYMLIST macro lists of an OPTNEG response.
+func parseMacroRequests(data []byte, nulPolicy NULPolicy) (map[Code][]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	reqs := make(map[Code][]string)
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("milter: negotiate: truncated macro request")
+		}
+		stage := binary.BigEndian.Uint32(data)
+		list, rest, err := nulPolicy.readCString(data[4:])
+		if err != nil {
+			return nil, fmt.Errorf("milter: negotiate: %w", err)
+		}
+		data = rest
+
+		found := false
+		for code, s := range macroStages {
+			if s == stage {
+				reqs[code] = strings.Fields(list)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("milter: negotiate: unknown macro stage: %v", stage)
+		}
+	}
+	return reqs, nil
+}
+
+// macroAlias returns the other spelling of a macro name: MTAs send
+// single-character macros such as "i" without braces, but some send them as
+// "{i}", and the other way around for long names.
+func macroAlias(name string) string {
+	if len(name) > 2 && name[0] == '{' && name[len(name)-1] == '}' {
+		return name[1 : len(name)-1]
+	}
+	return "{" + name + "}"
+}
+
+// macroStore holds the macros sent by the MTA, per stage. A macro packet
+// replaces the macros of its stage. Macros of the connect and HELO stages are
+// scoped to the connection, the others are cleared at the end of each
+// message, as sendmail does.
+type macroStore struct {
+	stages map[Code]map[string]string
+}
+
+// set replaces the macros of a stage.
+func (s *macroStore) set(code Code, macros map[string]string) {
+	if s.stages == nil {
+		s.stages = make(map[Code]map[string]string)
+	}
+	s.stages[code] = macros
+}
+
+// macroOrder lists the commands in the order they are sent during a
+// session, which defines the precedence of their macros.
+var macroOrder = map[Code]int{
+	CodeConn:   1,
+	CodeHelo:   2,
+	CodeMail:   3,
+	CodeRcpt:   4,
+	CodeData:   5,
+	CodeHeader: 6,
+	CodeEOH:    7,
+	CodeBody:   8,
+	CodeEOB:    9,
+}
+
+// codes returns the stages holding macros, in protocol order. Macros sent for
+// other commands, such as CodeUnknown, come first.
+func (s *macroStore) codes() []Code {
+	codes := make([]Code, 0, len(s.stages))
+	for code := range s.stages {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if oi, oj := macroOrder[codes[i]], macroOrder[codes[j]]; oi != oj {
+			return oi < oj
+		}
+		return codes[i] < codes[j]
+	})
+	return codes
+}
+
+// get returns the value of a macro, later stages taking precedence. The
+// macro may have been sent with or without braces, see macroAlias.
+func (s *macroStore) get(name string) string {
+	alias := macroAlias(name)
+	codes := s.codes()
+	for i := len(codes) - 1; i >= 0; i-- {
+		if v, ok := s.stages[codes[i]][name]; ok {
+			return v
+		}
+		if v, ok := s.stages[codes[i]][alias]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// stage returns a copy of the macros of a stage.
+func (s *macroStore) stage(code Code) map[string]string {
+	macros := make(map[string]string, len(s.stages[code]))
+	for k, v := range s.stages[code] {
+		macros[k] = v
+	}
+	return macros
+}
+
+// all returns the macros of all stages merged, later stages taking
+// precedence.
+func (s *macroStore) all() map[string]string {
+	macros := make(map[string]string)
+	for _, code := range s.codes() {
+		for k, v := range s.stages[code] {
+			macros[k] = v
+		}
+	}
+	return macros
+}
+
+// resetMessage clears the message-scoped macros.
+func (s *macroStore) resetMessage() {
+	for code := range s.stages {
+		if code != CodeConn && code != CodeHelo {
+			delete(s.stages, code)
+		}
+	}
+}
+
+// reset clears all macros.
+func (s *macroStore) reset() {
+	s.stages = nil
+}
@@ -0,0 +1,320 @@
+package milter
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	msgtextproto "github.com/emersion/go-message/textproto"
+)
+
+var (
+	matrixFlag   = flag.Bool("matrix", false, "run the cross-version compatibility matrix")
+	matrixReport = flag.String("matrix.report", "", "write the compatibility matrix report to this file")
+)
+
+// Protocol options making the MTA skip a command.
+var matrixNoOpts = []OptProtocol{
+	OptNoConnect, OptNoHelo, OptNoMailFrom, OptNoRcptTo, OptNoBody,
+	OptNoHeaders, OptNoEOH, OptNoUnknown, OptNoData,
+}
+
+// Protocol options making the milter skip a reply.
+var matrixNoReplyOpts = []OptProtocol{
+	OptNoConnReply, OptNoHeloReply, OptNoMailReply, OptNoRcptReply,
+	OptNoHeaderReply, OptNoEOHReply, OptNoBodyReply, OptNoUnknownReply,
+	OptNoDataReply,
+}
+
+var matrixOptNames = map[OptProtocol]string{
+	OptNoConnect:      "NOCONNECT",
+	OptNoHelo:         "NOHELO",
+	OptNoMailFrom:     "NOMAIL",
+	OptNoRcptTo:       "NORCPT",
+	OptNoBody:         "NOBODY",
+	OptNoHeaders:      "NOHDRS",
+	OptNoEOH:          "NOEOH",
+	OptNoUnknown:      "NOUNKNOWN",
+	OptNoData:         "NODATA",
+	OptNoConnReply:    "NR_CONN",
+	OptNoHeloReply:    "NR_HELO",
+	OptNoMailReply:    "NR_MAIL",
+	OptNoRcptReply:    "NR_RCPT",
+	OptNoHeaderReply:  "NR_HDR",
+	OptNoEOHReply:     "NR_EOH",
+	OptNoBodyReply:    "NR_BODY",
+	OptNoUnknownReply: "NR_UNKN",
+	OptNoDataReply:    "NR_DATA",
+}
+
+// matrixMilter records the commands it received.
+type matrixMilter struct {
+	NoOpMilter
+	calls map[Code]int
+}
+
+func (mm *matrixMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	mm.calls[CodeConn]++
+	return RespContinue, nil
+}
+
+func (mm *matrixMilter) Helo(name string, m *Modifier) (Response, error) {
+	mm.calls[CodeHelo]++
+	return RespContinue, nil
+}
+
+func (mm *matrixMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	mm.calls[CodeMail]++
+	return RespContinue, nil
+}
+
+func (mm *matrixMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	mm.calls[CodeRcpt]++
+	return RespContinue, nil
+}
+
+func (mm *matrixMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	mm.calls[CodeHeader]++
+	return RespContinue, nil
+}
+
+func (mm *matrixMilter) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	mm.calls[CodeEOH]++
+	return RespContinue, nil
+}
+
+func (mm *matrixMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	mm.calls[CodeBody]++
+	return RespContinue, nil
+}
+
+func (mm *matrixMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	mm.calls[CodeUnknown]++
+	return RespContinue, nil
+}
+
+func (mm *matrixMilter) Body(m *Modifier) (Response, error) {
+	mm.calls[CodeEOB]++
+	if err := m.AddHeader("X-Matrix", "ok"); err != nil {
+		return nil, err
+	}
+	return RespAccept, nil
+}
+
+// matrixCase is a protocol version and the protocol options requested by the
+// milter.
+type matrixCase struct {
+	version  uint32
+	protocol OptProtocol
+}
+
+func (c matrixCase) String() string {
+	var names []string
+	for _, opt := range append(append([]OptProtocol(nil), matrixNoOpts...), matrixNoReplyOpts...) {
+		if c.protocol&opt != 0 {
+			names = append(names, matrixOptNames[opt])
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, "-")
+	}
+	return fmt.Sprintf("v%v %v", c.version, strings.Join(names, "|"))
+}
+
+// matrixCases returns all combinations of the protocol options available in
+// version.
+func matrixCases(version uint32) []matrixCase {
+	var opts []OptProtocol
+	for _, opt := range append(append([]OptProtocol(nil), matrixNoOpts...), matrixNoReplyOpts...) {
+		if version >= 6 || opt&v2ProtocolMask != 0 {
+			opts = append(opts, opt)
+		}
+	}
+	n := 1 << uint(len(opts))
+	cases := make([]matrixCase, 0, n)
+	for i := 0; i < n; i++ {
+		var protocol OptProtocol
+		for j, opt := range opts {
+			if i&(1<<uint(j)) != 0 {
+				protocol |= opt
+			}
+		}
+		cases = append(cases, matrixCase{version, protocol})
+	}
+	return cases
+}
+
+// run runs a transaction between the client and a server session and checks
+// that the milter received exactly the commands it did not opt out of.
+func (c matrixCase) run() error {
+	mm := &matrixMilter{calls: make(map[Code]int)}
+	s := &Server{
+		NewMilter: func() Milter { return mm },
+		Actions:   OptAddHeader,
+		Protocol:  c.protocol,
+	}
+	serverConn, clientConn := net.Pipe()
+	session := s.newSession(serverConn, nil)
+	done := make(chan struct{})
+	go func() {
+		session.HandleMilterCommands()
+		close(done)
+	}()
+	defer func() {
+		clientConn.Close()
+		<-done
+	}()
+
+	cl := NewClientWithOptions("pipe", "matrix", ClientOptions{
+		Dialer:       pipeDialer{clientConn},
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		ActionMask:   OptAddHeader,
+		ProtocolMask: c.protocol,
+	})
+	cs, err := cl.Session()
+	if err != nil {
+		return err
+	}
+	defer cs.Close()
+	if cs.clientProtocolVersion != c.version {
+		return fmt.Errorf("negotiated version %v", cs.clientProtocolVersion)
+	}
+	if cs.ProtocolOpts != c.protocol {
+		return fmt.Errorf("negotiated protocol options 0x%x", uint32(cs.ProtocolOpts))
+	}
+
+	hdr := msgtextproto.Header{}
+	hdr.Add("From", "<from@example.org>")
+	hdr.Add("Subject", "matrix")
+	steps := []struct {
+		name string
+		f    func() (*Action, error)
+	}{
+		{"conn", func() (*Action, error) { return cs.Conn("localhost", FamilyInet, 25, "127.0.0.1") }},
+		{"helo", func() (*Action, error) { return cs.Helo("localhost") }},
+		{"mail", func() (*Action, error) { return cs.Mail("from@example.org", nil) }},
+		{"rcpt", func() (*Action, error) { return cs.Rcpt("to@example.org", nil) }},
+		{"unknown", func() (*Action, error) { return cs.Unknown("VRFY to@example.org") }},
+		{"header", func() (*Action, error) { return cs.Header(hdr) }},
+	}
+	for _, step := range steps {
+		act, err := step.f()
+		if err != nil {
+			return fmt.Errorf("%v: %w", step.name, err)
+		}
+		if act.Code != ActContinue {
+			return fmt.Errorf("%v: unexpected action %v", step.name, act.Code)
+		}
+	}
+	modifyActs, act, err := cs.BodyReadFrom(bytes.NewReader([]byte("body\r\n")))
+	if err != nil {
+		return fmt.Errorf("body: %w", err)
+	}
+	if act.Code != ActAccept {
+		return fmt.Errorf("body: unexpected action %v", act.Code)
+	}
+	if len(modifyActs) != 1 || modifyActs[0].HeaderName != "X-Matrix" {
+		return fmt.Errorf("body: unexpected modify actions %v", modifyActs)
+	}
+	if err := cs.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	<-done
+
+	for code, opt := range map[Code]OptProtocol{
+		CodeConn:    OptNoConnect,
+		CodeHelo:    OptNoHelo,
+		CodeMail:    OptNoMailFrom,
+		CodeRcpt:    OptNoRcptTo,
+		CodeUnknown: OptNoUnknown,
+		CodeHeader:  OptNoHeaders,
+		CodeEOH:     OptNoEOH,
+		CodeBody:    OptNoBody,
+		CodeEOB:     0,
+	} {
+		expected := 1
+		if c.protocol&opt != 0 {
+			expected = 0
+		} else if code == CodeHeader {
+			expected = 2 // one call per field
+		}
+		if mm.calls[code] != expected {
+			return fmt.Errorf("milter received %q %v times, expected %v", byte(code), mm.calls[code], expected)
+		}
+	}
+	return nil
+}
+
+// TestCompatibilityMatrix runs the client against the server for protocol
+// versions 2 to 6 and all combinations of the OptNo* options. It is slow and
+// only runs with -matrix:
+//
+//	go test -run TestCompatibilityMatrix -matrix -matrix.report matrix.txt
+func TestCompatibilityMatrix(t *testing.T) {
+	if !*matrixFlag {
+		t.Skip("compatibility matrix disabled, run with -matrix")
+	}
+
+	defer func(v uint32) { serverProtocolVersion = v }(serverProtocolVersion)
+
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "%-8s %8s %8s %8s\n", "version", "cases", "passed", "failed")
+	var failures []string
+	for version := uint32(2); version <= 6; version++ {
+		serverProtocolVersion = version
+		cases := matrixCases(version)
+
+		var mu sync.Mutex
+		var failed []string
+		ch := make(chan matrixCase)
+		var wg sync.WaitGroup
+		for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for c := range ch {
+					if err := c.run(); err != nil {
+						mu.Lock()
+						failed = append(failed, fmt.Sprintf("%v: %v", c, err))
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		for _, c := range cases {
+			ch <- c
+		}
+		close(ch)
+		wg.Wait()
+
+		sort.Strings(failed)
+		failures = append(failures, failed...)
+		fmt.Fprintf(&report, "%-8v %8v %8v %8v\n", version, len(cases), len(cases)-len(failed), len(failed))
+	}
+	if len(failures) > 0 {
+		report.WriteString("\nfailures:\n")
+		for _, f := range failures {
+			report.WriteString(f + "\n")
+		}
+	}
+
+	if *matrixReport != "" {
+		if err := ioutil.WriteFile(*matrixReport, report.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Log("\n" + report.String())
+	if len(failures) > 0 {
+		t.Errorf("%v incompatible combinations", len(failures))
+	}
+}
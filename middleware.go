@@ -0,0 +1,173 @@
+package milter
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+
+	msgtextproto "github.com/emersion/go-message/textproto"
+)
+
+// Middleware wraps a Milter to add cross-cutting behavior such as logging,
+// timing or macro enrichment. Middlewares usually embed a Passthrough with
+// the wrapped Milter and override the callbacks they are interested in.
+type Middleware func(Milter) Milter
+
+// Chain composes middlewares into a single one. The first middleware is the
+// outermost: Chain(a, b)(m) is a(b(m)).
+func Chain(middlewares ...Middleware) Middleware {
+	return func(m Milter) Milter {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			m = middlewares[i](m)
+		}
+		return m
+	}
+}
+
+// Passthrough forwards all the callbacks to the wrapped Milter. The
+// callbacks of the stages not handled by the wrapped Milter continue, like
+// when a Milter doesn't implement a handler interface.
+//
+// The optional interfaces changing how the server drives the session,
+// RcptBatcher, OrderedHeadersHandler and Negotiator, are only used if the
+// innermost wrapped Milter implements them. They are still called through
+// the middlewares, which can override them.
+type Passthrough struct {
+	Milter
+}
+
+var (
+	_ ConnectHandler        = Passthrough{}
+	_ HeloHandler           = Passthrough{}
+	_ MailHandler           = Passthrough{}
+	_ RcptHandler           = Passthrough{}
+	_ DataHandler           = Passthrough{}
+	_ HeaderHandler         = Passthrough{}
+	_ HeadersHandler        = Passthrough{}
+	_ RcptBatcher           = Passthrough{}
+	_ Negotiator            = Passthrough{}
+	_ OrderedHeadersHandler = Passthrough{}
+	_ BodyChunkHandler      = Passthrough{}
+	_ AbortHandler          = Passthrough{}
+	_ MacrosHandler         = Passthrough{}
+	_ UnknownHandler        = Passthrough{}
+)
+
+func (p Passthrough) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	if h, ok := p.Milter.(ConnectHandler); ok {
+		return h.Connect(host, family, port, addr, m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) Helo(name string, m *Modifier) (Response, error) {
+	if h, ok := p.Milter.(HeloHandler); ok {
+		return h.Helo(name, m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) MailFrom(from string, m *Modifier) (Response, error) {
+	if h, ok := p.Milter.(MailHandler); ok {
+		return h.MailFrom(from, m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	if h, ok := p.Milter.(RcptHandler); ok {
+		return h.RcptTo(rcptTo, m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) Data(m *Modifier) (Response, error) {
+	if h, ok := p.Milter.(DataHandler); ok {
+		return h.Data(m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) Header(name string, value string, m *Modifier) (Response, error) {
+	if h, ok := p.Milter.(HeaderHandler); ok {
+		return h.Header(name, value, m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) Headers(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	if hh, ok := p.Milter.(HeadersHandler); ok {
+		return hh.Headers(h, m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) OrderedHeaders(h msgtextproto.Header, m *Modifier) (Response, error) {
+	if hh, ok := p.Milter.(OrderedHeadersHandler); ok {
+		return hh.OrderedHeaders(h, m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) RcptBatch(rcpts []Recipient, total int, m *Modifier) (Response, error) {
+	if h, ok := p.Milter.(RcptBatcher); ok {
+		return h.RcptBatch(rcpts, total, m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) Negotiate(mtaVersion uint32, mtaActions OptAction, mtaProto OptProtocol) (OptAction, OptProtocol, error) {
+	if h, ok := p.Milter.(Negotiator); ok {
+		return h.Negotiate(mtaVersion, mtaActions, mtaProto)
+	}
+	return 0, 0, errors.New("milter: wrapped Milter is not a Negotiator")
+}
+
+func (p Passthrough) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	if h, ok := p.Milter.(BodyChunkHandler); ok {
+		return h.BodyChunk(chunk, m)
+	}
+	return RespContinue, nil
+}
+
+func (p Passthrough) Abort(m *Modifier) error {
+	if h, ok := p.Milter.(AbortHandler); ok {
+		return h.Abort(m)
+	}
+	return nil
+}
+
+func (p Passthrough) Macros(stage Code, macros map[string]string) error {
+	if h, ok := p.Milter.(MacrosHandler); ok {
+		return h.Macros(stage, macros)
+	}
+	return nil
+}
+
+func (p Passthrough) Unknown(cmd string, m *Modifier) (Response, error) {
+	if h, ok := p.Milter.(UnknownHandler); ok {
+		return h.Unknown(cmd, m)
+	}
+	return RespContinue, nil
+}
+
+// Unwrap returns the wrapped Milter.
+func (p Passthrough) Unwrap() Milter {
+	return p.Milter
+}
+
+// unwrapMilter returns the innermost Milter wrapped by the middlewares
+// embedding a Passthrough around m, or m itself.
+func unwrapMilter(m Milter) Milter {
+	for {
+		w, ok := m.(interface{ Unwrap() Milter })
+		if !ok {
+			return m
+		}
+		inner := w.Unwrap()
+		if inner == nil {
+			return m
+		}
+		m = inner
+	}
+}
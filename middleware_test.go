@@ -0,0 +1,115 @@
+package milter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type recordingMilter struct {
+	Passthrough
+	name  string
+	calls *[]string
+}
+
+func (rm recordingMilter) Helo(name string, m *Modifier) (Response, error) {
+	*rm.calls = append(*rm.calls, rm.name)
+	return rm.Passthrough.Helo(name, m)
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(m Milter) Milter {
+			return recordingMilter{Passthrough: Passthrough{m}, name: name, calls: &calls}
+		}
+	}
+
+	m := Chain(record("a"), record("b"))(NoOpMilter{})
+	if _, err := (Passthrough{m}).Helo("localhost", &Modifier{}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"a", "b"}) {
+		t.Fatal("Wrong call order:", calls)
+	}
+}
+
+func TestPassthrough_OptionalInterfaces(t *testing.T) {
+	var calls []string
+	wrap := func(m Milter) Milter {
+		return recordingMilter{Passthrough: Passthrough{m}, name: "wrapper", calls: &calls}
+	}
+
+	var bm batchMilter
+	om := orderedHeadersMilter{MockMilter: MockMilter{
+		MailResp: RespContinue,
+		RcptResp: RespContinue,
+		HdrResp:  RespContinue,
+		HdrsErr:  errors.New("Headers called"),
+	}}
+	mm := MockMilter{MailResp: RespContinue, RcptResp: RespReject}
+	for _, tc := range []struct {
+		name   string
+		milter Milter
+	}{
+		{"RcptBatcher", &bm},
+		{"OrderedHeadersHandler", &om},
+		{"plain", &mm},
+	} {
+		s := Server{
+			NewMilter: func() Milter {
+				return wrap(tc.milter)
+			},
+		}
+		session := startTestSession(t, &s, ClientOptions{})
+
+		if _, err := session.Mail("from@example.org", nil); err != nil {
+			t.Fatal(err)
+		}
+		act, err := session.Rcpt("to@example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.milter == &mm {
+			// RcptTo is still called if the wrapped Milter doesn't batch
+			if act.Code != ActReject {
+				t.Errorf("%v: unexpected action: %v", tc.name, act.Code)
+			}
+		} else {
+			if _, err := session.HeaderField("Subject", "Hello"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := session.HeaderEnd(); err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+		}
+
+		session.Close()
+		s.Close()
+	}
+
+	if !reflect.DeepEqual(bm.rcpts, []Recipient{{Addr: "to@example.org"}}) {
+		t.Errorf("RcptBatch not called through the wrapper: %+v", bm.rcpts)
+	}
+	if !reflect.DeepEqual(om.raw, []string{"Subject: Hello\r\n"}) {
+		t.Errorf("OrderedHeaders not called through the wrapper: %q", om.raw)
+	}
+}
+
+func TestPassthrough_Negotiate(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return Passthrough{negotiatingMilter{}}
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask:   OptAddHeader | OptChangeBody,
+		ProtocolMask: OptNoBody,
+	})
+	defer session.Close()
+
+	if session.ActionOpts != OptAddHeader || session.ProtocolOpts != OptNoBody {
+		t.Fatalf("Wrong options: 0x%x 0x%x", session.ActionOpts, session.ProtocolOpts)
+	}
+}
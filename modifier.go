@@ -4,9 +4,13 @@ package milter
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net/textproto"
+	"strings"
+	"time"
 )
 
 // postfix wants LF lines endings. Using CRLF results in double CR sequences.
@@ -14,50 +18,319 @@ func crlfToLF(b []byte) []byte {
 	return bytes.ReplaceAll(b, []byte{'\r', '\n'}, []byte{'\n'})
 }
 
+// ErrInvalidHeaderName is returned by Modifier when a header field name is
+// not valid.
+var ErrInvalidHeaderName = errors.New("milter: invalid header field name")
+
+// validHeaderName checks that name is a valid RFC 5322 field name: a
+// non-empty sequence of printable US-ASCII characters except colon.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// StageError is returned by Modifier when a modification is attempted
+// outside of end of message. The MTA only accepts modifications in response
+// to the end of message command, see Server.BufferModifications to queue them
+// instead.
+type StageError struct {
+	Action ModifyActCode
+	Stage  Code
+}
+
+func (err *StageError) Error() string {
+	stage, ok := stageLabels[err.Stage]
+	if !ok {
+		stage = fmt.Sprintf("%q", byte(err.Stage))
+	}
+	return fmt.Sprintf("milter: modification %q not allowed at stage %v, only at end of message", byte(err.Action), stage)
+}
+
+// modify sends a modification action to the MTA, or queues it if
+// Server.BufferModifications is set.
+func (m *Modifier) modify(code ModifyActCode, data []byte) error {
+	if m.queue != nil {
+		m.queue.add(code, data)
+		return nil
+	}
+	if m.stage != CodeEOB {
+		return &StageError{Action: code, Stage: m.stage}
+	}
+	return m.send(code, data)
+}
+
+func (m *Modifier) send(code ModifyActCode, data []byte) error {
+	if err := m.writer.WriteAction(NewResponse(byte(code), data).Response()); err != nil {
+		return err
+	}
+	if m.audit != nil {
+		m.audit(code, data)
+	}
+	return nil
+}
+
+func (m *Modifier) checkHeaderName(name string) error {
+	if m.allowInvalidHeaderNames || validHeaderName(name) {
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidHeaderName, name)
+}
+
+// ESMTPArgs are the ESMTP parameters of a MAIL or RCPT command, e.g.
+// "SIZE=1024" or "NOTIFY=SUCCESS,FAILURE".
+type ESMTPArgs []string
+
+// Get returns the value of the parameter with the specified keyword, matched
+// case-insensitively. Parameters without value, such as "SMTPUTF8", have an
+// empty value.
+func (args ESMTPArgs) Get(keyword string) (value string, ok bool) {
+	for _, arg := range args {
+		k, v := arg, ""
+		if i := strings.IndexByte(arg, '='); i >= 0 {
+			k, v = arg[:i], arg[i+1:]
+		}
+		if strings.EqualFold(k, keyword) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
 // Modifier provides access to Macros, Headers and Body data to callback handlers. It also defines a
 // number of functions that can be used by callback handlers to modify processing of the email message
 type Modifier struct {
 	Macros  map[string]string
 	Headers textproto.MIMEHeader
 
-	writePacket func(*Message) error
+	// ESMTP arguments of the MAIL command of the current message.
+	MailArgs ESMTPArgs
+	// ESMTP arguments of the RCPT command, in RcptTo only.
+	RcptArgs ESMTPArgs
+
+	writer     ActionWriter
+	audit      func(code ModifyActCode, data []byte)
+	queue      *modQueue
+	stage      Code
+	ctx        context.Context
+	macros     *macroStore
+	bodyHashes map[string][]byte
+	bodySize   int64
+	headers    []HeaderField
+	tempFiles  *tempFiles
+	body       *bodyBuffer
+	sessionID  string
+	start      time.Time
+	version    uint32
+	actions    OptAction
+	protocol   OptProtocol
+
+	sessionValues *Values
+	messageValues *Values
+
+	rcptRejected            bool
+	allowInvalidHeaderNames bool
+	logf                    func(format string, v ...interface{})
+}
+
+// RcptRejected reports whether the recipient passed to RcptTo has already
+// been rejected by the MTA, e.g. because the mailbox doesn't exist. Rejected
+// recipients are only passed to RcptTo if OptRcptRej is negotiated; they are
+// not recipients of the message and aren't passed to RcptBatch. The response
+// of RcptTo is ignored by the MTA for rejected recipients.
+func (m *Modifier) RcptRejected() bool {
+	return m.rcptRejected
+}
+
+// StageMacros returns the macros sent by the MTA for the stage of a command,
+// e.g. CodeHelo. Macros sent for the connect and HELO stages are kept for the
+// whole connection, the others are cleared at the end of each message.
+func (m *Modifier) StageMacros(code Code) map[string]string {
+	if m.macros == nil {
+		return nil
+	}
+	return m.macros.stage(code)
+}
+
+// Macro returns the value of a macro sent by the MTA, or an empty string if
+// it wasn't sent. The name may be given with or without braces: "{i}" matches
+// the "i" macro and "auth_authen" matches "{auth_authen}".
+func (m *Modifier) Macro(name string) string {
+	if v, ok := m.Macros[name]; ok {
+		return v
+	}
+	return m.Macros[macroAlias(name)]
+}
+
+// QueueID returns the queue ID of the message ("i" macro). Postfix only sends
+// it from the MAIL command on, or from the DATA command if the queue ID is
+// allocated late.
+func (m *Modifier) QueueID() string {
+	return m.Macro("i")
+}
+
+// DaemonName returns the name of the MTA daemon ("{daemon_name}" macro).
+func (m *Modifier) DaemonName() string {
+	return m.Macro("{daemon_name}")
+}
+
+// MTAHostname returns the hostname of the MTA ("j" macro).
+func (m *Modifier) MTAHostname() string {
+	return m.Macro("j")
+}
+
+// ClientName returns the hostname of the SMTP client ("{client_name}"
+// macro).
+func (m *Modifier) ClientName() string {
+	return m.Macro("{client_name}")
+}
+
+// ClientAddr returns the IP address of the SMTP client ("{client_addr}"
+// macro).
+func (m *Modifier) ClientAddr() string {
+	return m.Macro("{client_addr}")
+}
+
+// AuthenticatedUser returns the SASL login name of the SMTP client
+// ("{auth_authen}" macro), empty if the client didn't authenticate.
+func (m *Modifier) AuthenticatedUser() string {
+	return m.Macro("{auth_authen}")
+}
+
+// AuthType returns the SASL mechanism used by the SMTP client
+// ("{auth_type}" macro).
+func (m *Modifier) AuthType() string {
+	return m.Macro("{auth_type}")
+}
+
+// TLSVersion returns the TLS version of the SMTP connection
+// ("{tls_version}" macro), empty if TLS isn't used.
+func (m *Modifier) TLSVersion() string {
+	return m.Macro("{tls_version}")
+}
+
+// TLSCipher returns the TLS cipher of the SMTP connection ("{cipher}"
+// macro).
+func (m *Modifier) TLSCipher() string {
+	return m.Macro("{cipher}")
+}
+
+// CertSubject returns the subject of the certificate presented by the SMTP
+// client ("{cert_subject}" macro).
+func (m *Modifier) CertSubject() string {
+	return m.Macro("{cert_subject}")
+}
+
+// CertIssuer returns the issuer of the certificate presented by the SMTP
+// client ("{cert_issuer}" macro).
+func (m *Modifier) CertIssuer() string {
+	return m.Macro("{cert_issuer}")
+}
+
+// ProtocolVersion returns the milter protocol version negotiated with the MTA.
+func (m *Modifier) ProtocolVersion() uint32 {
+	return m.version
+}
+
+// Actions returns the actions negotiated with the MTA.
+func (m *Modifier) Actions() OptAction {
+	return m.actions
+}
+
+// Protocol returns the protocol options negotiated with the MTA.
+func (m *Modifier) Protocol() OptProtocol {
+	return m.protocol
+}
+
+// Context returns the context of the current message. It is cancelled when
+// the message is aborted or completed, when the connection is closed, when
+// the server is closed and when Server.CommandTimeout expires.
+func (m *Modifier) Context() context.Context {
+	return m.ctx
+}
+
+// SessionID returns the identifier of the session, as generated by
+// Server.IDGenerator.
+func (m *Modifier) SessionID() string {
+	return m.sessionID
+}
+
+// SessionStart returns the time the MTA connected, according to Server.Clock.
+func (m *Modifier) SessionStart() time.Time {
+	return m.start
+}
+
+// BodyHash returns the value of the named hash from Server.BodyHashes computed
+// over the message body. It is only available at end of message, nil is
+// returned otherwise.
+func (m *Modifier) BodyHash(name string) []byte {
+	return m.bodyHashes[name]
+}
+
+// BodySize returns the size in bytes of the message body received from the
+// MTA. It is only available at end of message, -1 is returned otherwise.
+func (m *Modifier) BodySize() int64 {
+	return m.bodySize
+}
+
+// HeaderFields returns the header fields of the message in the order they
+// were received, with their original values. It is only available at end of
+// message, nil is returned otherwise.
+//
+// Unlike Headers, which is shared with the earlier callbacks, the returned
+// slice is a snapshot which is not affected by changes made by handlers.
+func (m *Modifier) HeaderFields() []HeaderField {
+	return append([]HeaderField(nil), m.headers...)
 }
 
 // AddRecipient appends a new envelope recipient for current message
 func (m *Modifier) AddRecipient(r string) error {
 	data := []byte(fmt.Sprintf("<%s>", r) + null)
-	return m.writePacket(NewResponse('+', data).Response())
+	return m.modify(ActAddRcpt, data)
 }
 
 // DeleteRecipient removes an envelope recipient address from message
 func (m *Modifier) DeleteRecipient(r string) error {
 	data := []byte(fmt.Sprintf("<%s>", r) + null)
-	return m.writePacket(NewResponse('-', data).Response())
+	return m.modify(ActDelRcpt, data)
 }
 
 // ReplaceBody substitutes message body with provided body
 func (m *Modifier) ReplaceBody(body []byte) error {
 	body = crlfToLF(body)
-	return m.writePacket(NewResponse('b', body).Response())
+	return m.modify(ActReplBody, body)
 }
 
 // AddHeader appends a new email message header the message
 func (m *Modifier) AddHeader(name, value string) error {
+	if err := m.checkHeaderName(name); err != nil {
+		return err
+	}
 	var buffer bytes.Buffer
 	buffer.WriteString(name + null)
 	buffer.Write(crlfToLF([]byte(value)))
 	buffer.WriteString(null)
-	return m.writePacket(NewResponse('h', buffer.Bytes()).Response())
+	return m.modify(ActAddHeader, buffer.Bytes())
 }
 
 // Quarantine a message by giving a reason to hold it
 func (m *Modifier) Quarantine(reason string) error {
-	return m.writePacket(NewResponse('q', []byte(reason+null)).Response())
+	return m.modify(ActQuarantine, []byte(reason+null))
 }
 
 // ChangeHeader replaces the header at the specified position with a new one.
 // The index is per name.
 func (m *Modifier) ChangeHeader(index int, name, value string) error {
+	if err := m.checkHeaderName(name); err != nil {
+		return err
+	}
 	var buffer bytes.Buffer
 	if err := binary.Write(&buffer, binary.BigEndian, uint32(index)); err != nil {
 		return err
@@ -65,11 +338,14 @@ func (m *Modifier) ChangeHeader(index int, name, value string) error {
 	buffer.WriteString(name + null)
 	buffer.Write(crlfToLF([]byte(value)))
 	buffer.WriteString(null)
-	return m.writePacket(NewResponse('m', buffer.Bytes()).Response())
+	return m.modify(ActChangeHeader, buffer.Bytes())
 }
 
 // InsertHeader inserts the header at the specified position
 func (m *Modifier) InsertHeader(index int, name, value string) error {
+	if err := m.checkHeaderName(name); err != nil {
+		return err
+	}
 	var buffer bytes.Buffer
 	if err := binary.Write(&buffer, binary.BigEndian, uint32(index)); err != nil {
 		return err
@@ -77,20 +353,99 @@ func (m *Modifier) InsertHeader(index int, name, value string) error {
 	buffer.WriteString(name + null)
 	buffer.Write(crlfToLF([]byte(value)))
 	buffer.WriteString(null)
-	return m.writePacket(NewResponse('i', buffer.Bytes()).Response())
+	return m.modify(ActInsertHeader, buffer.Bytes())
+}
+
+// headerIndex returns the 1-based per-name index of an occurrence of the
+// header field name, as expected by ChangeHeader. A negative occurrence
+// counts from the last field.
+func (m *Modifier) headerIndex(name string, occurrence int) (int, error) {
+	n := 0
+	if m.headers != nil {
+		for _, f := range m.headers {
+			if strings.EqualFold(f.Key, name) {
+				n++
+			}
+		}
+	} else {
+		n = len(m.Headers[textproto.CanonicalMIMEHeaderKey(name)])
+	}
+	index := occurrence
+	if occurrence < 0 {
+		index = n + occurrence + 1
+	}
+	if index < 1 || index > n {
+		return 0, fmt.Errorf("%w: %v occurrence %v", ErrHeaderNotFound, name, occurrence)
+	}
+	return index, nil
 }
 
-// ChangeFrom replaces the FROM envelope header with a new one
+// ChangeHeaderByName replaces the value of an occurrence of the header field
+// name. Occurrences are numbered from 1 among the fields with the same name,
+// matched case-insensitively, as received from the MTA. A negative
+// occurrence counts from the last field, -1 being the last one.
+// ErrHeaderNotFound is returned if the occurrence does not exist.
+func (m *Modifier) ChangeHeaderByName(name string, occurrence int, value string) error {
+	index, err := m.headerIndex(name, occurrence)
+	if err != nil {
+		return err
+	}
+	return m.ChangeHeader(index, name, value)
+}
+
+// DeleteHeader deletes an occurrence of the header field name, see
+// ChangeHeaderByName. Occurrences are not renumbered by the MTA: to delete
+// several fields with the same name, delete the last ones first.
+func (m *Modifier) DeleteHeader(name string, occurrence int) error {
+	return m.ChangeHeaderByName(name, occurrence, "")
+}
+
+// NullSender is the null reverse-path, used as envelope sender of bounces.
+const NullSender = "<>"
+
+// ChangeFrom replaces the FROM envelope header with a new one. An empty
+// value is sent as NullSender.
 func (m *Modifier) ChangeFrom(value string) error {
+	if value == "" {
+		value = NullSender
+	}
 	data := []byte(value + null)
-	return m.writePacket(NewResponse('e', data).Response())
+	return m.modify(ActChangeFrom, data)
+}
+
+// ChangeFromNull replaces the FROM envelope header with the null sender, for
+// instance to turn a message into a bounce.
+func (m *Modifier) ChangeFromNull() error {
+	return m.ChangeFrom(NullSender)
 }
 
 // newModifier creates a new Modifier instance from milterSession
 func newModifier(s *milterSession) *Modifier {
 	return &Modifier{
-		Macros:      s.macros,
-		Headers:     s.headers,
-		writePacket: s.WritePacket,
+		Macros:     s.allMacros(),
+		Headers:    s.headers,
+		MailArgs:   s.mailArgs,
+		writer:     s.actionWriter(ActionWriterFunc(s.WritePacket)),
+		audit:      s.auditModification,
+		queue:      s.modQueue,
+		stage:      s.stage,
+		ctx:        s.context(),
+		macros:     &s.macros,
+		bodyHashes: s.bodyHashes,
+		bodySize:   s.eomBodySize,
+		headers:    s.headerSnapshot,
+		tempFiles:  s.tempFiles,
+		body:       s.body,
+		sessionID:  s.id,
+		start:      s.start,
+		version:    s.version,
+		actions:    s.actions,
+		protocol:   s.protocol,
+
+		sessionValues: s.sessionValues,
+		messageValues: s.messageValues,
+
+		allowInvalidHeaderNames: s.server.AllowInvalidHeaderNames,
+		logf:                    s.logf,
 	}
 }
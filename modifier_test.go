@@ -0,0 +1,301 @@
+package milter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestModifier_InvalidHeaderName(t *testing.T) {
+	var sent int
+	m := &Modifier{
+		stage: CodeEOB,
+		writer: ActionWriterFunc(func(*Message) error {
+			sent++
+			return nil
+		}),
+	}
+	for _, name := range []string{"", "X Spam", "X-Spam:", "X-Spam\r\nBcc", "X-Späm"} {
+		if err := m.AddHeader(name, "1"); !errors.Is(err, ErrInvalidHeaderName) {
+			t.Errorf("AddHeader(%q): expected ErrInvalidHeaderName, got %v", name, err)
+		}
+		if err := m.InsertHeader(0, name, "1"); !errors.Is(err, ErrInvalidHeaderName) {
+			t.Errorf("InsertHeader(%q): expected ErrInvalidHeaderName, got %v", name, err)
+		}
+		if err := m.ChangeHeader(1, name, "1"); !errors.Is(err, ErrInvalidHeaderName) {
+			t.Errorf("ChangeHeader(%q): expected ErrInvalidHeaderName, got %v", name, err)
+		}
+	}
+	if sent != 0 {
+		t.Fatal("Invalid header fields were sent:", sent)
+	}
+
+	if err := m.AddHeader("X-Spam", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.allowInvalidHeaderNames = true
+	if err := m.AddHeader("X Spam", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 {
+		t.Fatal("Wrong amount of header fields sent:", sent)
+	}
+}
+
+func TestModifier_ChangeFromNull(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		mod  func(m *Modifier) error
+	}{
+		{"ChangeFromNull", func(m *Modifier) error { return m.ChangeFromNull() }},
+		{"ChangeFrom", func(m *Modifier) error { return m.ChangeFrom("") }},
+		{"raw", func(m *Modifier) error {
+			return m.writer.WriteAction(NewResponse('e', []byte(null)).Response())
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			mm := MockMilter{
+				MailResp:      RespContinue,
+				HdrsResp:      RespContinue,
+				BodyChunkResp: RespContinue,
+				BodyResp:      RespAccept,
+				BodyMod: func(m *Modifier) {
+					if err := tc.mod(m); err != nil {
+						panic(err)
+					}
+				},
+			}
+			s := Server{
+				NewMilter: func() Milter {
+					return &mm
+				},
+				Actions: OptChangeFrom,
+			}
+			defer s.Close()
+			session := startTestSession(t, &s, ClientOptions{
+				ActionMask: OptChangeFrom,
+			})
+			defer session.Close()
+
+			if _, err := session.Mail("from@example.org", nil); err != nil {
+				t.Fatal(err)
+			}
+			modifyActs, _, err := session.End()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(modifyActs) != 1 || !modifyActs[0].IsNullSender() {
+				t.Fatalf("Wrong modify actions: %+v", modifyActs)
+			}
+
+			msg := MessageState{From: "from@example.org"}
+			ApplyModifyActions(&msg, modifyActs)
+			if msg.From != "" {
+				t.Fatalf("Wrong sender: %q", msg.From)
+			}
+		})
+	}
+}
+
+type stageMilter struct {
+	NoOpMilter
+	err error
+}
+
+func (sm *stageMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	sm.err = m.AddHeader("X-Rcpt", rcptTo)
+	return RespContinue, nil
+}
+
+func TestModifier_Stage(t *testing.T) {
+	sm := &stageMilter{}
+	s := Server{
+		NewMilter: func() Milter {
+			return sm
+		},
+		Actions: OptAddHeader,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptAddHeader,
+	})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	act, err := session.Rcpt("to@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActContinue {
+		t.Fatal("Unexpected action:", act.Code)
+	}
+	var stageErr *StageError
+	if !errors.As(sm.err, &stageErr) {
+		t.Fatalf("Expected *StageError, got %v", sm.err)
+	}
+	if stageErr.Action != ActAddHeader || stageErr.Stage != CodeRcpt {
+		t.Fatalf("Wrong StageError: %+v", stageErr)
+	}
+}
+
+func TestServer_BufferModifications(t *testing.T) {
+	mm := MockMilter{
+		MailResp: RespContinue,
+		MailMod: func(m *Modifier) {
+			m.ChangeFrom("<first@example.org>")
+			m.AddHeader("X-Mail", "1")
+		},
+		RcptResp: RespContinue,
+		RcptMod: func(m *Modifier) {
+			m.AddRecipient("bcc@example.org")
+		},
+		BodyResp: RespAccept,
+		BodyMod: func(m *Modifier) {
+			m.ChangeFrom("<second@example.org>")
+			m.ChangeHeader(1, "Subject", "first")
+			m.ChangeHeader(1, "subject", "second")
+			m.AddRecipient("bcc@example.org")
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Actions:             OptChangeFrom | OptAddHeader | OptChangeHeader | OptAddRcpt,
+		BufferModifications: true,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptChangeFrom | OptAddHeader | OptChangeHeader | OptAddRcpt,
+	})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"to1@example.org", "to2@example.org"} {
+		if _, err := session.Rcpt(rcpt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modifyActs, act, err := session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActAccept {
+		t.Fatal("Unexpected action:", act.Code)
+	}
+
+	expected := []ModifyAction{
+		{Code: ActAddHeader, HeaderName: "X-Mail", HeaderValue: "1"},
+		{Code: ActChangeFrom, Seq: 1, From: "<second@example.org>", FromArgs: []string{}},
+		{Code: ActChangeHeader, Seq: 2, HeaderIndex: 1, HeaderName: "subject", HeaderValue: "second"},
+		{Code: ActAddRcpt, Seq: 3, Rcpt: "<bcc@example.org>"},
+	}
+	if !reflect.DeepEqual(modifyActs, expected) {
+		t.Fatalf("Wrong modify actions:\n%+v\nexpected:\n%+v", modifyActs, expected)
+	}
+}
+
+func TestModQueue_Recipients(t *testing.T) {
+	var q modQueue
+	var rec ActionRecorder
+	m := NewModifier(ActionWriterFunc(func(msg *Message) error {
+		q.add(ModifyActCode(msg.Code), msg.Data)
+		return nil
+	}))
+	m.AddRecipient("a@example.org")
+	m.DeleteRecipient("a@example.org")
+	m.AddRecipient("a@example.org")
+	m.AddRecipient("b@example.org")
+	m.DeleteRecipient("b@example.org")
+	m.DeleteRecipient("c@example.org")
+	m.DeleteRecipient("c@example.org")
+	for _, msg := range q.take() {
+		if err := rec.WriteAction(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acts, err := rec.ModifyActions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ModifyAction{
+		{Code: ActAddRcpt, Rcpt: "<a@example.org>"},
+		{Code: ActDelRcpt, Rcpt: "<b@example.org>"},
+		{Code: ActDelRcpt, Rcpt: "<c@example.org>"},
+	}
+	if !reflect.DeepEqual(acts, expected) {
+		t.Fatalf("Wrong modify actions:\n%+v\nexpected:\n%+v", acts, expected)
+	}
+}
+
+func TestModifier_DeleteHeader(t *testing.T) {
+	var rec ActionRecorder
+	m := NewModifier(&rec)
+	m.headers = []HeaderField{
+		{Key: "Received", Value: "from a"},
+		{Key: "Subject", Value: "hello"},
+		{Key: "received", Value: "from b"},
+		{Key: "RECEIVED", Value: "from c"},
+	}
+	for _, occurrence := range []int{-1, 1} {
+		if err := m.DeleteHeader("Received", occurrence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.ChangeHeaderByName("subject", -1, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	for _, occurrence := range []int{0, 4, -4} {
+		if err := m.DeleteHeader("Received", occurrence); !errors.Is(err, ErrHeaderNotFound) {
+			t.Errorf("DeleteHeader(%v): expected ErrHeaderNotFound, got %v", occurrence, err)
+		}
+	}
+	if err := m.DeleteHeader("X-Missing", 1); !errors.Is(err, ErrHeaderNotFound) {
+		t.Errorf("Expected ErrHeaderNotFound, got %v", err)
+	}
+
+	acts, err := rec.ModifyActions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ModifyAction{
+		{Code: ActChangeHeader, HeaderIndex: 3, HeaderName: "Received"},
+		{Code: ActChangeHeader, HeaderIndex: 1, HeaderName: "Received"},
+		{Code: ActChangeHeader, HeaderIndex: 1, HeaderName: "subject", HeaderValue: "bye"},
+	}
+	if !reflect.DeepEqual(acts, expected) {
+		t.Fatalf("Wrong modify actions: %+v", acts)
+	}
+}
+
+func TestModifier_Macro(t *testing.T) {
+	m := &Modifier{Macros: map[string]string{
+		"{i}":           "4F3xyz",
+		"j":             "mx.example.org",
+		"daemon_name":   "smtpd",
+		"{auth_authen}": "alice",
+		"{tls_version}": "TLSv1.3",
+	}}
+	for _, tc := range []struct {
+		name, got, want string
+	}{
+		{"QueueID", m.QueueID(), "4F3xyz"},
+		{"MTAHostname", m.MTAHostname(), "mx.example.org"},
+		{"DaemonName", m.DaemonName(), "smtpd"},
+		{"AuthenticatedUser", m.AuthenticatedUser(), "alice"},
+		{"TLSVersion", m.TLSVersion(), "TLSv1.3"},
+		{"AuthType", m.AuthType(), ""},
+		{"Macro({j})", m.Macro("{j}"), "mx.example.org"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%v = %q, want %q", tc.name, tc.got, tc.want)
+		}
+	}
+}
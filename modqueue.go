@@ -0,0 +1,78 @@
+package milter
+
+import (
+	"bytes"
+	"strings"
+)
+
+// modQueue holds the modifications of the current message when
+// Server.BufferModifications is set.
+type modQueue struct {
+	msgs []*Message
+}
+
+func (q *modQueue) add(code ModifyActCode, data []byte) {
+	q.msgs = append(q.msgs, &Message{Code: byte(code), Data: data})
+}
+
+func (q *modQueue) reset() {
+	q.msgs = nil
+}
+
+// take returns the queued modifications without the redundant ones and
+// empties the queue. Only the last sender change, quarantine reason, change of
+// a given header field and addition or deletion of a given recipient are kept:
+// e.g. adding, deleting and adding again a recipient results in a single
+// addition.
+func (q *modQueue) take() []*Message {
+	msgs := q.msgs
+	q.msgs = nil
+
+	keep := make([]bool, len(msgs))
+	seen := make(map[string]bool)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		key := modifyKey(msgs[i])
+		if key == "" {
+			keep[i] = true
+			continue
+		}
+		keep[i] = !seen[key]
+		seen[key] = true
+	}
+
+	var out []*Message
+	for i, msg := range msgs {
+		if keep[i] {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+// modifyKey returns the key identifying the modifications superseded by msg.
+// The key is empty for modifications which are never redundant.
+func modifyKey(msg *Message) string {
+	switch ModifyActCode(msg.Code) {
+	case ActAddRcpt, ActDelRcpt:
+		// the net state of the recipient matters, not the code
+		rcpt := msg.Data
+		if i := bytes.IndexByte(rcpt, 0); i >= 0 {
+			rcpt = rcpt[:i]
+		}
+		return "rcpt" + string(rcpt)
+	case ActChangeFrom, ActQuarantine:
+		return string(msg.Code)
+	case ActChangeHeader:
+		if len(msg.Data) < 4 {
+			return ""
+		}
+		// index and field name
+		name := msg.Data[4:]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		return string(msg.Code) + string(msg.Data[:4]) + strings.ToLower(string(name))
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,27 @@
+package milter
+
+// NegotiationOffer describes what the MTA offers during negotiation, see
+// Server.Negotiate.
+type NegotiationOffer struct {
+	// Conn describes the connection of the MTA, e.g. the listener which
+	// accepted it.
+	Conn ConnInfo
+	// Version is the protocol version offered by the MTA.
+	Version  uint32
+	Actions  OptAction
+	Protocol OptProtocol
+}
+
+// NegotiationReply is what the server requests during negotiation, see
+// Server.Negotiate. Actions and Protocol are masked with what the MTA offers.
+type NegotiationReply struct {
+	// Version, if not zero, lowers the protocol version used for the
+	// connection. By default, the highest version supported by both sides is
+	// used.
+	Version  uint32
+	Actions  OptAction
+	Protocol OptProtocol
+	// MacroRequests lists the macros requested for each stage, as
+	// Server.MacroRequests.
+	MacroRequests map[Code][]string
+}
@@ -0,0 +1,21 @@
+package milter
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCred(conn *net.UnixConn) *PeerCred {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var ucred *syscall.Ucred
+	err = rc.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || ucred == nil {
+		return nil
+	}
+	return &PeerCred{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package milter
+
+import (
+	"net"
+)
+
+func peerCred(conn *net.UnixConn) *PeerCred {
+	return nil
+}
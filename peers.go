@@ -0,0 +1,97 @@
+package milter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrPeerNotAllowed is reported to Server.ErrorHook when a connection is
+// closed because of Server.AllowedPeers.
+var ErrPeerNotAllowed = errors.New("milter: peer not allowed")
+
+// AllowedPeers restricts the MTAs allowed to connect to the server. The
+// milter protocol has no authentication, so servers listening on TCP should
+// only accept connections from the expected MTAs.
+//
+// A connection is allowed if it matches any of the rules.
+type AllowedPeers struct {
+	// Networks allowed to connect over TCP, see ParseNetworks.
+	Networks []*net.IPNet
+	// UIDs of the processes allowed to connect over unix sockets. They are
+	// only matched on platforms supporting ConnInfo.PeerCred.
+	UIDs []int
+	// Func, if set, allows the connections for which it returns true. The
+	// TLS handshake, if any, is completed before Func is called.
+	Func func(info ConnInfo) bool
+}
+
+// ParseNetworks parses a list of networks in CIDR notation, such as
+// "192.0.2.0/24". Single IP addresses are accepted as well.
+func ParseNetworks(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("milter: invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("milter: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Allowed reports whether the connection described by info is allowed.
+func (p *AllowedPeers) Allowed(info ConnInfo) bool {
+	if ip := addrIP(info.RemoteAddr); ip != nil {
+		for _, n := range p.Networks {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	if info.PeerCred != nil {
+		for _, uid := range p.UIDs {
+			if info.PeerCred.UID == uid {
+				return true
+			}
+		}
+	}
+	return p.Func != nil && p.Func(info)
+}
+
+// addrIP returns the IP address of a TCP address, nil otherwise.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// checkPeer closes connections not allowed by Server.AllowedPeers.
+func (m *milterSession) checkPeer() error {
+	// the self-test connection is in-memory, it has no peer to check
+	if m.selfTest || m.server.AllowedPeers == nil || m.server.AllowedPeers.Allowed(m.connInfo) {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrPeerNotAllowed, m.connInfo.RemoteAddr)
+}
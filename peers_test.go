@@ -0,0 +1,93 @@
+package milter
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestAllowedPeers(t *testing.T) {
+	nets, err := ParseNetworks("192.0.2.0/24", "2001:db8::1", "198.51.100.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &AllowedPeers{
+		Networks: nets,
+		UIDs:     []int{25},
+		Func: func(info ConnInfo) bool {
+			return info.LocalAddr != nil && info.LocalAddr.String() == "trusted"
+		},
+	}
+	for _, tc := range []struct {
+		info    ConnInfo
+		allowed bool
+	}{
+		{ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.42")}}, true},
+		{ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}}, true},
+		{ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.7")}}, true},
+		{ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.8")}}, false},
+		{ConnInfo{RemoteAddr: &net.UnixAddr{Net: "unix"}, PeerCred: &PeerCred{UID: 25}}, true},
+		{ConnInfo{RemoteAddr: &net.UnixAddr{Net: "unix"}, PeerCred: &PeerCred{UID: 1000}}, false},
+		{ConnInfo{RemoteAddr: &net.UnixAddr{Net: "unix"}}, false},
+		{ConnInfo{LocalAddr: &net.UnixAddr{Name: "trusted", Net: "unix"}}, true},
+	} {
+		if allowed := p.Allowed(tc.info); allowed != tc.allowed {
+			t.Errorf("Allowed(%v, %+v) = %v, want %v", tc.info.RemoteAddr, tc.info.PeerCred, allowed, tc.allowed)
+		}
+	}
+
+	for _, cidr := range []string{"192.0.2.0/33", "example.org"} {
+		if _, err := ParseNetworks(cidr); err == nil {
+			t.Errorf("ParseNetworks(%q): expected error", cidr)
+		}
+	}
+}
+
+func TestServer_AllowedPeers(t *testing.T) {
+	for _, tc := range []struct {
+		cidr    string
+		allowed bool
+	}{
+		{"127.0.0.0/8", true},
+		{"192.0.2.0/24", false},
+	} {
+		nets, err := ParseNetworks(tc.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := make(chan error, 1)
+		s := Server{
+			NewMilter: func() Milter {
+				return NoOpMilter{}
+			},
+			AllowedPeers: &AllowedPeers{Networks: nets},
+			ErrorHook: func(err error) {
+				errs <- err
+			},
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(ln)
+
+		cl := NewClientWithOptions("tcp", ln.Addr().String(), ClientOptions{})
+		session, err := cl.Session()
+		if tc.allowed {
+			if err != nil {
+				t.Errorf("%v: %v", tc.cidr, err)
+			} else {
+				session.Close()
+			}
+		} else {
+			if err == nil {
+				session.Close()
+				t.Errorf("%v: expected connection to be closed", tc.cidr)
+			}
+			if err := <-errs; !errors.Is(err, ErrPeerNotAllowed) {
+				t.Errorf("%v: expected ErrPeerNotAllowed, got %v", tc.cidr, err)
+			}
+		}
+		s.Close()
+	}
+}
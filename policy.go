@@ -0,0 +1,317 @@
+package milter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PolicyRequest is the data submitted to an external policy service for each
+// message.
+type PolicyRequest struct {
+	Host   string            `json:"host"`
+	Family string            `json:"family"`
+	Addr   string            `json:"addr,omitempty"`
+	Port   uint16            `json:"port,omitempty"`
+	Helo   string            `json:"helo"`
+	From   string            `json:"from"`
+	Rcpts  []string          `json:"rcpts"`
+	Macros map[string]string `json:"macros,omitempty"`
+}
+
+// PolicyVerdict is the decision returned by an external policy service.
+type PolicyVerdict struct {
+	// One of "accept", "reject", "tempfail", "discard" or "continue". Empty
+	// means "continue".
+	Action string `json:"action"`
+
+	// Optional SMTP reply code and text for "reject" and "tempfail".
+	Code int    `json:"code,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+// Response converts the verdict to a milter response. It returns nil if the
+// message should be passed on to the next filter.
+//
+// Code must be a 5xx code for "reject" and a 4xx code for "tempfail", and
+// must be unset for other actions.
+func (v *PolicyVerdict) Response() (Response, error) {
+	var resp SimpleResponse
+	var class int
+	switch v.Action {
+	case "", "continue", "accept", "discard":
+		if v.Code != 0 {
+			return nil, fmt.Errorf("milter: policy: unexpected reply code for action %q: %v", v.Action, v.Code)
+		}
+		switch v.Action {
+		case "accept":
+			return RespAccept, nil
+		case "discard":
+			return RespDiscard, nil
+		}
+		return nil, nil
+	case "reject":
+		resp, class = RespReject, 5
+	case "tempfail":
+		resp, class = RespTempFail, 4
+	default:
+		return nil, fmt.Errorf("milter: policy: unknown action: %q", v.Action)
+	}
+	if v.Code == 0 {
+		return resp, nil
+	}
+	if v.Code/100 != class {
+		return nil, fmt.Errorf("milter: policy: invalid reply code for action %q: %v", v.Action, v.Code)
+	}
+	reply := strconv.Itoa(v.Code) + " " + v.Text
+	if err := checkReply(class, reply); err != nil {
+		return nil, err
+	}
+	return NewResponseStr(byte(ActReplyCode), reply), nil
+}
+
+// PolicyClient submits PolicyRequests as JSON to an HTTP policy service. It
+// is safe for concurrent use and is meant to be shared between sessions.
+type PolicyClient struct {
+	// URL the requests are POSTed to.
+	URL string
+
+	// HTTP client to use. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Timeout for a single request. Zero means no timeout.
+	Timeout time.Duration
+
+	// Verdicts for identical requests are cached for CacheTTL. Zero disables
+	// caching.
+	CacheTTL time.Duration
+
+	// Clock used to expire cached verdicts. If nil, the system clock is used.
+	Clock Clock
+
+	mu      sync.Mutex
+	cache   map[string]policyCacheEntry
+	sweepAt int
+}
+
+type policyCacheEntry struct {
+	verdict PolicyVerdict
+	expires time.Time
+}
+
+// Check submits req to the policy service and returns its verdict.
+func (c *PolicyClient) Check(ctx context.Context, req *PolicyRequest) (*PolicyVerdict, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("milter: policy: %w", err)
+	}
+
+	// Macros usually carry per-message values such as the queue ID, leave
+	// them out of the cache key.
+	keyReq := *req
+	keyReq.Macros = nil
+	keyBytes, err := json.Marshal(&keyReq)
+	if err != nil {
+		return nil, fmt.Errorf("milter: policy: %w", err)
+	}
+	key := string(keyBytes)
+	if v, ok := c.cached(key); ok {
+		return v, nil
+	}
+
+	if c.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("milter: policy: %w", err)
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("milter: policy: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("milter: policy: unexpected HTTP status: %v", resp.Status)
+	}
+
+	var v PolicyVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("milter: policy: %w", err)
+	}
+
+	c.store(key, v)
+	return &v, nil
+}
+
+func (c *PolicyClient) cached(key string) (*PolicyVerdict, bool) {
+	if c.CacheTTL == 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if c.now().After(e.expires) {
+		delete(c.cache, key)
+		return nil, false
+	}
+	v := e.verdict
+	return &v, true
+}
+
+func (c *PolicyClient) store(key string, v PolicyVerdict) {
+	if c.CacheTTL == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[string]policyCacheEntry)
+	}
+	now := c.now()
+	// Expired entries are removed on lookup, sweep the others once the cache
+	// has doubled in size since the last sweep.
+	if len(c.cache) >= c.sweepAt {
+		for k, e := range c.cache {
+			if now.After(e.expires) {
+				delete(c.cache, k)
+			}
+		}
+		c.sweepAt = 2*len(c.cache) + minSweepSize
+	}
+	c.cache[key] = policyCacheEntry{verdict: v, expires: now.Add(c.CacheTTL)}
+}
+
+// minSweepSize is the minimum amount of cache entries between two sweeps of
+// expired entries.
+const minSweepSize = 64
+
+func (c *PolicyClient) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock.Now()
+	}
+	return time.Now()
+}
+
+// PolicyMilter is a Milter that collects envelope and connection data and
+// consults an external policy service at end of message. If the service does
+// not decide, the message is passed on to the wrapped Milter.
+type PolicyMilter struct {
+	Passthrough
+
+	Client *PolicyClient
+
+	// FailOpen makes the filter pass messages on to the wrapped Milter if the
+	// policy service cannot be reached, instead of returning a temporary
+	// failure.
+	FailOpen bool
+
+	req PolicyRequest
+}
+
+var _ Milter = (*PolicyMilter)(nil)
+
+// policyConnKey is the key of the connection data of a PolicyRequest in
+// Modifier.SessionValues: the Milter is created again for each message of a
+// connection.
+type policyConnKey struct{}
+
+// conn returns the connection data of the requests, stored in the session
+// values.
+func (pm *PolicyMilter) conn(m *Modifier) *PolicyRequest {
+	values := m.SessionValues()
+	if values == nil {
+		return &pm.req
+	}
+	conn, ok := values.Get(policyConnKey{}).(*PolicyRequest)
+	if !ok {
+		conn = &PolicyRequest{}
+		values.Set(policyConnKey{}, conn)
+	}
+	return conn
+}
+
+func (pm *PolicyMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	conn := pm.conn(m)
+	conn.Host = host
+	conn.Family = family
+	conn.Port = port
+	if addr != nil {
+		conn.Addr = addr.String()
+	}
+	return pm.Passthrough.Connect(host, family, port, addr, m)
+}
+
+func (pm *PolicyMilter) Helo(name string, m *Modifier) (Response, error) {
+	pm.conn(m).Helo = name
+	return pm.Passthrough.Helo(name, m)
+}
+
+func (pm *PolicyMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	pm.req.From = from
+	return pm.Passthrough.MailFrom(from, m)
+}
+
+func (pm *PolicyMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	pm.req.Rcpts = append(pm.req.Rcpts, rcptTo)
+	return pm.Passthrough.RcptTo(rcptTo, m)
+}
+
+func (pm *PolicyMilter) Body(m *Modifier) (Response, error) {
+	defer pm.resetMessage()
+
+	conn := pm.conn(m)
+	pm.req.Host = conn.Host
+	pm.req.Family = conn.Family
+	pm.req.Addr = conn.Addr
+	pm.req.Port = conn.Port
+	pm.req.Helo = conn.Helo
+	pm.req.Macros = m.Macros
+	v, err := pm.Client.Check(m.Context(), &pm.req)
+	if err != nil {
+		m.Logf("Policy check failed: %v", err)
+		if pm.FailOpen {
+			return pm.Passthrough.Body(m)
+		}
+		return RespTempFail, nil
+	}
+
+	resp, err := v.Response()
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil {
+		return resp, nil
+	}
+	return pm.Passthrough.Body(m)
+}
+
+func (pm *PolicyMilter) Abort(m *Modifier) error {
+	pm.resetMessage()
+	return pm.Passthrough.Abort(m)
+}
+
+func (pm *PolicyMilter) resetMessage() {
+	pm.req.From = ""
+	pm.req.Rcpts = nil
+	pm.req.Macros = nil
+}
@@ -0,0 +1,194 @@
+package milter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyVerdict_Response(t *testing.T) {
+	tests := []struct {
+		verdict  PolicyVerdict
+		expected Response
+		err      bool
+	}{
+		{verdict: PolicyVerdict{}, expected: nil},
+		{verdict: PolicyVerdict{Action: "accept"}, expected: RespAccept},
+		{verdict: PolicyVerdict{Action: "discard"}, expected: RespDiscard},
+		{verdict: PolicyVerdict{Action: "reject"}, expected: RespReject},
+		{verdict: PolicyVerdict{Action: "tempfail"}, expected: RespTempFail},
+		{verdict: PolicyVerdict{Action: "reject", Code: 554, Text: "5.7.1 No"}, expected: NewResponseStr(byte(ActReplyCode), "554 5.7.1 No")},
+		{verdict: PolicyVerdict{Action: "tempfail", Code: 451, Text: "4.7.1 Later"}, expected: NewResponseStr(byte(ActReplyCode), "451 4.7.1 Later")},
+		{verdict: PolicyVerdict{Action: "reject", Code: 450}, err: true},
+		{verdict: PolicyVerdict{Action: "tempfail", Code: 550}, err: true},
+		{verdict: PolicyVerdict{Action: "accept", Code: 250}, err: true},
+		{verdict: PolicyVerdict{Action: "bounce"}, err: true},
+	}
+	for _, tc := range tests {
+		resp, err := tc.verdict.Response()
+		if tc.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error", tc.verdict)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tc.verdict, err)
+			continue
+		}
+		if (resp == nil) != (tc.expected == nil) || (resp != nil && !reflect.DeepEqual(resp.Response(), tc.expected.Response())) {
+			t.Errorf("%+v: wrong response: %+v", tc.verdict, resp)
+		}
+	}
+}
+
+// startPolicyService serves verdict over HTTP and counts requests.
+func startPolicyService(t *testing.T, verdict PolicyVerdict, requests *int) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req PolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*requests++
+		json.NewEncoder(w).Encode(&verdict)
+	}))
+}
+
+func TestPolicyClient_Cache(t *testing.T) {
+	var requests int
+	srv := startPolicyService(t, PolicyVerdict{Action: "reject"}, &requests)
+	defer srv.Close()
+
+	clock := &testClock{now: time.Unix(0, 0)}
+	c := PolicyClient{URL: srv.URL, CacheTTL: time.Minute, Clock: clock}
+	req := PolicyRequest{From: "from@example.org", Rcpts: []string{"to@example.org"}}
+	for i, queueID := range []string{"A", "B"} {
+		req.Macros = map[string]string{"i": queueID}
+		v, err := c.Check(context.Background(), &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Action != "reject" {
+			t.Fatal("Wrong action:", v.Action)
+		}
+		if requests != 1 {
+			t.Fatalf("Check %v: wrong amount of requests: %v", i, requests)
+		}
+	}
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	if _, err := c.Check(context.Background(), &req); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Fatal("Expired verdict was used, requests:", requests)
+	}
+}
+
+func testPolicyMilter(t *testing.T, pm *PolicyMilter, logger Logger) *Action {
+	t.Helper()
+	s := Server{
+		NewMilter: func() Milter {
+			return pm
+		},
+		Logger: logger,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Rcpt("to@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, act, err := session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return act
+}
+
+func TestPolicyMilter(t *testing.T) {
+	var requests int
+	srv := startPolicyService(t, PolicyVerdict{Action: "reject", Code: 554, Text: "5.7.1 Denied"}, &requests)
+	defer srv.Close()
+
+	act := testPolicyMilter(t, &PolicyMilter{Passthrough: Passthrough{NoOpMilter{}}, Client: &PolicyClient{URL: srv.URL}}, nil)
+	if act.Code != ActReplyCode || act.SMTPCode != 554 {
+		t.Fatalf("Expected rejection, got %+v", act)
+	}
+}
+
+func TestPolicyMilter_ServiceDown(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	var logger testLogger
+	pm := &PolicyMilter{Passthrough: Passthrough{NoOpMilter{}}, Client: &PolicyClient{URL: srv.URL}}
+	if act := testPolicyMilter(t, pm, &logger); act.Code != ActTempFail {
+		t.Fatalf("Expected tempfail, got %+v", act)
+	}
+	if len(logger.msgs) == 0 || !strings.Contains(logger.msgs[0], "Policy check failed") {
+		t.Fatal("Policy failure not logged:", logger.msgs)
+	}
+
+	pm.FailOpen = true
+	if act := testPolicyMilter(t, pm, nil); act.Code != ActAccept {
+		t.Fatalf("Expected accept, got %+v", act)
+	}
+}
+
+func TestPolicyMilter_Connection(t *testing.T) {
+	reqs := make(chan PolicyRequest, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req PolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reqs <- req
+		json.NewEncoder(w).Encode(&PolicyVerdict{})
+	}))
+	defer srv.Close()
+
+	s := Server{
+		NewMilter: func() Milter {
+			return &PolicyMilter{Passthrough: Passthrough{NoOpMilter{}}, Client: &PolicyClient{URL: srv.URL}}
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Conn("mx.example.org", FamilyInet, 25, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Helo("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	for i, from := range []string{"from1@example.org", "from2@example.org"} {
+		if _, err := session.Mail(from, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := session.End(); err != nil {
+			t.Fatal(err)
+		}
+
+		req := <-reqs
+		if req.Host != "mx.example.org" || req.Family != "tcp4" || req.Addr != "192.0.2.1" || req.Port != 25 || req.Helo != "client.example.org" {
+			t.Errorf("Message %v: wrong connection data: %+v", i, req)
+		}
+		if req.From != from {
+			t.Errorf("Message %v: wrong sender: %v", i, req.From)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package milter
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// workerPool limits the number of Milter callbacks running concurrently, see
+// Server.Workers.
+type workerPool struct {
+	slots    chan struct{}
+	maxQueue int32
+	waiting  int32
+}
+
+// workerPool returns the worker pool of the server, nil if Server.Workers is
+// not set.
+func (s *Server) workerPool() *workerPool {
+	if s.Workers <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pool == nil {
+		s.pool = &workerPool{
+			slots:    make(chan struct{}, s.Workers),
+			maxQueue: int32(s.WorkerQueue),
+		}
+	}
+	return s.pool
+}
+
+// acquire reserves a worker. If all workers are busy, it waits for one unless
+// the queue is full and wait is false. It reports whether a worker was
+// reserved.
+func (p *workerPool) acquire(ctx context.Context, wait bool) bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+	}
+	n := atomic.AddInt32(&p.waiting, 1)
+	defer atomic.AddInt32(&p.waiting, -1)
+	if !wait && n > p.maxQueue {
+		return false
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *workerPool) release() {
+	<-p.slots
+}
+
+// processInPool runs Process once a worker is available. If the queue is
+// full, a temporary failure is returned without running the callback, except
+// for Abort which always waits for a worker.
+func (m *milterSession) processInPool(msg *Message) (Response, error) {
+	pool := m.server.workerPool()
+	if pool == nil {
+		return m.processRecover(msg)
+	}
+	code := Code(msg.Code)
+	if !pool.acquire(m.connCtx, code == CodeAbort) {
+		if err := m.connCtx.Err(); err != nil {
+			return nil, err
+		}
+		m.logf("All workers busy, responding with a temporary failure")
+		if code == CodeEOB {
+			m.resetMessage()
+		}
+		return RespTempFail, nil
+	}
+	defer pool.release()
+	return m.processRecover(msg)
+}
@@ -0,0 +1,60 @@
+package milter
+
+import (
+	"testing"
+)
+
+func TestServer_Workers(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	s := Server{
+		NewMilter: func() Milter {
+			return &MockMilter{
+				MailResp: RespContinue,
+				MailMod: func(m *Modifier) {
+					if m.Macros["block"] != "" {
+						close(started)
+						<-unblock
+					}
+				},
+			}
+		},
+		Workers: 1,
+		Logger:  &testLogger{},
+	}
+	defer s.Close()
+	blocked := startTestSession(t, &s, ClientOptions{})
+	defer blocked.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if err := blocked.Macros(CodeMail, "block", "1"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := blocked.Mail("from@example.org", nil)
+		done <- err
+	}()
+	<-started
+
+	act, err := session.Mail("from@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActTempFail {
+		t.Fatal("Expected a temporary failure while the worker is busy, got", act.Code)
+	}
+
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	act, err = session.Mail("from@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActContinue {
+		t.Fatal("Unexpected code once the worker is available:", act.Code)
+	}
+}
@@ -0,0 +1,136 @@
+package milter
+
+import (
+	"fmt"
+)
+
+// ProtocolError is reported to Server.ErrorHook when the MTA sends a command
+// out of order and Server.StrictProtocol is set.
+type ProtocolError struct {
+	// Code is the command received.
+	Code Code
+	// Reason describes the violation.
+	Reason string
+}
+
+func (err *ProtocolError) Error() string {
+	return fmt.Sprintf("milter: protocol violation: command %q %v", byte(err.Code), err.Reason)
+}
+
+// messageOrder is the order of the commands of a message.
+var messageOrder = map[Code]int{
+	CodeMail:   1,
+	CodeRcpt:   2,
+	CodeData:   3,
+	CodeHeader: 4,
+	CodeEOH:    5,
+	CodeBody:   6,
+	CodeEOB:    7,
+}
+
+// protocolState tracks the commands received during a session to validate
+// their order, see Server.StrictProtocol.
+type protocolState struct {
+	negotiated bool
+	connected  bool
+	// phase is the last command of the message in progress, zero outside of
+	// a message.
+	phase Code
+}
+
+// check reports whether code is valid in the current state. protocol are the
+// negotiated protocol options.
+func (p *protocolState) check(code Code, protocol OptProtocol) *ProtocolError {
+	violation := func(format string, v ...interface{}) *ProtocolError {
+		return &ProtocolError{Code: code, Reason: fmt.Sprintf(format, v...)}
+	}
+
+	switch code {
+	case CodeMacro, CodeQuit:
+		return nil
+	case CodeOptNeg:
+		if p.negotiated {
+			return violation("after negotiation")
+		}
+		return nil
+	}
+	if !p.negotiated {
+		return violation("before negotiation")
+	}
+
+	switch code {
+	case CodeConn:
+		if p.connected {
+			return violation("repeated")
+		}
+		fallthrough
+	case CodeHelo:
+		if p.phase != 0 {
+			return violation("during a message")
+		}
+		return nil
+	}
+
+	order, ok := messageOrder[code]
+	if !ok {
+		// abort, unknown SMTP commands and commands handled by the
+		// application
+		return nil
+	}
+	if p.phase == 0 {
+		if code != CodeMail && protocol&OptNoMailFrom == 0 {
+			return violation("outside of a message")
+		}
+		return nil
+	}
+	current := messageOrder[p.phase]
+	switch {
+	case code == CodeMail && current <= messageOrder[CodeRcpt]:
+		// some MTAs don't abort transactions ended before DATA
+		return nil
+	case order < current:
+		return violation("after %q", byte(p.phase))
+	case order == current && code != CodeRcpt && code != CodeHeader && code != CodeBody:
+		return violation("repeated")
+	}
+	return nil
+}
+
+// update records a command processed successfully.
+func (p *protocolState) update(code Code) {
+	switch code {
+	case CodeOptNeg:
+		p.negotiated = true
+	case CodeConn:
+		p.connected = true
+	case CodeQuitNewConn:
+		p.connected = false
+		p.phase = 0
+	case CodeAbort, CodeEOB:
+		p.phase = 0
+	default:
+		if _, ok := messageOrder[code]; ok {
+			p.phase = code
+		}
+	}
+}
+
+// endMessage records a response ending the message in progress. Rejecting a
+// recipient doesn't end the message.
+func (p *protocolState) endMessage(code Code) {
+	if code != CodeRcpt {
+		p.phase = 0
+	}
+}
+
+// checkProtocol validates the order of a command if Server.StrictProtocol is
+// set.
+func (m *milterSession) checkProtocol(code Code) error {
+	if !m.server.StrictProtocol {
+		return nil
+	}
+	if err := m.protoState.check(code, m.protocol); err != nil {
+		return err
+	}
+	return nil
+}
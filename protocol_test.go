@@ -0,0 +1,97 @@
+package milter
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProtocolState(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		protocol OptProtocol
+		codes    string
+		// index of the first invalid command, -1 if none
+		invalid int
+	}{
+		{"message", 0, "OCHMRRTLLNBBE", -1},
+		{"two messages", 0, "OCHMRNBEMRNBE", -1},
+		{"abort", 0, "OCMRLAMRE", -1},
+		{"transaction restarted before DATA", 0, "OCMRMRE", -1},
+		{"macros", 0, "DOCDMDRE", -1},
+		{"before negotiation", 0, "CO", 0},
+		{"negotiation repeated", 0, "OCO", 2},
+		{"connect repeated", 0, "OCC", 2},
+		{"body before mail", 0, "OCB", 2},
+		{"body before mail without MAIL", OptNoMailFrom, "OCRBE", -1},
+		{"header after end of headers", 0, "OCMRLNL", 6},
+		{"end of headers repeated", 0, "OCMRNN", 5},
+		{"helo during message", 0, "OCMRH", 4},
+		{"mail after data", 0, "OCMRTM", 5},
+		{"quit new conn", 0, "OCMREKCMRE", -1},
+	} {
+		var p protocolState
+		invalid := -1
+		for i, c := range tc.codes {
+			code := Code(c)
+			if err := p.check(code, tc.protocol); err != nil {
+				invalid = i
+				break
+			}
+			p.update(code)
+		}
+		if invalid != tc.invalid {
+			t.Errorf("%v: first invalid command at %v, expected %v", tc.name, invalid, tc.invalid)
+		}
+	}
+}
+
+func TestServer_StrictProtocol(t *testing.T) {
+	errCh := make(chan error, 1)
+	s := Server{
+		NewMilter: func() Milter {
+			return &MockMilter{
+				MailResp: RespContinue,
+				RcptResp: RespContinue,
+				HdrResp:  RespContinue,
+				HdrsResp: RespContinue,
+			}
+		},
+		StrictProtocol:    true,
+		ProtocolViolation: ErrorTempFail,
+		ErrorHook: func(err error) {
+			errCh <- err
+		},
+		Logger: &testLogger{},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Rcpt("to@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.HeaderEnd(); err != nil {
+		t.Fatal(err)
+	}
+	act, err := session.HeaderField("Subject", "late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActTempFail {
+		t.Fatal("Unexpected code for a header after end of headers:", act.Code)
+	}
+
+	select {
+	case err := <-errCh:
+		var perr *ProtocolError
+		if !errors.As(err, &perr) || perr.Code != CodeHeader {
+			t.Fatalf("Expected *ProtocolError, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ErrorHook not called")
+	}
+}
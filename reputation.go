@@ -0,0 +1,115 @@
+package milter
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ReputationCache is a cache of per-client IP data, such as DNSBL or GeoIP
+// lookup results, shared between sessions so that lookups aren't repeated
+// for every message from busy peers. It is safe for concurrent use.
+type ReputationCache struct {
+	// Entries expire after TTL. Zero means entries never expire.
+	TTL time.Duration
+
+	// Clock used to expire entries. If nil, the system clock is used.
+	Clock Clock
+
+	mu      sync.Mutex
+	entries map[string]reputationEntry
+	sweepAt int
+	hits    uint64
+	misses  uint64
+}
+
+type reputationEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// ReputationStats are metrics about a ReputationCache.
+type ReputationStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// HitRate returns the ratio of lookups answered from the cache.
+func (st ReputationStats) HitRate() float64 {
+	if st.Hits+st.Misses == 0 {
+		return 0
+	}
+	return float64(st.Hits) / float64(st.Hits+st.Misses)
+}
+
+func (c *ReputationCache) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock.Now()
+	}
+	return time.Now()
+}
+
+// Get returns the cached value for ip.
+func (c *ReputationCache) Get(ip net.IP) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := ip.String()
+	e, ok := c.entries[key]
+	if ok && c.TTL != 0 && c.now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return e.value, true
+}
+
+// Set stores the value for ip.
+func (c *ReputationCache) Set(ip net.IP, v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]reputationEntry)
+	}
+	now := c.now()
+	// Expired entries are removed on lookup, sweep the others once the cache
+	// has doubled in size since the last sweep.
+	if c.TTL != 0 && len(c.entries) >= c.sweepAt {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.sweepAt = 2*len(c.entries) + minSweepSize
+	}
+	c.entries[ip.String()] = reputationEntry{value: v, expires: now.Add(c.TTL)}
+}
+
+// Lookup returns the cached value for ip, calling lookup and caching its
+// result if missing. Errors are not cached.
+func (c *ReputationCache) Lookup(ip net.IP, lookup func(ip net.IP) (interface{}, error)) (interface{}, error) {
+	if v, ok := c.Get(ip); ok {
+		return v, nil
+	}
+	v, err := lookup(ip)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(ip, v)
+	return v, nil
+}
+
+// Stats returns metrics about the cache.
+func (c *ReputationCache) Stats() ReputationStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ReputationStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: len(c.entries),
+	}
+}
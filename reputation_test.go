@@ -0,0 +1,65 @@
+package milter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestReputationCache(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	c := ReputationCache{TTL: time.Minute, Clock: clock}
+	ip := net.ParseIP("192.0.2.1")
+
+	lookups := 0
+	lookup := func(ip net.IP) (interface{}, error) {
+		lookups++
+		return "listed", nil
+	}
+	for i := 0; i < 3; i++ {
+		v, err := c.Lookup(ip, lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "listed" {
+			t.Fatal("Wrong value:", v)
+		}
+	}
+	if lookups != 1 {
+		t.Fatal("Wrong amount of lookups:", lookups)
+	}
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	if _, ok := c.Get(ip); ok {
+		t.Fatal("Entry not expired")
+	}
+
+	if st := c.Stats(); st.Hits != 2 || st.Misses != 2 || st.HitRate() != 0.5 {
+		t.Fatalf("Wrong stats: %+v", st)
+	}
+}
+
+func TestReputationCache_Sweep(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	c := ReputationCache{TTL: time.Minute, Clock: clock}
+
+	for i := 0; i < minSweepSize; i++ {
+		c.Set(net.IPv4(192, 0, 2, byte(i)), i)
+	}
+	clock.now = clock.now.Add(2 * time.Minute)
+	for i := 0; i < minSweepSize; i++ {
+		c.Set(net.IPv4(198, 51, 100, byte(i)), i)
+	}
+	// The expired entries are swept once, when the threshold is reached
+	if st := c.Stats(); st.Entries != minSweepSize {
+		t.Fatalf("Wrong amount of entries: %v", st.Entries)
+	}
+}
@@ -1,5 +1,12 @@
 package milter
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // Response represents a response structure returned by callback
 // handlers to indicate how the milter server should proceed
 type Response interface {
@@ -12,21 +19,42 @@ type SimpleResponse byte
 
 // Response returns a Message object reference
 func (r SimpleResponse) Response() *Message {
+	if r == RespNoReply {
+		return &Message{byte(ActContinue), nil}
+	}
 	return &Message{byte(r), nil}
 }
 
-// Continue to process milter messages only if current code is Continue
+// Continue to process milter messages only if current code is Continue or Skip
 func (r SimpleResponse) Continue() bool {
-	return ActionCode(r) == ActContinue
+	return ActionCode(r) == ActContinue || ActionCode(r) == ActSkip || r == RespNoReply
 }
 
 // Define standard responses with no data
 const (
-	RespAccept   = SimpleResponse(ActAccept)
+	// RespAccept accepts the message without calling the remaining
+	// callbacks.
+	RespAccept = SimpleResponse(ActAccept)
+	// RespContinue continues with the next command.
 	RespContinue = SimpleResponse(ActContinue)
-	RespDiscard  = SimpleResponse(ActDiscard)
-	RespReject   = SimpleResponse(ActReject)
+	// RespDiscard accepts the message but silently discards it.
+	RespDiscard = SimpleResponse(ActDiscard)
+	// RespReject rejects the command, or the recipient for RcptTo, with a
+	// permanent failure. Use RejectWithCode to customize the SMTP reply.
+	RespReject = SimpleResponse(ActReject)
+	// RespTempFail rejects the command, or the recipient for RcptTo, with a
+	// temporary failure. Use TempFailWithCode to customize the SMTP reply.
 	RespTempFail = SimpleResponse(ActTempFail)
+
+	// RespSkip can be returned by BodyChunk to skip the remaining body chunks
+	// of the message. Body is still called at end of message.
+	RespSkip = SimpleResponse(ActSkip)
+
+	// RespNoReply continues without sending a response to the MTA, for the
+	// commands whose response was disabled with the OptNo*Reply protocol
+	// options. Otherwise it is sent as RespContinue, since the MTA waits for
+	// a response.
+	RespNoReply = SimpleResponse(0)
 )
 
 // CustomResponse is a response instance used by callback handlers to indicate
@@ -43,7 +71,7 @@ func (c *CustomResponse) Response() *Message {
 
 // Continue returns false if milter chain should be stopped, true otherwise
 func (c *CustomResponse) Continue() bool {
-	for _, q := range []ActionCode{ActAccept, ActDiscard, ActReject, ActTempFail} {
+	for _, q := range []ActionCode{ActAccept, ActDiscard, ActReject, ActTempFail, ActReplyCode} {
 		if c.code == byte(q) {
 			return false
 		}
@@ -60,3 +88,138 @@ func NewResponse(code byte, data []byte) *CustomResponse {
 func NewResponseStr(code byte, data string) *CustomResponse {
 	return NewResponse(code, []byte(data+null))
 }
+
+// Maximum number of lines of a reply, as enforced by libmilter.
+const maxReplyLines = 32
+
+// RejectWithCode returns a response rejecting the command with a custom SMTP
+// reply. code must be a 5xx SMTP code. enhanced is an optional enhanced status
+// code such as "5.7.1", its class must match code. Each line is sent as a line
+// of a multi-line reply.
+func RejectWithCode(code int, enhanced string, lines ...string) (*CustomResponse, error) {
+	return newReplyResponse(5, code, enhanced, lines)
+}
+
+// TempFailWithCode is like RejectWithCode but for a temporary failure: code
+// must be a 4xx SMTP code.
+func TempFailWithCode(code int, enhanced string, lines ...string) (*CustomResponse, error) {
+	return newReplyResponse(4, code, enhanced, lines)
+}
+
+func newReplyResponse(class int, code int, enhanced string, lines []string) (*CustomResponse, error) {
+	if code/100 != class {
+		return nil, fmt.Errorf("milter: reply: invalid SMTP code %v, expected %vxx", code, class)
+	}
+	if enhanced != "" && !validEnhancedCode(class, enhanced) {
+		return nil, fmt.Errorf("milter: reply: invalid enhanced status code %q for SMTP code %v", enhanced, code)
+	}
+	if len(lines) > maxReplyLines {
+		return nil, fmt.Errorf("milter: reply: too many lines: %v", len(lines))
+	}
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+
+	var sb strings.Builder
+	for i, line := range lines {
+		if strings.ContainsAny(line, "\r\n\x00") {
+			return nil, fmt.Errorf("milter: reply: invalid character in line %q", line)
+		}
+		sb.WriteString(strconv.Itoa(code))
+		if i < len(lines)-1 {
+			sb.WriteByte('-')
+		} else {
+			sb.WriteByte(' ')
+		}
+		if enhanced != "" {
+			sb.WriteString(enhanced)
+			if line != "" {
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteString(line)
+		if i < len(lines)-1 {
+			sb.WriteString("\r\n")
+		}
+	}
+	return NewResponseStr(byte(ActReplyCode), sb.String()), nil
+}
+
+// ErrInvalidReply is returned when the SMTP reply of a response doesn't
+// match its action, e.g. a 4xx code for a rejection.
+var ErrInvalidReply = errors.New("milter: invalid reply")
+
+// checkResponse checks that the SMTP reply carried by msg, if any, is
+// consistent: sendmail treats a 2xx or 3xx code, or a reply code whose class
+// differs from the action, as a protocol error.
+func checkResponse(msg *Message) error {
+	var class int
+	switch ActionCode(msg.Code) {
+	case ActReplyCode:
+	case ActReject:
+		class = 5
+	case ActTempFail:
+		class = 4
+	default:
+		return nil
+	}
+	reply := strings.TrimSuffix(string(msg.Data), null)
+	if reply == "" && class != 0 {
+		return nil
+	}
+	return checkReply(class, reply)
+}
+
+// checkReply checks the SMTP reply of a response. class is the expected
+// class of the code, or 0 for either 4xx or 5xx.
+func checkReply(class int, reply string) error {
+	lines := strings.Split(reply, "\r\n")
+	code := reply
+	if len(code) > 3 {
+		code = code[:3]
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || n/100 < 4 || n/100 > 5 {
+		return fmt.Errorf("%w: invalid SMTP code in %q", ErrInvalidReply, lines[0])
+	}
+	if class != 0 && n/100 != class {
+		return fmt.Errorf("%w: SMTP code %v doesn't match action, expected %vxx", ErrInvalidReply, n, class)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, code) {
+			return fmt.Errorf("%w: SMTP code mismatch in line %q, expected %v", ErrInvalidReply, line, code)
+		}
+		text := line[3:]
+		if text != "" && text[0] != ' ' && text[0] != '-' {
+			return fmt.Errorf("%w: invalid separator in line %q", ErrInvalidReply, line)
+		}
+		// the enhanced status code, if any, must have the same class
+		enhanced := strings.TrimLeft(text, " -")
+		if i := strings.IndexByte(enhanced, ' '); i >= 0 {
+			enhanced = enhanced[:i]
+		}
+		if strings.Count(enhanced, ".") == 2 && enhanced[0] >= '0' && enhanced[0] <= '9' && !validEnhancedCode(n/100, enhanced) {
+			return fmt.Errorf("%w: invalid enhanced status code %q for SMTP code %v", ErrInvalidReply, enhanced, n)
+		}
+	}
+	return nil
+}
+
+// validEnhancedCode checks that enhanced is a RFC 3463 status code of class.
+func validEnhancedCode(class int, enhanced string) bool {
+	parts := strings.Split(enhanced, ".")
+	if len(parts) != 3 || parts[0] != strconv.Itoa(class) {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if len(part) == 0 || len(part) > 3 {
+			return false
+		}
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
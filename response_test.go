@@ -0,0 +1,97 @@
+package milter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRejectWithCode(t *testing.T) {
+	for _, tc := range []struct {
+		reject   bool
+		code     int
+		enhanced string
+		lines    []string
+		data     string
+	}{
+		{true, 550, "5.7.1", []string{"Rejected"}, "550 5.7.1 Rejected"},
+		{true, 554, "", []string{"Rejected"}, "554 Rejected"},
+		{true, 550, "5.7.1", []string{"Rejected", "See https://example.org"}, "550-5.7.1 Rejected\r\n550 5.7.1 See https://example.org"},
+		{true, 550, "5.7.1", nil, "550 5.7.1"},
+		{false, 451, "4.7.1", []string{"Try again", "later"}, "451-4.7.1 Try again\r\n451 4.7.1 later"},
+	} {
+		f := TempFailWithCode
+		if tc.reject {
+			f = RejectWithCode
+		}
+		resp, err := f(tc.code, tc.enhanced, tc.lines...)
+		if err != nil {
+			t.Errorf("%v %v %q: %v", tc.code, tc.enhanced, tc.lines, err)
+			continue
+		}
+		msg := resp.Response()
+		if ActionCode(msg.Code) != ActReplyCode {
+			t.Errorf("%v %v %q: wrong code: %v", tc.code, tc.enhanced, tc.lines, msg.Code)
+		}
+		if s := string(msg.Data); s != tc.data+"\x00" {
+			t.Errorf("%v %v %q: wrong data: %q", tc.code, tc.enhanced, tc.lines, s)
+		}
+		if resp.Continue() {
+			t.Errorf("%v %v %q: reply must not continue", tc.code, tc.enhanced, tc.lines)
+		}
+	}
+
+	for _, tc := range []struct {
+		reject   bool
+		code     int
+		enhanced string
+		lines    []string
+	}{
+		{true, 450, "", nil},
+		{false, 550, "", nil},
+		{true, 250, "", nil},
+		{true, 550, "4.7.1", nil},
+		{true, 550, "5.7", nil},
+		{true, 550, "5.7.1234", nil},
+		{true, 550, "5.x.1", nil},
+		{true, 550, "5.7.1", []string{"Rejected\r\n250 OK"}},
+		{true, 550, "5.7.1", make([]string, maxReplyLines+1)},
+	} {
+		f := TempFailWithCode
+		if tc.reject {
+			f = RejectWithCode
+		}
+		if _, err := f(tc.code, tc.enhanced, tc.lines...); err == nil {
+			t.Errorf("%v %v %q: expected error", tc.code, tc.enhanced, tc.lines)
+		}
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	for _, tc := range []struct {
+		resp  Response
+		valid bool
+	}{
+		{RespReject, true},
+		{RespTempFail, true},
+		{RespContinue, true},
+		{NewResponseStr(byte(ActReplyCode), "550 5.7.1 Rejected"), true},
+		{NewResponseStr(byte(ActReplyCode), "451-4.7.1 Try again\r\n451 4.7.1 later"), true},
+		{NewResponseStr(byte(ActReplyCode), "554"), true},
+		{NewResponseStr(byte(ActReject), "550 5.7.1 Rejected"), true},
+		{NewResponseStr(byte(ActReplyCode), "250 OK"), false},
+		{NewResponseStr(byte(ActReplyCode), "Rejected"), false},
+		{NewResponseStr(byte(ActReplyCode), "550 4.7.1 Rejected"), false},
+		{NewResponseStr(byte(ActReplyCode), "550-5.7.1 Rejected\r\n451 4.7.1 later"), false},
+		{NewResponseStr(byte(ActReplyCode), "5501 Rejected"), false},
+		{NewResponseStr(byte(ActReject), "451 4.7.1 Try again"), false},
+		{NewResponseStr(byte(ActTempFail), "550 5.7.1 Rejected"), false},
+	} {
+		msg := tc.resp.Response()
+		err := checkResponse(msg)
+		if tc.valid && err != nil {
+			t.Errorf("%c %q: %v", msg.Code, msg.Data, err)
+		} else if !tc.valid && !errors.Is(err, ErrInvalidReply) {
+			t.Errorf("%c %q: expected ErrInvalidReply, got %v", msg.Code, msg.Data, err)
+		}
+	}
+}
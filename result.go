@@ -0,0 +1,161 @@
+package milter
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// TraceHeader is the header field used by filters to explain their decision,
+// as a list of entries separated by semicolons. See Result.Trace.
+const TraceHeader = "X-Milter-Trace"
+
+// Result is the outcome of a message checked by a milter.
+type Result struct {
+	// Modify actions, in the order they were sent by the milter.
+	ModifyActions []ModifyAction
+
+	// Final action.
+	Action *Action
+
+	// Effective recipients of the message: the recipients accepted by the
+	// milter, with the ActAddRcpt and ActDelRcpt modify actions applied.
+	Recipients []string
+
+	// Recipients rejected by the milter, in the order they were sent.
+	RejectedRcpts []RcptRejection
+
+	// NoRcpts reports whether the modify actions would have removed all the
+	// recipients of the message. ClientOptions.NoRcptPolicy has been applied.
+	NoRcpts bool
+}
+
+// NoRcptPolicy controls what happens when the modify actions of a milter
+// would leave a message without recipients, which would silently lose it.
+type NoRcptPolicy int
+
+const (
+	// NoRcptAllow leaves the result as is.
+	NoRcptAllow NoRcptPolicy = iota
+	// NoRcptKeepOriginal drops the ActAddRcpt and ActDelRcpt modify actions,
+	// so that the message is delivered to the original recipients.
+	NoRcptKeepOriginal
+	// NoRcptDiscard replaces the final action with ActDiscard.
+	NoRcptDiscard
+	// NoRcptReject replaces the final action with ActReject.
+	NoRcptReject
+)
+
+// RcptRejection is a recipient rejected by the milter.
+type RcptRejection struct {
+	Addr string
+	// Reject, TempFail or ReplyCode action.
+	Action *Action
+}
+
+// EndResult is like End, but returns a Result.
+func (s *ClientSession) EndResult() (*Result, error) {
+	rcpts, rejected := s.rcpts, s.rejectedRcpts
+	modifyActs, act, err := s.End()
+	if err != nil {
+		return nil, err
+	}
+	return s.newResult(rcpts, rejected, modifyActs, act), nil
+}
+
+// newResult builds the Result of a message, applying the NoRcptPolicy.
+func (s *ClientSession) newResult(rcpts []string, rejected []RcptRejection, modifyActs []ModifyAction, act *Action) *Result {
+	res := &Result{
+		ModifyActions: modifyActs,
+		Action:        act,
+		Recipients:    effectiveRcpts(rcpts, modifyActs),
+		RejectedRcpts: rejected,
+	}
+	switch act.Code {
+	case ActAccept, ActContinue:
+	default:
+		return res
+	}
+	if len(rcpts) == 0 || len(res.Recipients) > 0 {
+		return res
+	}
+
+	res.NoRcpts = true
+	switch s.noRcptPolicy {
+	case NoRcptKeepOriginal:
+		res.ModifyActions = nil
+		for _, a := range modifyActs {
+			if a.Code != ActAddRcpt && a.Code != ActDelRcpt {
+				res.ModifyActions = append(res.ModifyActions, a)
+			}
+		}
+		res.Recipients = append([]string(nil), rcpts...)
+	case NoRcptDiscard:
+		res.Action = &Action{Code: ActDiscard}
+	case NoRcptReject:
+		res.Action = &Action{Code: ActReject}
+	}
+	return res
+}
+
+// effectiveRcpts returns the recipients resulting from applying the
+// ActAddRcpt and ActDelRcpt actions in acts to rcpts, as ApplyModifyActions
+// would.
+func effectiveRcpts(rcpts []string, acts []ModifyAction) []string {
+	msg := MessageState{Rcpts: append([]string(nil), rcpts...)}
+	var rcptActs []ModifyAction
+	for _, act := range acts {
+		if act.Code == ActAddRcpt || act.Code == ActDelRcpt {
+			rcptActs = append(rcptActs, act)
+		}
+	}
+	ApplyModifyActions(&msg, rcptActs)
+	return msg.Rcpts
+}
+
+// BodyReplaced reports whether the milter replaced the message body.
+func (r *Result) BodyReplaced() bool {
+	for _, act := range r.ModifyActions {
+		if act.Code == ActReplBody {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplacementBody returns the replacement body, reassembled in order from all
+// ActReplBody actions. It returns nil if the body was not replaced.
+//
+// The individual chunks are still available in ModifyActions.
+func (r *Result) ReplacementBody() io.Reader {
+	var readers []io.Reader
+	for _, act := range r.ModifyActions {
+		if act.Code == ActReplBody {
+			readers = append(readers, bytes.NewReader(act.Body))
+		}
+	}
+	if readers == nil {
+		return nil
+	}
+	return io.MultiReader(readers...)
+}
+
+// Trace returns the entries of the TraceHeader fields added by the milter,
+// explaining which rules or filters fired and why.
+func (r *Result) Trace() []string {
+	var trace []string
+	for _, act := range r.ModifyActions {
+		if act.Code != ActAddHeader && act.Code != ActInsertHeader {
+			continue
+		}
+		if !strings.EqualFold(act.HeaderName, TraceHeader) {
+			continue
+		}
+		for _, entry := range strings.Split(act.HeaderValue, ";") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				trace = append(trace, entry)
+			}
+		}
+	}
+	return trace
+}
@@ -0,0 +1,127 @@
+package milter
+
+import (
+	"strings"
+)
+
+// DomainMap maps email domains to replacement domains, for instance when
+// migrating users to a new domain.
+//
+// Keys are matched case-insensitively. A key starting with "*." matches the
+// subdomains of the domain, the most specific key wins. If the value of a
+// wildcard key also starts with "*.", the matched subdomain labels are kept:
+//
+//	DomainMap{
+//		"old.example":   "new.example",
+//		"*.old.example": "*.new.example", // a.old.example -> a.new.example
+//	}
+type DomainMap map[string]string
+
+// Lookup returns the replacement domain for domain.
+func (dm DomainMap) Lookup(domain string) (string, bool) {
+	domain = strings.ToLower(domain)
+	if v, ok := dm.get(domain); ok {
+		return v, true
+	}
+	labels := strings.Split(domain, ".")
+	for i := 1; i < len(labels); i++ {
+		v, ok := dm.get("*." + strings.Join(labels[i:], "."))
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(v, "*.") {
+			v = strings.Join(labels[:i], ".") + v[1:]
+		}
+		return v, true
+	}
+	return "", false
+}
+
+func (dm DomainMap) get(key string) (string, bool) {
+	if v, ok := dm[key]; ok {
+		return v, true
+	}
+	for k, v := range dm {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// RewriteAddr rewrites the domain of addr, with or without angle brackets.
+// It returns false if the domain is not mapped.
+func (dm DomainMap) RewriteAddr(addr string) (string, bool) {
+	bare := strings.TrimSuffix(strings.TrimPrefix(addr, "<"), ">")
+	i := strings.LastIndexByte(bare, '@')
+	if i < 0 {
+		return addr, false
+	}
+	domain, ok := dm.Lookup(bare[i+1:])
+	if !ok {
+		return addr, false
+	}
+	rewritten := bare[:i+1] + domain
+	if bare != addr {
+		rewritten = "<" + rewritten + ">"
+	}
+	return rewritten, true
+}
+
+// AddressRewriter is a Milter rewriting the domains of the envelope sender
+// and recipients at end of message, before passing it on to the wrapped
+// Milter. Senders are changed with ChangeFrom, recipients are replaced with
+// DeleteRecipient and AddRecipient. The OptChangeFrom, OptAddRcpt and
+// OptRemoveRcpt actions are required.
+type AddressRewriter struct {
+	Passthrough
+	Senders    DomainMap
+	Recipients DomainMap
+
+	from  string
+	rcpts []string
+}
+
+var _ Milter = (*AddressRewriter)(nil)
+
+func (ar *AddressRewriter) MailFrom(from string, m *Modifier) (Response, error) {
+	ar.from, ar.rcpts = from, nil
+	return ar.Passthrough.MailFrom(from, m)
+}
+
+func (ar *AddressRewriter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	ar.rcpts = append(ar.rcpts, rcptTo)
+	return ar.Passthrough.RcptTo(rcptTo, m)
+}
+
+func (ar *AddressRewriter) Body(m *Modifier) (Response, error) {
+	defer ar.reset()
+	if from, ok := ar.Senders.RewriteAddr(ar.from); ok {
+		if err := m.ChangeFrom(from); err != nil {
+			return nil, err
+		}
+	}
+	for _, rcpt := range ar.rcpts {
+		rewritten, ok := ar.Recipients.RewriteAddr(rcpt)
+		if !ok {
+			continue
+		}
+		// AddRecipient and DeleteRecipient add angle brackets
+		if err := m.DeleteRecipient(strings.Trim(rcpt, "<>")); err != nil {
+			return nil, err
+		}
+		if err := m.AddRecipient(strings.Trim(rewritten, "<>")); err != nil {
+			return nil, err
+		}
+	}
+	return ar.Passthrough.Body(m)
+}
+
+func (ar *AddressRewriter) Abort(m *Modifier) error {
+	ar.reset()
+	return ar.Passthrough.Abort(m)
+}
+
+func (ar *AddressRewriter) reset() {
+	ar.from, ar.rcpts = "", nil
+}
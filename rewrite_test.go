@@ -0,0 +1,76 @@
+package milter
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testDomainMap = DomainMap{
+	"old.example":        "new.example",
+	"*.old.example":      "*.new.example",
+	"*.legacy.example":   "new.example",
+	"x.legacy.example":   "x.example",
+	"*.a.legacy.example": "a.example",
+}
+
+func TestDomainMap_RewriteAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr, rewritten string
+		ok              bool
+	}{
+		{"user@old.example", "user@new.example", true},
+		{"<user@OLD.example>", "<user@new.example>", true},
+		{"user@b.a.old.example", "user@b.a.new.example", true},
+		{"user@b.legacy.example", "user@new.example", true},
+		{"user@x.legacy.example", "user@x.example", true},
+		{"user@b.a.legacy.example", "user@a.example", true},
+		{"user@legacy.example", "user@legacy.example", false},
+		{"user@example.org", "user@example.org", false},
+		{"<>", "<>", false},
+	} {
+		rewritten, ok := testDomainMap.RewriteAddr(tc.addr)
+		if rewritten != tc.rewritten || ok != tc.ok {
+			t.Errorf("RewriteAddr(%q) = %q, %v, want %q, %v", tc.addr, rewritten, ok, tc.rewritten, tc.ok)
+		}
+	}
+}
+
+func TestAddressRewriter(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return &AddressRewriter{
+				Passthrough: Passthrough{NoOpMilter{}},
+				Senders:     testDomainMap,
+				Recipients:  testDomainMap,
+			}
+		},
+		Actions: OptChangeFrom | OptAddRcpt | OptRemoveRcpt,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptChangeFrom | OptAddRcpt | OptRemoveRcpt,
+	})
+	defer session.Close()
+
+	if _, err := session.Mail("from@old.example", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"to1@example.org", "to2@b.old.example"} {
+		if _, err := session.Rcpt(rcpt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := session.EndResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := MessageState{}
+	ApplyModifyActions(&msg, res.ModifyActions)
+	if msg.From != "from@new.example" {
+		t.Fatal("Wrong sender:", msg.From)
+	}
+	if expected := []string{"to1@example.org", "to2@b.new.example"}; !reflect.DeepEqual(res.Recipients, expected) {
+		t.Fatalf("Wrong recipients: %v", res.Recipients)
+	}
+}
@@ -0,0 +1,197 @@
+package milter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Verdict is the result of a content scan.
+type Verdict struct {
+	// Infected is set if the scanner found a threat in the content.
+	Infected bool
+	// Name of the threat, if any.
+	Threat string
+}
+
+// Scanner is implemented by content scanners such as antivirus engines.
+type Scanner interface {
+	ScanReader(ctx context.Context, r io.Reader) (Verdict, error)
+}
+
+// ClamdScanner is a Scanner that submits content to clamd using the INSTREAM
+// command.
+type ClamdScanner struct {
+	// Network and address of the clamd socket, e.g. "unix" and
+	// "/run/clamav/clamd.ctl".
+	Network string
+	Address string
+
+	// Timeout for the whole scan. Zero means no timeout.
+	Timeout time.Duration
+}
+
+var _ Scanner = (*ClamdScanner)(nil)
+
+// ScanReader implements Scanner.
+func (s *ClamdScanner) ScanReader(ctx context.Context, r io.Reader) (Verdict, error) {
+	if s.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("milter: clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return Verdict{}, fmt.Errorf("milter: clamd: %w", err)
+	}
+
+	buf := make([]byte, 4+32*1024)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return Verdict{}, fmt.Errorf("milter: clamd: %w", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Verdict{}, err
+		}
+	}
+	// Zero-length chunk terminates the stream.
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Verdict{}, fmt.Errorf("milter: clamd: %w", err)
+	}
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("milter: clamd: %w", err)
+	}
+	return parseClamdReply(readCString(reply))
+}
+
+func parseClamdReply(reply string) (Verdict, error) {
+	// Replies look like "stream: OK" or "stream: Eicar-Signature FOUND".
+	reply = strings.TrimSpace(reply)
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Verdict{
+			Infected: true,
+			Threat:   strings.TrimSuffix(reply, " FOUND"),
+		}, nil
+	default:
+		return Verdict{}, fmt.Errorf("milter: clamd: unexpected reply: %q", reply)
+	}
+}
+
+// ScanMilter is a Milter that buffers the message and submits it to a Scanner
+// at end of message. Clean messages are passed on to the wrapped Milter.
+type ScanMilter struct {
+	Passthrough
+
+	Scanner Scanner
+
+	// Quarantine infected messages instead of rejecting them.
+	Quarantine bool
+
+	// Maximum size of the buffered message in bytes. Larger messages are
+	// passed on to the wrapped Milter without being scanned. Zero means
+	// 25 MiB, the default stream size limit of clamd.
+	MaxSize int64
+
+	header    bytes.Buffer
+	body      bytes.Buffer
+	oversized bool
+}
+
+var _ Milter = (*ScanMilter)(nil)
+
+func (sm *ScanMilter) maxSize() int64 {
+	if sm.MaxSize == 0 {
+		return 25 * 1024 * 1024
+	}
+	return sm.MaxSize
+}
+
+// buffer appends data to buf, unless the message is too large to be scanned.
+func (sm *ScanMilter) buffer(buf *bytes.Buffer, data string) {
+	if sm.oversized {
+		return
+	}
+	if int64(sm.header.Len()+sm.body.Len()+len(data)) > sm.maxSize() {
+		sm.oversized = true
+		sm.header.Reset()
+		sm.body.Reset()
+		return
+	}
+	buf.WriteString(data)
+}
+
+func (sm *ScanMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	sm.buffer(&sm.header, name+": "+value+"\r\n")
+	return sm.Passthrough.Header(name, value, m)
+}
+
+func (sm *ScanMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	sm.buffer(&sm.body, string(chunk))
+	return sm.Passthrough.BodyChunk(chunk, m)
+}
+
+func (sm *ScanMilter) Body(m *Modifier) (Response, error) {
+	defer sm.reset()
+
+	if sm.oversized {
+		m.Logf("Message larger than %v bytes, not scanned", sm.maxSize())
+		return sm.Passthrough.Body(m)
+	}
+
+	msg := io.MultiReader(&sm.header, strings.NewReader("\r\n"), &sm.body)
+	verdict, err := sm.Scanner.ScanReader(m.Context(), msg)
+	if err != nil {
+		m.Logf("Scan failed: %v", err)
+		return RespTempFail, nil
+	}
+	if verdict.Infected {
+		if !sm.Quarantine {
+			return NewResponseStr(byte(ActReplyCode), "550 5.7.1 Message infected with "+verdict.Threat), nil
+		}
+		if err := m.Quarantine("infected with " + verdict.Threat); err != nil {
+			return nil, err
+		}
+	}
+
+	return sm.Passthrough.Body(m)
+}
+
+func (sm *ScanMilter) Abort(m *Modifier) error {
+	sm.reset()
+	return sm.Passthrough.Abort(m)
+}
+
+func (sm *ScanMilter) reset() {
+	sm.header.Reset()
+	sm.body.Reset()
+	sm.oversized = false
+}
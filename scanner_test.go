@@ -0,0 +1,155 @@
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// startFakeClamd serves the clamd INSTREAM command on a loopback listener,
+// reporting streams containing "EICAR" as infected.
+func startFakeClamd(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeClamd(conn)
+		}
+	}()
+	return ln
+}
+
+func serveFakeClamd(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	if cmd, err := br.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+	var stream bytes.Buffer
+	for {
+		var n uint32
+		if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+			return
+		}
+		if n == 0 {
+			break
+		}
+		if _, err := io.CopyN(&stream, br, int64(n)); err != nil {
+			return
+		}
+	}
+	if strings.Contains(stream.String(), "EICAR") {
+		io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+	} else {
+		io.WriteString(conn, "stream: OK\x00")
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	ln := startFakeClamd(t)
+	defer ln.Close()
+	scanner := &ClamdScanner{Network: "tcp", Address: ln.Addr().String(), Timeout: time.Second}
+
+	verdict, err := scanner.ScanReader(context.Background(), strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Infected {
+		t.Fatal("Clean content reported as infected")
+	}
+
+	verdict, err = scanner.ScanReader(context.Background(), strings.NewReader(strings.Repeat("x", 64*1024)+"EICAR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verdict.Infected || verdict.Threat != "Eicar-Signature" {
+		t.Fatalf("Wrong verdict: %+v", verdict)
+	}
+}
+
+func testScanMilter(t *testing.T, sm *ScanMilter, logger Logger, body string) *Action {
+	t.Helper()
+	s := Server{
+		NewMilter: func() Milter {
+			return sm
+		},
+		Logger: logger,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	var hdr textproto.Header
+	hdr.Add("Subject", "Test")
+	if _, err := session.Header(hdr); err != nil {
+		t.Fatal(err)
+	}
+	_, act, err := session.BodyReadFrom(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return act
+}
+
+func TestScanMilter(t *testing.T) {
+	ln := startFakeClamd(t)
+	defer ln.Close()
+	scanner := &ClamdScanner{Network: "tcp", Address: ln.Addr().String(), Timeout: time.Second}
+
+	act := testScanMilter(t, &ScanMilter{Passthrough: Passthrough{NoOpMilter{}}, Scanner: scanner}, nil, "EICAR")
+	if act.Code != ActReplyCode || act.SMTPCode != 550 {
+		t.Fatalf("Expected rejection, got %+v", act)
+	}
+
+	act = testScanMilter(t, &ScanMilter{Passthrough: Passthrough{NoOpMilter{}}, Scanner: scanner}, nil, "hello")
+	if act.Code != ActAccept {
+		t.Fatalf("Expected accept, got %+v", act)
+	}
+
+	// Oversized messages aren't scanned
+	act = testScanMilter(t, &ScanMilter{Passthrough: Passthrough{NoOpMilter{}}, Scanner: scanner, MaxSize: 16}, nil, "EICAR"+strings.Repeat("x", 32))
+	if act.Code != ActAccept {
+		t.Fatalf("Expected accept, got %+v", act)
+	}
+}
+
+func TestScanMilter_ScannerDown(t *testing.T) {
+	ln := startFakeClamd(t)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var logger testLogger
+	scanner := &ClamdScanner{Network: "tcp", Address: addr, Timeout: time.Second}
+	act := testScanMilter(t, &ScanMilter{Passthrough: Passthrough{NoOpMilter{}}, Scanner: scanner}, &logger, "hello")
+	if act.Code != ActTempFail {
+		t.Fatalf("Expected tempfail, got %+v", act)
+	}
+	found := false
+	for _, msg := range logger.msgs {
+		if strings.Contains(msg, "Scan failed") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Scan failure not logged:", logger.msgs)
+	}
+}
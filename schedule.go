@@ -0,0 +1,110 @@
+package milter
+
+import (
+	"time"
+)
+
+// TimeWindow is a daily time window, such as a backup window. Start and End
+// are offsets from midnight, End being before Start for windows spanning
+// midnight.
+type TimeWindow struct {
+	Start time.Duration
+	End   time.Duration
+
+	// Days the window applies to, according to Start. If empty, every day.
+	Weekdays []time.Weekday
+
+	// Time zone of the window. If nil, the local time zone is used.
+	Location *time.Location
+}
+
+// Contains reports whether t is in the window.
+func (w *TimeWindow) Contains(t time.Time) bool {
+	loc := w.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	offset := t.Sub(midnight)
+
+	day := t.Weekday()
+	if w.End < w.Start {
+		if offset >= w.Start {
+			return w.onDay(day)
+		}
+		// window started the day before
+		return offset < w.End && w.onDay((day+6)%7)
+	}
+	return offset >= w.Start && offset < w.End && w.onDay(day)
+}
+
+func (w *TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range w.Weekdays {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func inWindows(windows []TimeWindow, t time.Time) bool {
+	for i := range windows {
+		if windows[i].Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// WindowCheck returns a ScoreRule check firing during the windows, so that
+// scoring rules can take the time of day into account.
+func WindowCheck(clock Clock, windows ...TimeWindow) func(msg *ScoreMessage) (float64, error) {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return func(msg *ScoreMessage) (float64, error) {
+		if inWindows(windows, clock.Now()) {
+			return 1, nil
+		}
+		return 0, nil
+	}
+}
+
+// WindowMilter is a Milter deferring messages during time windows, for
+// instance low-priority bulk mail during backup windows. Other messages are
+// passed on to the wrapped Milter.
+type WindowMilter struct {
+	Passthrough
+
+	Windows []TimeWindow
+
+	// Match selects the messages to defer by sender. If nil, all messages are
+	// deferred.
+	Match func(from string, m *Modifier) bool
+
+	// Response returned for deferred messages. If nil, RespTempFail is used.
+	Response Response
+
+	// Clock used to check the windows. If nil, the system clock is used.
+	Clock Clock
+}
+
+var _ Milter = (*WindowMilter)(nil)
+
+func (wm *WindowMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	clock := wm.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	if inWindows(wm.Windows, clock.Now()) && (wm.Match == nil || wm.Match(from, m)) {
+		if wm.Response != nil {
+			return wm.Response, nil
+		}
+		return RespTempFail, nil
+	}
+	return wm.Passthrough.MailFrom(from, m)
+}
@@ -0,0 +1,34 @@
+package milter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindow_Contains(t *testing.T) {
+	// 23:00 to 02:00 starting on Saturdays
+	w := TimeWindow{
+		Start:    23 * time.Hour,
+		End:      2 * time.Hour,
+		Weekdays: []time.Weekday{time.Saturday},
+		Location: time.UTC,
+	}
+	for _, tc := range []struct {
+		t        string
+		expected bool
+	}{
+		{"2024-06-01T23:30:00Z", true},  // Saturday
+		{"2024-06-02T01:00:00Z", true},  // Sunday, started on Saturday
+		{"2024-06-02T02:00:00Z", false}, // end
+		{"2024-06-02T23:30:00Z", false}, // Sunday
+		{"2024-06-01T22:59:00Z", false},
+	} {
+		tm, err := time.Parse(time.RFC3339, tc.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Contains(tm); got != tc.expected {
+			t.Errorf("Contains(%v) = %v, expected %v", tc.t, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package milter
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ScoreMessage is the data of a message available to ScoreRules.
+type ScoreMessage struct {
+	Host   string
+	Family string
+	Addr   net.IP
+	Helo   string
+	From   string
+	Rcpts  []string
+	Header textproto.MIMEHeader
+	Macros map[string]string
+}
+
+// ScoreRule is a check contributing to the score of a message.
+type ScoreRule struct {
+	Name string
+	// Weight the result of Check is multiplied by.
+	Weight float64
+	// Check returns the raw score of the message, usually 0 or 1.
+	Check func(msg *ScoreMessage) (float64, error)
+	// Human-readable description of the rule, reported in traces.
+	Description string
+}
+
+// ScoreHit is a rule which contributed to the score of a message.
+type ScoreHit struct {
+	Rule        string
+	Score       float64
+	Description string
+}
+
+// String formats the hit as a trace entry, e.g.
+// "FREEMAIL=1.5: sender uses a free mail provider".
+func (hit ScoreHit) String() string {
+	s := hit.Rule + "=" + formatFloat(hit.Score)
+	if hit.Description != "" {
+		s += ": " + hit.Description
+	}
+	return s
+}
+
+// ScoreMilter is a Milter evaluating weighted rules at end of message. The
+// total score is compared to thresholds to tag, quarantine or reject the
+// message. Messages which are not rejected are passed on to the wrapped
+// Milter.
+//
+// The score is added to messages in the ScoreHeader field, which requires
+// the OptAddHeader action. Quarantine requires OptQuarantine.
+type ScoreMilter struct {
+	Passthrough
+
+	Rules []ScoreRule
+
+	// Thresholds at which the message is tagged with an "X-Spam-Flag: YES"
+	// header field, quarantined or rejected. Zero disables the action.
+	TagScore        float64
+	QuarantineScore float64
+	RejectScore     float64
+
+	// Header field carrying the score. Defaults to "X-Milter-Score".
+	ScoreHeader string
+
+	// Trace enables the TraceHeader field, explaining which rules fired and
+	// why. It can also be enabled per message by the MTA by sending the
+	// macro named TraceMacro with a non-empty value.
+	Trace      bool
+	TraceMacro string
+
+	msg ScoreMessage
+}
+
+var _ Milter = (*ScoreMilter)(nil)
+
+func (sm *ScoreMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	sm.msg.Host = host
+	sm.msg.Family = family
+	sm.msg.Addr = addr
+	return sm.Passthrough.Connect(host, family, port, addr, m)
+}
+
+func (sm *ScoreMilter) Helo(name string, m *Modifier) (Response, error) {
+	sm.msg.Helo = name
+	return sm.Passthrough.Helo(name, m)
+}
+
+func (sm *ScoreMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	sm.msg.From = from
+	return sm.Passthrough.MailFrom(from, m)
+}
+
+func (sm *ScoreMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	sm.msg.Rcpts = append(sm.msg.Rcpts, rcptTo)
+	return sm.Passthrough.RcptTo(rcptTo, m)
+}
+
+// Score evaluates the rules against msg and returns the total score and
+// the rules which contributed to it.
+func (sm *ScoreMilter) Score(msg *ScoreMessage) (float64, []ScoreHit, error) {
+	var total float64
+	var hits []ScoreHit
+	for _, rule := range sm.Rules {
+		v, err := rule.Check(msg)
+		if err != nil {
+			return 0, nil, fmt.Errorf("milter: score: rule %v: %w", rule.Name, err)
+		}
+		if v == 0 {
+			continue
+		}
+		score := v * rule.Weight
+		total += score
+		hits = append(hits, ScoreHit{Rule: rule.Name, Score: score, Description: rule.Description})
+	}
+	return total, hits, nil
+}
+
+func (sm *ScoreMilter) Body(m *Modifier) (Response, error) {
+	defer sm.resetMessage()
+
+	sm.msg.Header = m.Headers
+	sm.msg.Macros = m.Macros
+	score, hits, err := sm.Score(&sm.msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if sm.RejectScore != 0 && score >= sm.RejectScore {
+		return NewResponseStr(byte(ActReplyCode), "550 5.7.1 Message rejected by policy"), nil
+	}
+
+	if len(hits) > 0 && (sm.Trace || (sm.TraceMacro != "" && m.Macros[sm.TraceMacro] != "")) {
+		if err := m.AddHeader(TraceHeader, formatTrace(hits)); err != nil {
+			return nil, err
+		}
+	}
+
+	headerName := sm.ScoreHeader
+	if headerName == "" {
+		headerName = "X-Milter-Score"
+	}
+	if err := m.AddHeader(headerName, formatScore(score, hits)); err != nil {
+		return nil, err
+	}
+	if sm.TagScore != 0 && score >= sm.TagScore {
+		if err := m.AddHeader("X-Spam-Flag", "YES"); err != nil {
+			return nil, err
+		}
+	}
+	if sm.QuarantineScore != 0 && score >= sm.QuarantineScore {
+		if err := m.Quarantine("score " + formatFloat(score)); err != nil {
+			return nil, err
+		}
+	}
+
+	return sm.Passthrough.Body(m)
+}
+
+func (sm *ScoreMilter) Abort(m *Modifier) error {
+	sm.resetMessage()
+	return sm.Passthrough.Abort(m)
+}
+
+func (sm *ScoreMilter) resetMessage() {
+	sm.msg.From = ""
+	sm.msg.Rcpts = nil
+	sm.msg.Header = nil
+	sm.msg.Macros = nil
+}
+
+// formatScore formats the score header field value, e.g.
+// "7.5 (FOO=5, BAR=2.5)".
+func formatScore(score float64, hits []ScoreHit) string {
+	var sb strings.Builder
+	sb.WriteString(formatFloat(score))
+	if len(hits) > 0 {
+		sb.WriteString(" (")
+		for i, hit := range hits {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(hit.Rule + "=" + formatFloat(hit.Score))
+		}
+		sb.WriteString(")")
+	}
+	return sb.String()
+}
+
+func formatTrace(hits []ScoreHit) string {
+	entries := make([]string, len(hits))
+	for i, hit := range hits {
+		entries[i] = hit.String()
+	}
+	return strings.Join(entries, "; ")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,108 @@
+package milter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScoreMilter(t *testing.T) {
+	rules := []ScoreRule{
+		{Name: "FREEMAIL", Weight: 1.5, Check: func(msg *ScoreMessage) (float64, error) {
+			if strings.HasSuffix(msg.From, "@example.com") {
+				return 1, nil
+			}
+			return 0, nil
+		}},
+		{Name: "MANY_RCPTS", Weight: 4, Check: func(msg *ScoreMessage) (float64, error) {
+			if len(msg.Rcpts) > 1 {
+				return 1, nil
+			}
+			return 0, nil
+		}},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &ScoreMilter{
+				Passthrough: Passthrough{NoOpMilter{}},
+				Rules:       rules,
+				TagScore:    1,
+				RejectScore: 5,
+			}
+		},
+		Actions: OptAddHeader,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptAddHeader,
+	})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Rcpt("to@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	modifyActs, act, err := session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActAccept {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	if len(modifyActs) != 2 || modifyActs[0].HeaderValue != "1.5 (FREEMAIL=1.5)" || modifyActs[1].HeaderName != "X-Spam-Flag" {
+		t.Fatalf("Wrong modify actions: %+v", modifyActs)
+	}
+
+	if _, err := session.Mail("from@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"to1@example.org", "to2@example.org"} {
+		if _, err := session.Rcpt(rcpt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, act, err = session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActReplyCode || act.SMTPCode != 550 {
+		t.Fatal("Unexpected action:", act)
+	}
+}
+
+func TestScoreMilter_Trace(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return &ScoreMilter{
+				Passthrough: Passthrough{NoOpMilter{}},
+				Rules: []ScoreRule{{
+					Name:        "ALWAYS",
+					Weight:      2,
+					Description: "always fires",
+					Check: func(msg *ScoreMessage) (float64, error) {
+						return 1, nil
+					},
+				}},
+				TraceMacro: "{milter_debug}",
+			}
+		},
+		Actions: OptAddHeader,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptAddHeader,
+	})
+	defer session.Close()
+
+	if err := session.Macros(CodeEOB, "{milter_debug}", "1"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := session.EndResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace := res.Trace(); len(trace) != 1 || trace[0] != "ALWAYS=2: always fires" {
+		t.Fatalf("Wrong trace: %q", trace)
+	}
+}
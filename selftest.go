@@ -0,0 +1,91 @@
+package milter
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// pipeDialer is a Dialer returning a pre-established connection.
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+// SelfTest runs a complete transaction through the Milter configured on the
+// server, using an in-memory connection between the package's client and a
+// server session. It returns an error if the transaction could not be
+// completed, which makes it suitable to back health checks and readiness
+// probes of filter daemons. Any decision made by the filter, including a
+// rejection, is considered a success. The transaction is not reported to
+// Server.Audit, Server.SessionStore and Server.ConnState.
+//
+// timeout limits the duration of each step of the transaction.
+func (s *Server) SelfTest(timeout time.Duration) error {
+	serverConn, clientConn := net.Pipe()
+	session := s.newSession(serverConn, nil)
+	session.selfTest = true
+	go session.HandleMilterCommands()
+	factory := session.factory
+
+	c := NewClientWithOptions("pipe", "selftest", ClientOptions{
+		Dialer:       pipeDialer{clientConn},
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		ActionMask:   factory.Actions,
+		ProtocolMask: factory.Protocol,
+		Handshake:    s.Handshake,
+	})
+	defer c.Close()
+
+	cs, err := c.Session()
+	if err != nil {
+		clientConn.Close()
+		return fmt.Errorf("milter: self-test: %w", err)
+	}
+	defer cs.Close()
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<selftest@localhost>")
+	hdr.Add("To", "<selftest@localhost>")
+	hdr.Add("Subject", "milter self-test")
+
+	steps := []func() (*Action, error){
+		func() (*Action, error) {
+			return cs.Conn("localhost", FamilyInet, 25, "127.0.0.1")
+		},
+		func() (*Action, error) {
+			return cs.Helo("localhost")
+		},
+		func() (*Action, error) {
+			return cs.Mail("selftest@localhost", nil)
+		},
+		func() (*Action, error) {
+			return cs.Rcpt("selftest@localhost", nil)
+		},
+		func() (*Action, error) {
+			return cs.Header(hdr)
+		},
+		func() (*Action, error) {
+			_, act, err := cs.BodyReadFrom(bytes.NewReader([]byte("milter self-test\r\n")))
+			return act, err
+		},
+	}
+	for _, step := range steps {
+		act, err := step()
+		if err != nil {
+			return fmt.Errorf("milter: self-test: %w", err)
+		}
+		if act.Code != ActContinue {
+			break
+		}
+	}
+
+	return nil
+}
@@ -1,65 +1,179 @@
 package milter
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"hash"
+	"log"
 	"net"
 	"net/textproto"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	msgtextproto "github.com/emersion/go-message/textproto"
 )
 
 // Milter protocol version implemented by the server.
 //
 // Note: Not exported as we might want to support multiple versions
 // transparently in the future.
-var serverProtocolVersion uint32 = 2
+var serverProtocolVersion uint32 = 6
+
+// Default timeout for reads and writes, as in libmilter.
+const defaultTimeout = 7210 * time.Second
+
+// Lowest milter protocol version accepted by the server.
+const minProtocolVersion = 2
+
+// Actions and protocol options available before protocol version 6.
+const (
+	v2ActionMask   OptAction   = 0x3f
+	v2ProtocolMask OptProtocol = 0x7f
+)
 
 // ErrServerClosed is returned by the Server's Serve method after a call to
 // Close.
 var ErrServerClosed = errors.New("milter: server closed")
 
+// ErrListenerClosed is returned by the Server's Serve method after a call to
+// CloseListener.
+var ErrListenerClosed = errors.New("milter: listener closed")
+
 // Milter is an interface for milter callback handlers.
+//
+// Only the end of message callback is required. A Milter may implement the
+// handler interfaces of the other stages, such as ConnectHandler or
+// RcptHandler; the stages it doesn't handle are continued automatically.
 type Milter interface {
-	// Connect is called to provide SMTP connection data for incoming message.
-	// Suppress with OptNoConnect.
+	// Body is called at the end of each message. All changes to message's
+	// content & attributes must be done here.
+	Body(m *Modifier) (Response, error)
+}
+
+// ConnectHandler may be implemented by a Milter to be provided SMTP
+// connection data for incoming message. Suppress with OptNoConnect.
+type ConnectHandler interface {
 	Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error)
+}
 
-	// Helo is called to process any HELO/EHLO related filters. Suppress with
-	// OptNoHelo.
+// HeloHandler may be implemented by a Milter to process any HELO/EHLO related
+// filters. Suppress with OptNoHelo.
+type HeloHandler interface {
 	Helo(name string, m *Modifier) (Response, error)
+}
 
-	// MailFrom is called to process filters on envelope FROM address. Suppress
-	// with OptNoMailFrom.
+// MailHandler may be implemented by a Milter to process filters on envelope
+// FROM address. Suppress with OptNoMailFrom.
+type MailHandler interface {
 	MailFrom(from string, m *Modifier) (Response, error)
+}
 
-	// RcptTo is called to process filters on envelope TO address. Suppress with
-	// OptNoRcptTo.
+// RcptHandler may be implemented by a Milter to process filters on envelope
+// TO address. Suppress with OptNoRcptTo.
+type RcptHandler interface {
 	RcptTo(rcptTo string, m *Modifier) (Response, error)
+}
 
-	// Header is called once for each header in incoming message. Suppress with
-	// OptNoHeaders.
+// DataHandler may be implemented by a Milter to be notified of the DATA
+// command, once all recipients are known. Suppress with OptNoData.
+type DataHandler interface {
+	Data(m *Modifier) (Response, error)
+}
+
+// HeaderHandler may be implemented by a Milter to be called once for each
+// header in incoming message. Suppress with OptNoHeaders.
+type HeaderHandler interface {
 	Header(name string, value string, m *Modifier) (Response, error)
+}
 
-	// Headers is called when all message headers have been processed. Suppress
-	// with OptNoEOH.
+// HeadersHandler may be implemented by a Milter to be called when all message
+// headers have been processed. Suppress with OptNoEOH.
+type HeadersHandler interface {
 	Headers(h textproto.MIMEHeader, m *Modifier) (Response, error)
+}
 
-	// BodyChunk is called to process next message body chunk data (up to 64KB
-	// in size). Suppress with OptNoBody.
-	BodyChunk(chunk []byte, m *Modifier) (Response, error)
+// OrderedHeadersHandler may be implemented by a Milter to be called when all
+// message headers have been processed, with the header fields in the order
+// they were received and with their original casing, as needed e.g. to sign
+// a message with DKIM: the Raw method of the fields returned by h.Fields
+// gives the field as sent by the MTA. It is called instead of
+// HeadersHandler. Suppress with OptNoEOH.
+type OrderedHeadersHandler interface {
+	OrderedHeaders(h msgtextproto.Header, m *Modifier) (Response, error)
+}
 
-	// Body is called at the end of each message. All changes to message's
-	// content & attributes must be done here.
-	Body(m *Modifier) (Response, error)
+// BodyChunkHandler may be implemented by a Milter to process next message
+// body chunk data (up to 64KB in size). Suppress with OptNoBody. RespSkip can
+// be returned to skip the remaining chunks.
+type BodyChunkHandler interface {
+	BodyChunk(chunk []byte, m *Modifier) (Response, error)
+}
 
-	// Abort is called is the current message has been aborted. All message data
-	// should be reset to prior to the Helo callback. Connection data should be
-	// preserved.
+// AbortHandler may be implemented by a Milter to be notified that the current
+// message has been aborted. All message data should be reset to prior to the
+// Helo callback. Connection data should be preserved.
+type AbortHandler interface {
 	Abort(m *Modifier) error
 }
 
+// MacrosHandler may be implemented by a Milter to be passed the macros sent
+// by the MTA before the command of stage, as received, in addition to the
+// merged view provided by Modifier.Macros. The map is a copy and may be
+// retained.
+type MacrosHandler interface {
+	Macros(stage Code, macros map[string]string) error
+}
+
+// UnknownHandler may be implemented by a Milter to process SMTP commands not
+// recognized by the MTA, such as unusual verbs forwarded by Postfix. Suppress
+// with OptNoUnknown.
+type UnknownHandler interface {
+	Unknown(cmd string, m *Modifier) (Response, error)
+}
+
+// Recipient is an envelope recipient of a message.
+type Recipient struct {
+	Addr string
+	Args ESMTPArgs
+}
+
+// RcptBatcher may be implemented by a Milter to receive all recipients of a
+// message in a single call instead of one RcptTo call per recipient, which is
+// cheaper for bulk mail with many recipients. RcptBatch is called once the
+// last recipient has been received, before the message data. total is the
+// number of recipients, which is greater than len(rcpts) if the list was
+// capped by Server.MaxRecipients.
+type RcptBatcher interface {
+	RcptBatch(rcpts []Recipient, total int, m *Modifier) (Response, error)
+}
+
+// Negotiator may be implemented by a Milter to choose the actions and
+// protocol options requested for a connection, depending on what the MTA
+// offers, instead of Server.Actions and Server.Protocol. The result is still
+// masked with what the MTA offers. Returning an error closes the connection.
+type Negotiator interface {
+	Negotiate(mtaVersion uint32, mtaActions OptAction, mtaProto OptProtocol) (OptAction, OptProtocol, error)
+}
+
 // NoOpMilter is a dummy Milter implementation that does nothing.
 type NoOpMilter struct{}
 
-var _ Milter = NoOpMilter{}
+var (
+	_ Milter           = NoOpMilter{}
+	_ ConnectHandler   = NoOpMilter{}
+	_ HeloHandler      = NoOpMilter{}
+	_ MailHandler      = NoOpMilter{}
+	_ RcptHandler      = NoOpMilter{}
+	_ DataHandler      = NoOpMilter{}
+	_ HeaderHandler    = NoOpMilter{}
+	_ HeadersHandler   = NoOpMilter{}
+	_ BodyChunkHandler = NoOpMilter{}
+	_ AbortHandler     = NoOpMilter{}
+	_ UnknownHandler   = NoOpMilter{}
+)
 
 func (NoOpMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
 	return RespContinue, nil
@@ -77,6 +191,10 @@ func (NoOpMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
 	return RespContinue, nil
 }
 
+func (NoOpMilter) Data(m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
 func (NoOpMilter) Header(name string, value string, m *Modifier) (Response, error) {
 	return RespContinue, nil
 }
@@ -97,48 +215,621 @@ func (NoOpMilter) Abort(m *Modifier) error {
 	return nil
 }
 
+func (NoOpMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+// AcceptLimiter limits the rate at which a server accepts connections. It is
+// implemented by golang.org/x/time/rate.Limiter.
+type AcceptLimiter interface {
+	// Wait blocks until a new connection can be accepted. It returns an
+	// error if ctx is cancelled, which happens when the server is closed.
+	Wait(ctx context.Context) error
+}
+
+// ErrorPolicy defines how a server handles errors returned by Milter
+// callbacks.
+type ErrorPolicy int
+
+const (
+	// ErrorCloseConn closes the connection. The MTA handles the failure as
+	// configured, e.g. with the default_action of Postfix or the F flag of
+	// sendmail.
+	ErrorCloseConn ErrorPolicy = iota
+	// ErrorTempFail logs the error and responds with RespTempFail.
+	ErrorTempFail
+	// ErrorReject logs the error and responds with RespReject.
+	ErrorReject
+	// ErrorAcceptAndLog logs the error and responds with RespAccept, so that
+	// mail keeps flowing while the filter is broken.
+	ErrorAcceptAndLog
+)
+
+func (p ErrorPolicy) String() string {
+	switch p {
+	case ErrorCloseConn:
+		return "close"
+	case ErrorTempFail:
+		return "tempfail"
+	case ErrorReject:
+		return "reject"
+	case ErrorAcceptAndLog:
+		return "accept"
+	}
+	return fmt.Sprintf("ErrorPolicy(%d)", int(p))
+}
+
 // Server is a milter server.
 type Server struct {
 	NewMilter func() Milter
-	Actions   OptAction
-	Protocol  OptProtocol
+	// NewMilterWithConn, if set, is used instead of NewMilter to create the
+	// Milter of new connections and messages. It receives information about
+	// the MTA connection, so that a server can tell upstreams apart.
+	NewMilterWithConn func(conn ConnInfo) Milter
+	Actions           OptAction
+	Protocol          OptProtocol
+	// The fields above must not be changed once the server is started, use
+	// SetMilterFactory instead.
+
+	// MacroRequests lists the macros the server wants the MTA to send for each
+	// stage, keyed by CodeConn, CodeHelo, CodeMail, CodeRcpt, CodeData,
+	// CodeEOH or CodeEOB. If non-empty, OptSetSymList is requested during
+	// negotiation and the MTA only sends the listed macros.
+	MacroRequests map[Code][]string
+
+	// Negotiate, if set, chooses the protocol version, actions, protocol
+	// options and macros requested for a connection, depending on what the
+	// MTA offers, e.g. to enable body callbacks only for some listeners. It
+	// is used instead of Actions, Protocol, MacroRequests and Negotiator.
+	// Returning an error closes the connection.
+	Negotiate func(offer NegotiationOffer) (NegotiationReply, error)
+
+	// Enrichers are invoked when the MTA reports a new SMTP connection, their
+	// results are exposed as pseudo-macros in Modifier.Macros.
+	Enrichers []Enricher
+
+	// BodyHashes lists hash functions computed over the message body as it is
+	// streamed by the MTA, keyed by name. The resulting values are available
+	// at end of message via Modifier.BodyHash, so filters don't need to buffer
+	// the body themselves. Any hash.Hash implementation can be used, including
+	// fuzzy hashes such as ssdeep.
+	BodyHashes map[string]func() hash.Hash
+
+	// UnixSocketMode is the file mode set on unix sockets created by
+	// ListenAndServe. Zero leaves the mode set by the umask.
+	UnixSocketMode os.FileMode
+	// UnixSocketOwner and UnixSocketGroup are the user and group, as names
+	// or numeric IDs, set on unix sockets created by ListenAndServe, e.g. to
+	// give access to the MTA only. Empty leaves them unchanged.
+	UnixSocketOwner string
+	UnixSocketGroup string
+
+	// TempDir is the directory of the temporary files allocated with
+	// Modifier.TempFile. If empty, the default directory for temporary files
+	// is used.
+	TempDir string
+	// TempQuota caps the total size in bytes of the temporary files of a
+	// message. Zero means no limit.
+	TempQuota int64
+
+	// BufferBody, if set, makes the server buffer the body of messages, so
+	// that Modifier.BodyReader can be used at end of message instead of
+	// accumulating body chunks. Up to BodyMemoryLimit bytes are kept in
+	// memory, larger bodies are spilled to a temporary file in TempDir,
+	// counted in TempQuota. Zero means 1 MiB.
+	BufferBody      bool
+	BodyMemoryLimit int
+
+	// ErrorHook, if set, is called with errors terminating a session and
+	// errors of Milter callbacks handled by OnError, as a *MilterError.
+	// Failures to write to the MTA are wrapped *WriteError and panics in
+	// Milter callbacks are wrapped *PanicError.
+	ErrorHook func(err error)
+
+	// ConnState, if set, is called when a connection changes state, from the
+	// session goroutine. It can be used to track connections or enforce
+	// quotas without wrapping the listener.
+	ConnState func(conn ConnInfo, state ConnState)
+
+	// OnUnknownMessage, if set, is called with the commands the server doesn't
+	// know instead of closing the connection, e.g. to handle vendor extensions
+	// or commands of newer protocol versions. If the returned Response is
+	// nil, no response is sent. Use HandleRaw to override known commands.
+	OnUnknownMessage func(msg *Message) (Response, error)
+
+	// StrictProtocol, if set, makes the server validate the order of the
+	// commands sent by the MTA, e.g. that no header is sent after the end of
+	// headers. Commands out of order are not processed: they are reported to
+	// ErrorHook as *ProtocolError and handled as configured by
+	// ProtocolViolation, by default by closing the connection.
+	StrictProtocol    bool
+	ProtocolViolation ErrorPolicy
+
+	// OnError defines how errors returned by Milter callbacks are handled.
+	// A response whose SMTP reply doesn't match its action, e.g. a 2xx code
+	// or a 4xx code with ActReject, is handled as an error wrapping
+	// ErrInvalidReply. By default, the connection is closed.
+	OnError ErrorPolicy
+
+	// PanicResponse is sent to the MTA when a Milter callback panics, before
+	// the connection is closed. The server keeps running. If nil,
+	// RespTempFail is used.
+	PanicResponse Response
+
+	// MaxRecipients caps the number of recipients tracked per message,
+	// passed to RcptBatcher.RcptBatch and saved by SessionStore. Zero means
+	// no limit.
+	MaxRecipients int
+
+	// MaxSessionMemory, if set, is the approximate size in bytes of the state
+	// buffered by a session, such as header fields, macros and recipients,
+	// above which the session is recycled: the connection is closed once the
+	// current message is done, so that the MTA opens a new one. This keeps
+	// the memory usage of long-running connections predictable. Zero means
+	// no limit.
+	MaxSessionMemory int
+
+	// MaxMessagesPerConn, if set, is the number of messages processed on a
+	// connection after which new messages are answered with a temporary
+	// failure, or the connection is closed if OptNoMailReply was negotiated.
+	// The connection is closed instead of being reused for a new SMTP
+	// connection (CodeQuitNewConn), so that the MTA opens a new one and the
+	// load is rebalanced across instances of the filter. Zero means no limit.
+	MaxMessagesPerConn int
+
+	// ReadTimeout is the maximum time to wait for a command from the MTA
+	// while a message is in progress. IdleTimeout is the maximum time to wait
+	// for a command between messages. WriteTimeout is the maximum time to
+	// write a response. If zero, the libmilter default of 7210 seconds is used.
+	// A negative value disables the timeout.
+	ReadTimeout  time.Duration
+	IdleTimeout  time.Duration
+	WriteTimeout time.Duration
+	// CommandTimeout limits the time a Milter callback is expected to spend
+	// processing a single command: the context returned by Modifier.Context
+	// is cancelled once it expires. Zero means no limit.
+	CommandTimeout time.Duration
+
+	// MaxConnections limits the number of connections served concurrently.
+	// Zero means no limit. Once the limit is reached, new connections wait up
+	// to MaxConnectionsWait for a slot before being closed. OnConnectionLimit,
+	// if set, is called with connections closed because of the limit.
+	MaxConnections     int
+	MaxConnectionsWait time.Duration
+	OnConnectionLimit  func(conn net.Conn)
+
+	// Workers, if positive, limits the number of Milter callbacks running
+	// concurrently, for filters doing expensive work. Commands wait for a
+	// worker in a queue of up to WorkerQueue commands; once the queue is
+	// full, RespTempFail is sent without running the callback. Aborts always
+	// wait for a worker.
+	Workers     int
+	WorkerQueue int
+
+	// LoadShedder, if set, refuses new messages with a temporary failure
+	// while the filter is overloaded.
+	LoadShedder *LoadShedder
+
+	// AcceptLimiter, if set, limits the rate at which connections are
+	// accepted.
+	AcceptLimiter AcceptLimiter
+
+	// MinVersion is the minimum protocol version the MTA must support. Zero
+	// means any version.
+	MinVersion uint32
+	// RequiredActions lists actions the MTA must offer. Connections not
+	// satisfying MinVersion or RequiredActions are closed during negotiation.
+	RequiredActions OptAction
+
+	// ModifyBatchSize enables batching of the modification actions written at
+	// end of message. Actions are buffered and flushed every ModifyBatchSize
+	// actions, each batch being followed by a progress packet, so that
+	// filters emitting hundreds of modifications don't trip the MTA's
+	// end-of-message timeout. Zero disables batching.
+	ModifyBatchSize int
+	// ModifyBatchDelay is the pause between two batches of modification
+	// actions, to pace writes on slow links.
+	ModifyBatchDelay time.Duration
+
+	// ProgressInterval, if positive, makes the server send a progress packet
+	// every ProgressInterval while the end of message callback runs, so that
+	// slow filters don't trip the MTA's end-of-message timeout. Progress
+	// packets are never interleaved with the modification actions written
+	// by the callback.
+	ProgressInterval time.Duration
+
+	// ModifyFailResponse, if set, enables soft-fail for modification actions
+	// written at end of message. If writing an action fails before anything
+	// was sent, the error is logged, the remaining actions are abandoned and
+	// ModifyFailResponse, e.g. RespAccept or RespTempFail, is sent instead of
+	// the response of the filter. By default, or if the stream is out of
+	// sync, the connection is closed.
+	ModifyFailResponse Response
+
+	// BufferModifications makes Modifier queue the modifications made by
+	// callbacks at any stage instead of rejecting those made before end of
+	// message with *StageError. They are sent once Body returns, right
+	// before its response, without the redundant ones: only the last sender
+	// change, quarantine reason, change of a given header field and addition
+	// or deletion of a given recipient are kept. Modifier then
+	// only fails on invalid arguments, write errors are handled as without
+	// buffering, see ModifyFailResponse.
+	BufferModifications bool
+
+	// ActionWriter, if set, wraps the writer of the modification actions of
+	// each Modifier, e.g. to count or log them.
+	ActionWriter func(w ActionWriter) ActionWriter
+
+	// AllowInvalidHeaderNames disables the validation of header field names
+	// passed to Modifier. By default, names containing characters other than
+	// printable US-ASCII or a colon are rejected with ErrInvalidHeaderName.
+	AllowInvalidHeaderNames bool
+
+	// NULPolicy controls how strings with embedded or missing NUL characters
+	// received from the MTA are handled.
+	NULPolicy NULPolicy
+
+	// MaxPacketSize is the maximum size in bytes of packets accepted from the
+	// MTA. Sessions receiving larger packets are closed and
+	// *PacketSizeError is reported to ErrorHook. Zero means 1 MiB, a
+	// negative value disables the limit.
+	MaxPacketSize int
+
+	// AllowedPeers, if set, restricts the MTAs allowed to connect. Other
+	// connections are closed before negotiation. SelfTest is not affected.
+	AllowedPeers *AllowedPeers
+
+	// Handshake, if set, is performed on accepted connections before milter
+	// negotiation. Connections failing it are closed.
+	Handshake Handshake
+
+	// SessionStore, if set, receives checkpoints of the sessions, so that
+	// interrupted sessions can be identified after a restart.
+	SessionStore SessionStore
 
-	listeners []net.Listener
-	closed    bool
+	// Logger, if set, receives the log messages about sessions. If nil, the
+	// standard logger is used. Use &QueueIDLogger{} to prefix messages with
+	// the queue ID of the current message.
+	Logger Logger
+
+	// Tracer, if set, is used to create tracing spans for sessions.
+	Tracer Tracer
+
+	// Name identifies the filter, e.g. in audit records.
+	Name string
+	// Audit, if set, receives a record of the actions and modifications sent
+	// to the MTA for each message.
+	Audit AuditSink
+
+	// ProfilerLabels, if set, attaches runtime/pprof labels to the
+	// goroutines of sessions: the session ID ("milter.session_id"), the
+	// address of the MTA ("milter.peer") and the stage of the command being
+	// processed ("milter.stage"), so that CPU and heap profiles can be
+	// attributed to MTAs and stages.
+	ProfilerLabels bool
+
+	// IDGenerator is used to generate session identifiers. If nil, random
+	// identifiers are used.
+	IDGenerator IDGenerator
+
+	// Clock is used to timestamp sessions. If nil, the system clock is used.
+	Clock Clock
+
+	rawHandlers map[Code]RawHandler
+	factory     atomic.Value // *sessionFactory
+
+	draining int32
+
+	mu           sync.Mutex
+	listeners    []*serverListener
+	closed       bool
+	sessions     map[*milterSession]struct{}
+	shuttingDown int32
+	ctx          context.Context
+	cancel       context.CancelFunc
+	connSem      chan struct{}
+	pool         *workerPool
 }
 
-// Serve starts the server.
+// Serve accepts connections on ln and serves milter sessions. It can be
+// called concurrently to serve several listeners, e.g. a TCP and a unix
+// socket.
 func (s *Server) Serve(ln net.Listener) error {
 	defer ln.Close()
 
-	s.listeners = append(s.listeners, ln)
+	sl := s.addListener(ln)
+	if sl == nil {
+		return ErrServerClosed
+	}
+	defer s.removeListener(sl)
 
+	var tempDelay time.Duration
 	for {
+		if s.AcceptLimiter != nil {
+			if err := s.AcceptLimiter.Wait(s.baseContext()); err != nil {
+				if closedErr := s.listenerClosed(sl); closedErr != nil {
+					return closedErr
+				}
+				return err
+			}
+		}
+
 		conn, err := ln.Accept()
 		if err != nil {
-			if s.closed {
-				return ErrServerClosed
+			if closedErr := s.listenerClosed(sl); closedErr != nil {
+				return closedErr
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// e.g. EMFILE, retry with exponential backoff
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				s.logf("Error accepting connection: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
 			}
 			return err
 		}
+		tempDelay = 0
+
+		if !s.acquireConn() {
+			if s.OnConnectionLimit != nil {
+				s.OnConnectionLimit(conn)
+			}
+			conn.Close()
+			continue
+		}
+
+		session := s.newSession(conn, ln)
+		s.trackSession(session, true)
+		go func() {
+			defer s.releaseConn()
+			defer s.trackSession(session, false)
+			session.HandleMilterCommands()
+		}()
+	}
+}
+
+// acquireConn reserves a slot for a new connection if MaxConnections is set,
+// waiting up to MaxConnectionsWait. It reports whether a slot was reserved.
+func (s *Server) acquireConn() bool {
+	if s.MaxConnections <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	if s.connSem == nil {
+		s.connSem = make(chan struct{}, s.MaxConnections)
+	}
+	sem := s.connSem
+	s.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+	if s.MaxConnectionsWait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(s.MaxConnectionsWait)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *Server) releaseConn() {
+	if s.MaxConnections > 0 {
+		<-s.connSem
+	}
+}
+
+// newSession creates the state of a session served over conn, accepted by ln
+func (s *Server) newSession(conn net.Conn, ln net.Listener) *milterSession {
+	info := newConnInfo(conn, ln)
+	factory := s.milterFactory()
+	connCtx, connCancel := context.WithCancel(s.baseContext())
+	m := &milterSession{
+		connCtx:    connCtx,
+		connCancel: connCancel,
+
+		id:       s.newID(),
+		start:    s.now(),
+		server:   s,
+		factory:  factory,
+		actions:  factory.Actions,
+		protocol: factory.Protocol,
+		conn:     &watchConn{Conn: conn},
+
+		nulPolicy:   s.NULPolicy,
+		connInfo:    info,
+		backend:     factory.NewMilter(info),
+		hasher:      newBodyHasher(s.BodyHashes),
+		eomBodySize: -1,
+		tempFiles:   newTempFiles(s.TempDir, s.TempQuota),
+
+		sessionValues: &Values{},
+		messageValues: &Values{},
+	}
+	if s.BufferBody {
+		m.body = newBodyBuffer(s.BodyMemoryLimit, m.tempFiles)
+	}
+	if s.BufferModifications {
+		m.modQueue = &modQueue{}
+	}
+	return m
+}
+
+// baseContext returns the context the session contexts are derived from. It
+// is cancelled when the server is closed.
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+// cancelSessions cancels the contexts of all sessions.
+func (s *Server) cancelSessions() {
+	s.baseContext()
+	s.cancel()
+}
 
-		session := milterSession{
-			server:   s,
-			actions:  s.Actions,
-			protocol: s.Protocol,
-			conn:     conn,
-			backend:  s.NewMilter(),
+func (s *Server) trackSession(session *milterSession, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.sessions == nil {
+			s.sessions = make(map[*milterSession]struct{})
 		}
-		go session.HandleMilterCommands()
+		s.sessions[session] = struct{}{}
+	} else {
+		delete(s.sessions, session)
 	}
 }
 
+// closeIdleSessions closes the connections of sessions not processing a
+// message, or all connections if force is set. It reports whether no session
+// is left.
+func (s *Server) closeIdleSessions(force bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for session := range s.sessions {
+		if force || !session.inMessage() {
+			session.conn.Close()
+		}
+	}
+	return len(s.sessions) == 0
+}
+
+func (s *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) != 0
+}
+
+// shutdownPollInterval is how often Shutdown checks for idle sessions.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown gracefully shuts down the server without interrupting messages in
+// progress. It closes all listeners, then closes connections as soon as they
+// are not processing a message (after end of message, abort or quit) and
+// waits for all of them to be closed.
+//
+// If ctx expires first, the remaining connections are closed and the
+// context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	err := s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleSessions(false) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.cancelSessions()
+			s.closeIdleSessions(true)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes all listeners and cancels the contexts of the sessions in
+// progress, see Modifier.Context.
 func (s *Server) Close() error {
+	s.cancelSessions()
+	return s.closeListeners()
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.closed = true
-	for _, ln := range s.listeners {
-		if err := ln.Close(); err != nil {
-			return err
+	var err error
+	for _, sl := range s.listeners {
+		if closeErr := sl.Close(); closeErr != nil && err == nil {
+			err = closeErr
 		}
 	}
-	return nil
+	return err
+}
+
+// RawHandler processes a raw milter command. If the returned Response is nil,
+// no response is sent to the MTA.
+type RawHandler func(msg *Message, m *Modifier) (Response, error)
+
+// HandleRaw registers a handler for the specified command code, bypassing the
+// Milter interface and the built-in processing of the command. This is an
+// escape hatch to implement experimental or MTA-specific extensions.
+//
+// HandleRaw must be called before Serve.
+func (s *Server) HandleRaw(code Code, h RawHandler) {
+	if s.rawHandlers == nil {
+		s.rawHandlers = make(map[Code]RawHandler)
+	}
+	s.rawHandlers[code] = h
+}
+
+// timeout returns the effective value of a timeout option
+func timeout(d time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return defaultTimeout
+	case d < 0:
+		return 0
+	default:
+		return d
+	}
+}
+
+// logf logs a message not related to a session
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Logf("", "", format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+func (s *Server) newID() string {
+	if s.IDGenerator != nil {
+		return s.IDGenerator.NewID()
+	}
+	return randomIDGenerator{}.NewID()
+}
+
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return systemClock{}.Now()
+}
+
+// SetDraining enables or disables draining mode. While draining, new
+// connections and new messages are answered with a temporary failure, while
+// messages already in progress are processed normally. This allows a filter
+// to be replaced without bouncing mail.
+func (s *Server) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&s.draining, v)
+}
+
+// Draining reports whether the server is in draining mode.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
 }
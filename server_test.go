@@ -0,0 +1,2532 @@
+package milter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// startTestSession serves s on a loopback listener and returns a client
+// session connected to it.
+func startTestSession(t *testing.T, s *Server, opts ClientOptions) *ClientSession {
+	t.Helper()
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(local)
+
+	cl := NewClientWithOptions("tcp", local.Addr().String(), opts)
+	session, err := cl.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestServer_BodyHashes(t *testing.T) {
+	var sum []byte
+	var size int64
+	mm := MockMilter{
+		MailResp:      RespContinue,
+		BodyChunkResp: RespContinue,
+		BodyResp:      RespAccept,
+		BodyMod: func(m *Modifier) {
+			sum = m.BodyHash("sha256")
+			size = m.BodySize()
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		BodyHashes: map[string]func() hash.Hash{
+			"sha256": sha256.New,
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	body := bytes.Repeat([]byte("body"), 32000)
+	if _, _, err := session.BodyReadFrom(bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := sha256.Sum256(body)
+	if !bytes.Equal(sum, expected[:]) {
+		t.Fatalf("Wrong body hash: %x", sum)
+	}
+	if size != int64(len(body)) {
+		t.Fatal("Wrong body size:", size)
+	}
+}
+
+func TestServer_Draining(t *testing.T) {
+	mm := MockMilter{
+		MailResp: RespContinue,
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	s.SetDraining(true)
+	act, err := session.Mail("from@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActTempFail {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	if mm.From != "" {
+		t.Fatal("MailFrom called while draining")
+	}
+}
+
+func TestServer_SelfTest(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		Actions: OptAddHeader,
+	}
+	if err := s.SelfTest(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingSessionStore counts the calls to its methods.
+type countingSessionStore struct {
+	calls int32
+}
+
+func (s *countingSessionStore) Save(st *SessionState) error {
+	atomic.AddInt32(&s.calls, 1)
+	return nil
+}
+
+func (s *countingSessionStore) Delete(id string) error {
+	atomic.AddInt32(&s.calls, 1)
+	return nil
+}
+
+func TestServer_SelfTestHooks(t *testing.T) {
+	var store countingSessionStore
+	var states int32
+	sink := make(chanAuditSink, 10)
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		Audit:        sink,
+		SessionStore: &store,
+		ConnState: func(ConnInfo, ConnState) {
+			atomic.AddInt32(&states, 1)
+		},
+	}
+	if err := s.SelfTest(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// let the session end
+	time.Sleep(50 * time.Millisecond)
+
+	if len(sink) != 0 {
+		t.Error("Self-test transaction audited")
+	}
+	if n := atomic.LoadInt32(&store.calls); n != 0 {
+		t.Error("Self-test session checkpointed:", n)
+	}
+	if n := atomic.LoadInt32(&states); n != 0 {
+		t.Error("Self-test session state reported:", n)
+	}
+}
+
+func TestServer_SelfTestAllowedPeers(t *testing.T) {
+	nets, err := ParseNetworks("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		AllowedPeers: &AllowedPeers{Networks: nets},
+	}
+	if err := s.SelfTest(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_SharedSecretHandshake(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		Handshake: &SharedSecretHandshake{Secret: []byte("secret")},
+	}
+	defer s.Close()
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(local)
+
+	cl := NewClientWithOptions("tcp", local.Addr().String(), ClientOptions{
+		Handshake: &SharedSecretHandshake{Secret: []byte("secret")},
+	})
+	session, err := cl.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+
+	cl = NewClientWithOptions("tcp", local.Addr().String(), ClientOptions{
+		Handshake: &SharedSecretHandshake{Secret: []byte("wrong")},
+	})
+	if _, err := cl.Session(); !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("Expected ErrHandshakeFailed, got %v", err)
+	}
+}
+
+func TestSharedSecretHandshake_Impostor(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		// Accept any proof and answer with a bogus one
+		nonce := make([]byte, handshakeNonceSize)
+		serverConn.Write(nonce)
+		io.ReadFull(serverConn, make([]byte, handshakeNonceSize+sha256.Size))
+		serverConn.Write(make([]byte, sha256.Size))
+	}()
+
+	h := &SharedSecretHandshake{Secret: []byte("secret"), Timeout: time.Second}
+	if err := h.ClientHandshake(clientConn); !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("Expected ErrHandshakeFailed, got %v", err)
+	}
+}
+
+func TestServer_NegotiateV6(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		Actions:  OptAddHeader | OptChangeFrom,
+		Protocol: OptNoHelo | OptNoConnReply,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask:   OptAddHeader | OptChangeFrom | OptQuarantine,
+		ProtocolMask: OptNoConnReply,
+	})
+	defer session.Close()
+
+	if session.ActionOption(OptQuarantine) {
+		t.Fatal("OptQuarantine negotiated without being requested")
+	}
+	if session.ProtocolOption(OptNoHelo) {
+		t.Fatal("OptNoHelo negotiated without being offered")
+	}
+	if !session.ActionOption(OptChangeFrom) {
+		t.Fatal("OptChangeFrom not negotiated")
+	}
+	if !session.ProtocolOption(OptNoConnReply) {
+		t.Fatal("OptNoConnReply not negotiated")
+	}
+}
+
+type unknownMilter struct {
+	NoOpMilter
+	cmd string
+}
+
+func (um *unknownMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	um.cmd = cmd
+	return RespReject, nil
+}
+
+func TestServer_Unknown(t *testing.T) {
+	um := unknownMilter{}
+	s := Server{
+		NewMilter: func() Milter {
+			return &um
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	act, err := session.Unknown("XFOO bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActReject {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	if um.cmd != "XFOO bar" {
+		t.Fatal("Wrong command:", um.cmd)
+	}
+}
+
+func TestServer_ModifyBatch(t *testing.T) {
+	mm := MockMilter{
+		BodyResp: RespAccept,
+		BodyMod: func(m *Modifier) {
+			for i := 0; i < 5; i++ {
+				m.AddHeader("X-Test", "value")
+			}
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Actions:         OptAddHeader,
+		ModifyBatchSize: 2,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptAddHeader,
+	})
+	defer session.Close()
+
+	modifyActs, act, err := session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActAccept {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	if len(modifyActs) != 5 {
+		t.Fatal("Wrong amount of modify actions:", len(modifyActs))
+	}
+}
+
+func TestServer_QuitNewConn(t *testing.T) {
+	var milters []*MockMilter
+	s := Server{
+		NewMilter: func() Milter {
+			mm := &MockMilter{
+				ConnResp: RespContinue,
+			}
+			milters = append(milters, mm)
+			return mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Conn("host1", FamilyInet, 25, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.QuitNewConn(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Conn("host2", FamilyInet, 25, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(milters) != 2 {
+		t.Fatal("Wrong amount of milters:", len(milters))
+	}
+	if milters[0].Host != "host1" || milters[1].Host != "host2" {
+		t.Fatal("Wrong hosts:", milters[0].Host, milters[1].Host)
+	}
+}
+
+func TestServer_BodyChunkSkip(t *testing.T) {
+	bodyCalled := false
+	mm := MockMilter{
+		BodyChunkResp: RespSkip,
+		BodyResp:      RespAccept,
+		BodyMod: func(m *Modifier) {
+			bodyCalled = true
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Protocol: OptSkip,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ProtocolMask: OptSkip,
+	})
+	defer session.Close()
+
+	_, act, err := session.BodyReadFrom(bytes.NewReader(bytes.Repeat([]byte{'A'}, 3*MaxBodyChunk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActAccept {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	if len(mm.Chunks) != 1 {
+		t.Fatal("Wrong amount of body chunks received:", len(mm.Chunks))
+	}
+	if !bodyCalled {
+		t.Fatal("Body not called")
+	}
+}
+
+func TestServer_NoReply(t *testing.T) {
+	mm := MockMilter{
+		ConnResp: RespContinue,
+		HdrResp:  RespContinue,
+		HdrsResp: RespContinue,
+		BodyResp: RespAccept,
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Protocol: OptNoConnReply | OptNoHeaderReply,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ProtocolMask: OptNoConnReply | OptNoHeaderReply,
+	})
+	defer session.Close()
+
+	if _, err := session.Conn("host", FamilyInet, 25, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("From", "from@example.org")
+	hdr.Add("To", "to@example.org")
+	act, err := session.Header(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActContinue {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	_, act, err = session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActAccept {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+}
+
+func TestServer_RespNoReply(t *testing.T) {
+	mm := MockMilter{
+		ConnResp: RespNoReply,
+		HeloResp: RespNoReply,
+		MailResp: RespReject,
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Protocol: OptNoConnReply,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ProtocolMask: OptNoConnReply,
+	})
+	defer session.Close()
+
+	// no response is sent, the client doesn't wait for one
+	if _, err := session.Conn("host", FamilyInet, 25, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	// the MTA expects a response
+	act, err := session.Helo("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActContinue {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	// the stream is still in sync
+	act, err = session.Mail("from@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActReject {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+}
+
+func TestServer_MacroRequests(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		MacroRequests: map[Code][]string{
+			CodeConn: {"j", "{daemon_name}"},
+			CodeMail: {"{auth_authen}"},
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptSetSymList,
+	})
+	defer session.Close()
+
+	if !session.ActionOption(OptSetSymList) {
+		t.Fatal("OptSetSymList not negotiated")
+	}
+	if !reflect.DeepEqual(session.MacroRequests, s.MacroRequests) {
+		t.Fatal("Wrong macro requests:", session.MacroRequests)
+	}
+}
+
+func TestServer_TempFile(t *testing.T) {
+	var name string
+	var writeErr error
+	mm := MockMilter{
+		BodyResp: RespAccept,
+		BodyMod: func(m *Modifier) {
+			f, err := m.TempFile()
+			if err != nil {
+				writeErr = err
+				return
+			}
+			name = f.Name()
+			_, writeErr = f.Write(make([]byte, 16))
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		TempDir:   t.TempDir(),
+		TempQuota: 8,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, _, err := session.End(); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(writeErr, ErrTempQuota) {
+		t.Fatalf("Expected ErrTempQuota, got %v", writeErr)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatal("Temporary file not removed:", name)
+	}
+}
+
+func TestServer_HeaderFields(t *testing.T) {
+	var fields []HeaderField
+	mm := MockMilter{
+		HdrResp:  RespContinue,
+		HdrsResp: RespContinue,
+		HdrsMod: func(m *Modifier) {
+			m.Headers.Del("Subject")
+		},
+		BodyResp: RespAccept,
+		BodyMod: func(m *Modifier) {
+			fields = m.HeaderFields()
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	hdr.Add("To", "to@example.org")
+	if _, err := session.Header(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := session.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []HeaderField{
+		{Key: "To", Value: "to@example.org"},
+		{Key: "Subject", Value: "Hello"},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatal("Wrong header fields:", fields)
+	}
+}
+
+type orderedHeadersMilter struct {
+	MockMilter
+	raw []string
+}
+
+func (m *orderedHeadersMilter) OrderedHeaders(h textproto.Header, mod *Modifier) (Response, error) {
+	fields := h.Fields()
+	for fields.Next() {
+		raw, err := fields.Raw()
+		if err != nil {
+			return nil, err
+		}
+		m.raw = append(m.raw, string(raw))
+	}
+	return RespContinue, nil
+}
+
+func TestServer_OrderedHeaders(t *testing.T) {
+	mm := orderedHeadersMilter{
+		MockMilter: MockMilter{
+			HdrResp:  RespContinue,
+			HdrsErr:  errors.New("Headers called"),
+			BodyResp: RespAccept,
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	for _, f := range []HeaderField{
+		{Key: "subject", Value: "Hello"},
+		{Key: "X-Custom", Value: "a"},
+		{Key: "DKIM-Signature", Value: "v=1;\r\n\tb=abc"},
+		{Key: "x-custom", Value: "b"},
+	} {
+		if _, err := session.HeaderField(f.Key, f.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := session.HeaderEnd(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := session.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"subject: Hello\r\n",
+		"X-Custom: a\r\n",
+		"DKIM-Signature: v=1;\r\n\tb=abc\r\n",
+		"x-custom: b\r\n",
+	}
+	if !reflect.DeepEqual(mm.raw, expected) {
+		t.Fatalf("Wrong header fields: %q", mm.raw)
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	mm := MockMilter{
+		MailResp: RespContinue,
+		BodyResp: RespAccept,
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	time.Sleep(2 * shutdownPollInterval)
+	select {
+	case err := <-done:
+		t.Fatal("Shutdown returned with a message in progress:", err)
+	default:
+	}
+
+	_, act, err := session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActAccept {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_ShutdownRejectedRcpt(t *testing.T) {
+	var milters int32
+	s := Server{
+		NewMilter: func() Milter {
+			atomic.AddInt32(&milters, 1)
+			return &MockMilter{
+				MailResp: RespContinue,
+				RcptResp: RespReject,
+				BodyResp: RespAccept,
+			}
+		},
+	}
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	// a rejected recipient doesn't end the message
+	if _, err := session.Rcpt("to1@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	time.Sleep(2 * shutdownPollInterval)
+
+	act, err := session.Rcpt("to2@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActReject {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	if n := atomic.LoadInt32(&milters); n != 1 {
+		t.Fatal("Milter replaced after a rejected recipient:", n)
+	}
+	if _, act, err = session.End(); err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActAccept {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// activityConn records whether the session is in a message when a packet is
+// written.
+type activityConn struct {
+	net.Conn
+	session   *milterSession
+	inMessage []bool
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	c.inMessage = append(c.inMessage, c.session.inMessage())
+	return c.Conn.Write(b)
+}
+
+func TestServer_InMessageUntilEOBResponse(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+	}
+	serverConn, conn := net.Pipe()
+	defer conn.Close()
+	ac := &activityConn{Conn: serverConn}
+	ac.session = s.newSession(ac, nil)
+	go ac.session.HandleMilterCommands()
+
+	for _, msg := range []*Message{
+		{Code: byte(CodeMail), Data: []byte("<from@example.org>\x00")},
+		{Code: byte(CodeEOB)},
+	} {
+		if err := writePacket(conn, msg, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPacket(conn, time.Second, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Shutdown must not close the connection before the final response
+	if !reflect.DeepEqual(ac.inMessage, []bool{true, true}) {
+		t.Fatalf("Session not in message while writing responses: %v", ac.inMessage)
+	}
+}
+
+func TestServer_ListenAndServeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "milter.sock")
+
+	// leave a stale socket behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		UnixSocketMode:  0600,
+		UnixSocketOwner: strconv.Itoa(os.Getuid()),
+		UnixSocketGroup: strconv.Itoa(os.Getgid()),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe("unix", path)
+	}()
+
+	var session *ClientSession
+	for i := 0; ; i++ {
+		cl := NewClientWithOptions("unix", path, ClientOptions{})
+		session, err = cl.Session()
+		if err == nil {
+			break
+		} else if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	session.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatal("Wrong socket mode:", fi.Mode())
+	}
+
+	s.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Socket not removed")
+	}
+}
+
+func TestServer_CloseListener(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+	}
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixLn, err := net.Listen("unix", filepath.Join(t.TempDir(), "milter.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpDone := make(chan error, 1)
+	unixDone := make(chan error, 1)
+	go func() { tcpDone <- s.Serve(tcpLn) }()
+	go func() { unixDone <- s.Serve(unixLn) }()
+
+	for i := 0; len(s.Addrs()) < 2; i++ {
+		if i == 50 {
+			t.Fatal("Listeners not registered:", s.Addrs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.CloseListener(tcpLn.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-tcpDone; err != ErrListenerClosed {
+		t.Fatal(err)
+	}
+	if addrs := s.Addrs(); len(addrs) != 1 || addrs[0].String() != unixLn.Addr().String() {
+		t.Fatal("Wrong addresses:", addrs)
+	}
+	if err := s.CloseListener(tcpLn.Addr()); err == nil {
+		t.Fatal("Expected an error closing a closed listener")
+	}
+
+	session, err := NewClientWithOptions("unix", unixLn.Addr().String(), ClientOptions{}).Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+
+	s.Close()
+	if err := <-unixDone; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if err := s.Serve(tcpLn); err != ErrServerClosed {
+		t.Fatal("Serve after Close:", err)
+	}
+}
+
+func TestServer_ListenAndServeUnixOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "milter.sock")
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		UnixSocketOwner: "nonexistent-milter-user",
+	}
+	if err := s.ListenAndServe("unix", path); err == nil {
+		t.Fatal("Expected error for unknown owner")
+	}
+	matches, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Fatal("Socket files left behind:", matches)
+	}
+}
+
+func TestServer_Context(t *testing.T) {
+	var ctx context.Context
+	mm := MockMilter{
+		MailResp: RespContinue,
+		MailMod: func(m *Modifier) {
+			ctx = m.Context()
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Context cancelled during message")
+	}
+	if err := session.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Context not cancelled after abort")
+	}
+}
+
+type testLogger struct {
+	sessionIDs []string
+	msgs       []string
+}
+
+func (l *testLogger) Logf(sessionID, queueID string, format string, v ...interface{}) {
+	l.sessionIDs = append(l.sessionIDs, sessionID)
+	l.msgs = append(l.msgs, queueID+": "+fmt.Sprintf(format, v...))
+}
+
+func TestServer_ContextDisconnect(t *testing.T) {
+	cancelled := make(chan error, 1)
+	mm := MockMilter{
+		MailResp: RespContinue,
+		BodyResp: RespAccept,
+		BodyMod: func(m *Modifier) {
+			select {
+			case <-m.Context().Done():
+				cancelled <- m.Context().Err()
+			case <-time.After(5 * time.Second):
+				cancelled <- nil
+			}
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Send EOB and disconnect while the filter is busy
+	if err := writePacket(session.conn, &Message{Code: byte(CodeEOB)}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	session.conn.Close()
+
+	if err := <-cancelled; err == nil {
+		t.Fatal("Context not cancelled after disconnect")
+	}
+}
+
+func TestServer_Logger(t *testing.T) {
+	mm := MockMilter{
+		MailResp: RespContinue,
+		MailMod: func(m *Modifier) {
+			m.Logf("sender %v", "from@example.org")
+		},
+	}
+	var logger testLogger
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Logger: &logger,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if err := session.Macros(CodeMail, "i", "ABCDEF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(logger.msgs, []string{"ABCDEF: sender from@example.org"}) {
+		t.Fatal("Wrong log messages:", logger.msgs)
+	}
+	if logger.sessionIDs[0] == "" {
+		t.Fatal("Missing session ID")
+	}
+}
+
+func TestServer_OnError(t *testing.T) {
+	errFilter := errors.New("filter broken")
+	for policy, code := range map[ErrorPolicy]ActionCode{
+		ErrorCloseConn:    0,
+		ErrorTempFail:     ActTempFail,
+		ErrorReject:       ActReject,
+		ErrorAcceptAndLog: ActAccept,
+	} {
+		errCh := make(chan error, 1)
+		s := Server{
+			NewMilter: func() Milter {
+				return &MockMilter{MailErr: errFilter, HeloResp: RespContinue}
+			},
+			OnError: policy,
+			ErrorHook: func(err error) {
+				errCh <- err
+			},
+			Logger: &testLogger{},
+		}
+		session := startTestSession(t, &s, ClientOptions{})
+
+		act, err := session.Mail("from@example.org", nil)
+		if policy == ErrorCloseConn {
+			if err == nil {
+				t.Errorf("%v: expected the connection to be closed", policy)
+			}
+		} else if err != nil {
+			t.Errorf("%v: %v", policy, err)
+		} else if act.Code != code {
+			t.Errorf("%v: unexpected code: %v", policy, act.Code)
+		} else if _, err := session.Helo("localhost"); err != nil {
+			t.Errorf("%v: session unusable after error: %v", policy, err)
+		}
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, errFilter) {
+				t.Errorf("%v: wrong error reported: %v", policy, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v: ErrorHook not called", policy)
+		}
+
+		session.Close()
+		s.Close()
+	}
+}
+
+func TestServer_InvalidReply(t *testing.T) {
+	errCh := make(chan error, 1)
+	s := Server{
+		NewMilter: func() Milter {
+			return &MockMilter{MailResp: NewResponseStr(byte(ActReplyCode), "250 OK")}
+		},
+		OnError: ErrorTempFail,
+		ErrorHook: func(err error) {
+			errCh <- err
+		},
+		Logger: &testLogger{},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	act, err := session.Mail("from@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActTempFail {
+		t.Errorf("Unexpected code: %v", act.Code)
+	}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrInvalidReply) {
+			t.Errorf("Wrong error reported: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("ErrorHook not called")
+	}
+}
+
+func TestServer_Panic(t *testing.T) {
+	mm := MockMilter{
+		MailMod: func(m *Modifier) {
+			panic("oops")
+		},
+	}
+	var hookErr error
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		ErrorHook: func(err error) {
+			hookErr = err
+		},
+		Logger: &testLogger{},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	act, err := session.Mail("from@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActTempFail {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+	var perr *PanicError
+	if !errors.As(hookErr, &perr) || perr.Value != "oops" {
+		t.Fatal("Wrong error reported:", hookErr)
+	}
+}
+
+type memorySessionStore struct {
+	mu     sync.Mutex
+	states map[string]*SessionState
+}
+
+func (s *memorySessionStore) Save(st *SessionState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[st.ID] = st
+	return nil
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, id)
+	return nil
+}
+
+func TestServer_SessionStore(t *testing.T) {
+	mm := MockMilter{
+		MailResp: RespContinue,
+		RcptResp: RespContinue,
+	}
+	store := memorySessionStore{states: make(map[string]*SessionState)}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		SessionStore: &store,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Rcpt("to@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.states) != 1 {
+		t.Fatal("Wrong amount of checkpoints:", len(store.states))
+	}
+	for _, st := range store.states {
+		if !st.InMessage || st.From != "from@example.org" || !reflect.DeepEqual(st.Rcpts, []string{"to@example.org"}) {
+			t.Fatalf("Wrong checkpoint: %+v", st)
+		}
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		IdleTimeout: 50 * time.Millisecond,
+		Logger:      &testLogger{},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	defer session.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := session.Mail("from@example.org", nil); err == nil {
+		t.Fatal("Expected error after idle timeout")
+	}
+}
+
+func TestServer_ESMTPArgs(t *testing.T) {
+	var mailArgs, rcptArgs ESMTPArgs
+	var size, notify string
+	mm := MockMilter{
+		MailResp: RespContinue,
+		MailMod: func(m *Modifier) {
+			mailArgs = m.MailArgs
+			size, _ = m.MailArgs.Get("size")
+		},
+		RcptResp: RespContinue,
+		RcptMod: func(m *Modifier) {
+			rcptArgs = m.RcptArgs
+			notify, _ = m.RcptArgs.Get("NOTIFY")
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", []string{"SIZE=1024", "SMTPUTF8"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Rcpt("to@example.org", []string{"NOTIFY=NEVER"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(mailArgs, ESMTPArgs{"SIZE=1024", "SMTPUTF8"}) || size != "1024" {
+		t.Fatalf("Wrong MAIL arguments: %v", mailArgs)
+	}
+	if _, ok := mailArgs.Get("SMTPUTF8"); !ok {
+		t.Fatal("Missing SMTPUTF8 argument")
+	}
+	if !reflect.DeepEqual(rcptArgs, ESMTPArgs{"NOTIFY=NEVER"}) || notify != "NEVER" {
+		t.Fatalf("Wrong RCPT arguments: %v", rcptArgs)
+	}
+}
+
+func TestServer_RcptRejected(t *testing.T) {
+	var rejected []bool
+	mm := MockMilter{
+		MailResp: RespContinue,
+		RcptResp: RespContinue,
+		RcptMod: func(m *Modifier) {
+			rejected = append(rejected, m.RcptRejected())
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Protocol: OptRcptRej,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ProtocolMask: OptRcptRej,
+	})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, mailer := range []string{"error", "smtp"} {
+		if err := session.Macros(CodeRcpt, "{rcpt_mailer}", mailer); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := session.Rcpt("to@example.org", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(rejected, []bool{true, false}) {
+		t.Fatalf("Wrong rejections: %v", rejected)
+	}
+}
+
+// bodyOnlyMilter only implements the end of message callback.
+type bodyOnlyMilter struct{}
+
+func (bodyOnlyMilter) Body(m *Modifier) (Response, error) {
+	if err := m.AddHeader("X-Checked", "yes"); err != nil {
+		return nil, err
+	}
+	return RespAccept, nil
+}
+
+func TestServer_OptionalHandlers(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return bodyOnlyMilter{}
+		},
+		Actions: OptAddHeader,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask: OptAddHeader,
+	})
+	defer session.Close()
+
+	steps := []func() (*Action, error){
+		func() (*Action, error) {
+			return session.Conn("mail.example.com", FamilyInet, 25, "192.0.2.1")
+		},
+		func() (*Action, error) { return session.Helo("mail.example.com") },
+		func() (*Action, error) { return session.Mail("from@example.org", nil) },
+		func() (*Action, error) { return session.Rcpt("to@example.org", nil) },
+		func() (*Action, error) { return session.HeaderField("Subject", "Hello") },
+		func() (*Action, error) { return session.HeaderEnd() },
+		func() (*Action, error) { return session.BodyChunk([]byte("Hello")) },
+	}
+	for i, step := range steps {
+		act, err := step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act.Code != ActContinue {
+			t.Fatalf("Step %v: unexpected code: %v", i, act.Code)
+		}
+	}
+	modifyActs, act, err := session.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActAccept || len(modifyActs) != 1 {
+		t.Fatalf("Wrong end of message: %v %+v", act.Code, modifyActs)
+	}
+}
+
+// negotiatingMilter doesn't want the body if the MTA can't skip it.
+type negotiatingMilter struct {
+	NoOpMilter
+}
+
+func (negotiatingMilter) Negotiate(mtaVersion uint32, mtaActions OptAction, mtaProto OptProtocol) (OptAction, OptProtocol, error) {
+	if mtaProto&OptSkip == 0 {
+		return OptAddHeader, OptNoBody, nil
+	}
+	return OptAddHeader | OptChangeBody, OptSkip, nil
+}
+
+func TestServer_Negotiator(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return negotiatingMilter{}
+		},
+	}
+	defer s.Close()
+
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask:   OptAddHeader | OptChangeBody,
+		ProtocolMask: OptNoBody,
+	})
+	defer session.Close()
+	if session.ActionOpts != OptAddHeader || session.ProtocolOpts != OptNoBody {
+		t.Fatalf("Wrong options: 0x%x 0x%x", session.ActionOpts, session.ProtocolOpts)
+	}
+
+	session = startTestSession(t, &s, ClientOptions{
+		ActionMask:   OptAddHeader | OptChangeBody,
+		ProtocolMask: OptNoBody | OptSkip,
+	})
+	defer session.Close()
+	if session.ActionOpts != OptAddHeader|OptChangeBody || session.ProtocolOpts != OptSkip {
+		t.Fatalf("Wrong options: 0x%x 0x%x", session.ActionOpts, session.ProtocolOpts)
+	}
+}
+
+func TestServer_MaxPacketSize(t *testing.T) {
+	errCh := make(chan error, 1)
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		MaxPacketSize: 64,
+		ErrorHook: func(err error) {
+			errCh <- err
+		},
+		Logger: &testLogger{},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	defer session.Close()
+
+	if _, err := session.Mail(strings.Repeat("a", 128)+"@example.org", nil); err == nil {
+		t.Fatal("Expected error for oversized packet")
+	}
+
+	select {
+	case err := <-errCh:
+		var sizeErr *PacketSizeError
+		if !errors.As(err, &sizeErr) {
+			t.Fatalf("Expected *PacketSizeError, got %v", err)
+		}
+		if sizeErr.Max != 64 || sizeErr.Size <= 64 {
+			t.Fatalf("Wrong error: %+v", sizeErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ErrorHook not called")
+	}
+}
+
+func TestServer_Negotiate(t *testing.T) {
+	offers := make(chan NegotiationOffer, 1)
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		Actions: OptAddHeader,
+		Negotiate: func(offer NegotiationOffer) (NegotiationReply, error) {
+			offers <- offer
+			return NegotiationReply{
+				Actions:       OptChangeFrom,
+				Protocol:      OptNoHelo,
+				MacroRequests: map[Code][]string{CodeMail: {"{auth_authen}"}},
+			}, nil
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ActionMask:   OptAddHeader | OptChangeFrom | OptSetSymList,
+		ProtocolMask: OptNoHelo | OptNoBody,
+	})
+	defer session.Close()
+
+	offer := <-offers
+	if offer.Version != serverProtocolVersion || offer.Actions != OptAddHeader|OptChangeFrom|OptSetSymList || offer.Protocol != OptNoHelo|OptNoBody {
+		t.Errorf("Wrong offer: %+v", offer)
+	}
+	if offer.Conn.RemoteAddr == nil {
+		t.Error("Missing connection information")
+	}
+	if session.ActionOpts != OptChangeFrom|OptSetSymList || session.ProtocolOpts != OptNoHelo {
+		t.Errorf("Wrong options: actions 0x%x, protocol 0x%x", uint32(session.ActionOpts), uint32(session.ProtocolOpts))
+	}
+	if expected := map[Code][]string{CodeMail: {"{auth_authen}"}}; !reflect.DeepEqual(session.MacroRequests, expected) {
+		t.Errorf("Wrong macro requests: %v", session.MacroRequests)
+	}
+}
+
+func TestServer_NegotiationError(t *testing.T) {
+	errCh := make(chan error, 1)
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		RequiredActions: OptQuarantine,
+		ErrorHook: func(err error) {
+			errCh <- err
+		},
+		Logger: &testLogger{},
+	}
+	defer s.Close()
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(local)
+
+	cl := NewClientWithOptions("tcp", local.Addr().String(), ClientOptions{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		ActionMask:   OptAddHeader,
+		ProtocolMask: OptNoBody,
+	})
+	if _, err := cl.Session(); err == nil {
+		t.Fatal("Expected negotiation to fail")
+	}
+
+	select {
+	case err := <-errCh:
+		var negErr *NegotiationError
+		if !errors.As(err, &negErr) || !errors.Is(err, ErrNegotiationPolicy) {
+			t.Fatalf("Expected *NegotiationError, got %v", err)
+		}
+		if negErr.Version != serverProtocolVersion || negErr.Actions != OptAddHeader || negErr.Protocol != OptNoBody {
+			t.Fatalf("Wrong error: %+v", negErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ErrorHook not called")
+	}
+}
+
+func TestServer_MinVersion(t *testing.T) {
+	errCh := make(chan error, 1)
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		MinVersion: 6,
+		ErrorHook: func(err error) {
+			errCh <- err
+		},
+		Logger: &testLogger{},
+	}
+	serverConn, conn := net.Pipe()
+	defer conn.Close()
+	go s.newSession(serverConn, nil).HandleMilterCommands()
+
+	data := make([]byte, 4*3)
+	binary.BigEndian.PutUint32(data, 4)
+	binary.BigEndian.PutUint32(data[4:], uint32(OptAddHeader))
+	if err := writePacket(conn, &Message{Code: byte(CodeOptNeg), Data: data}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPacket(conn, time.Second, 0); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+
+	select {
+	case err := <-errCh:
+		var negErr *NegotiationError
+		if !errors.As(err, &negErr) || !errors.Is(err, ErrNegotiationPolicy) {
+			t.Fatalf("Expected *NegotiationError, got %v", err)
+		}
+		if negErr.Version != 4 {
+			t.Fatalf("Wrong error: %+v", negErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ErrorHook not called")
+	}
+}
+
+func TestServer_MaxSessionMemory(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		MaxSessionMemory: 1024,
+		Logger:           &testLogger{},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	defer session.Close()
+
+	send := func(value string) error {
+		if _, err := session.Mail("from@example.org", nil); err != nil {
+			return err
+		}
+		hdr := textproto.Header{}
+		hdr.Add("Subject", value)
+		if _, err := session.Header(hdr); err != nil {
+			return err
+		}
+		_, _, err := session.End()
+		return err
+	}
+
+	// Small messages don't recycle the session
+	for i := 0; i < 3; i++ {
+		if err := send("Hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := send(strings.Repeat("a", 2048)); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("Hello"); err == nil {
+		t.Fatal("Expected the session to be recycled")
+	}
+}
+
+func TestServer_MaxMessagesPerConn(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		MaxMessagesPerConn: 2,
+		Logger:             &testLogger{},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	defer session.Close()
+
+	for i := 0; i < 2; i++ {
+		act, err := session.Mail("from@example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act.Code != ActContinue {
+			t.Fatal("Unexpected code:", act.Code)
+		}
+		if _, _, err := session.End(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	act, err := session.Mail("from@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActTempFail {
+		t.Fatal("Unexpected code:", act.Code)
+	}
+
+	session.QuitNewConn()
+	if _, err := session.Conn("host", FamilyInet, 25, "127.0.0.1"); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+}
+
+func TestServer_MaxMessagesPerConnNoReply(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		Protocol:           OptNoMailReply,
+		MaxMessagesPerConn: 1,
+		Logger:             &testLogger{},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{
+		ProtocolMask: OptNoMailReply,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := session.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the temporary failure can't be sent, the connection is closed
+	session.Mail("from@example.org", nil)
+	if _, _, err := session.End(); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+}
+
+func TestServer_BufferBody(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+	}{
+		{"memory", "Hello"},
+		{"spill", strings.Repeat("Hello world!\r\n", 64)},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var body []byte
+			var readErr error
+			mm := MockMilter{
+				MailResp:      RespContinue,
+				BodyChunkResp: RespContinue,
+				BodyResp:      RespAccept,
+				BodyMod: func(m *Modifier) {
+					r, err := m.BodyReader()
+					if err != nil {
+						readErr = err
+						return
+					}
+					body, readErr = ioutil.ReadAll(r)
+				},
+			}
+			s := Server{
+				NewMilter: func() Milter {
+					return &mm
+				},
+				BufferBody:      true,
+				BodyMemoryLimit: 64,
+				TempDir:         t.TempDir(),
+			}
+			defer s.Close()
+			session := startTestSession(t, &s, ClientOptions{})
+			defer session.Close()
+
+			if _, err := session.Mail("from@example.org", nil); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(tc.body); i += 100 {
+				end := i + 100
+				if end > len(tc.body) {
+					end = len(tc.body)
+				}
+				if _, err := session.BodyChunk([]byte(tc.body[i:end])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, _, err := session.End(); err != nil {
+				t.Fatal(err)
+			}
+
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if string(body) != tc.body {
+				t.Fatalf("Wrong body: %q", body)
+			}
+		})
+	}
+}
+
+func TestModifier_Entity(t *testing.T) {
+	var subject string
+	var body []byte
+	var readErr error
+	mm := MockMilter{
+		MailResp:      RespContinue,
+		HdrResp:       RespContinue,
+		HdrsResp:      RespContinue,
+		BodyChunkResp: RespContinue,
+		BodyResp:      RespAccept,
+		BodyMod: func(m *Modifier) {
+			e, err := m.Entity()
+			if err != nil {
+				readErr = err
+				return
+			}
+			subject = e.Header.Get("Subject")
+			body, readErr = ioutil.ReadAll(e.Body)
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		BufferBody: true,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	hdr.Add("Content-Transfer-Encoding", "base64")
+	if _, err := session.Header(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.BodyChunk([]byte("SGVsbG8gd29ybGQh\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := session.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if subject != "Hello" || string(body) != "Hello world!" {
+		t.Fatalf("Wrong message: %q %q", subject, body)
+	}
+}
+
+type staticIDGenerator string
+
+func (id staticIDGenerator) NewID() string {
+	return string(id)
+}
+
+func TestServer_ProfilerLabels(t *testing.T) {
+	var profile bytes.Buffer
+	mm := MockMilter{
+		MailResp:      RespContinue,
+		BodyChunkResp: RespContinue,
+		BodyResp:      RespAccept,
+		BodyMod: func(m *Modifier) {
+			pprof.Lookup("goroutine").WriteTo(&profile, 1)
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		ProfilerLabels: true,
+		IDGenerator:    staticIDGenerator("test-session"),
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := session.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, label := range []string{`"milter.session_id":"test-session"`, `"milter.stage":"eom"`, `"milter.peer":"127.0.0.1:`} {
+		if !strings.Contains(profile.String(), label) {
+			t.Errorf("Missing label %v in goroutine profile", label)
+		}
+	}
+}
+
+func TestServer_MaxConnections(t *testing.T) {
+	limited := make(chan struct{}, 1)
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		MaxConnections: 1,
+		OnConnectionLimit: func(conn net.Conn) {
+			limited <- struct{}{}
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	cl := NewClientWithOptions("tcp", s.Addrs()[0].String(), ClientOptions{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	if _, err := cl.Session(); err == nil {
+		t.Fatal("Expected error when exceeding MaxConnections")
+	}
+	select {
+	case <-limited:
+	case <-time.After(time.Second):
+		t.Fatal("OnConnectionLimit not called")
+	}
+}
+
+type tempErrListener struct {
+	net.Listener
+	errs int
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary error" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func (ln *tempErrListener) Accept() (net.Conn, error) {
+	if ln.errs > 0 {
+		ln.errs--
+		return nil, tempError{}
+	}
+	return ln.Listener.Accept()
+}
+
+func TestServer_AcceptTemporaryError(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return NoOpMilter{}
+		},
+		Logger: &testLogger{},
+	}
+	defer s.Close()
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(&tempErrListener{Listener: local, errs: 3})
+
+	cl := NewClientWithOptions("tcp", local.Addr().String(), ClientOptions{})
+	session, err := cl.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+}
+
+func TestServer_LoadShedder(t *testing.T) {
+	mm := MockMilter{
+		MailResp: RespContinue,
+	}
+	shedder := &LoadShedder{High: 10, Low: 5}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		LoadShedder: shedder,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	for _, tc := range []struct {
+		load     int64
+		expected ActionCode
+	}{
+		{8, ActContinue},
+		{10, ActTempFail},
+		{7, ActTempFail},
+		{5, ActContinue},
+	} {
+		shedder.Set(tc.load)
+		act, err := session.Mail("from@example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act.Code != tc.expected {
+			t.Fatalf("Unexpected code for load %v: %v", tc.load, act.Code)
+		}
+		if err := session.Abort(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := shedder.Stats(); stats.Transitions != 1 || stats.Refused != 2 {
+		t.Fatalf("Wrong stats: %+v", stats)
+	}
+}
+
+type testSpan struct {
+	name  string
+	attrs map[string]string
+	ended chan<- *testSpan
+}
+
+func (s *testSpan) SetAttribute(key, value string) {
+	s.attrs[key] = value
+}
+
+func (s *testSpan) End() {
+	s.ended <- s
+}
+
+type testTracer struct {
+	ended chan *testSpan
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, &testSpan{name: name, attrs: make(map[string]string), ended: t.ended}
+}
+
+func TestServer_Tracer(t *testing.T) {
+	mm := MockMilter{
+		MailResp: RespReject,
+	}
+	tracer := testTracer{ended: make(chan *testSpan, 10)}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Tracer: &tracer,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+
+	if err := session.Macros(CodeMail, "i", "ABCDEF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+
+	span := <-tracer.ended
+	if span.name != "milter.mail" || span.attrs["milter.queue_id"] != "ABCDEF" || span.attrs["milter.action"] != "r" {
+		t.Fatalf("Wrong span: %+v", span)
+	}
+	span = <-tracer.ended
+	if span.name != "milter.session" {
+		t.Fatalf("Wrong span: %+v", span)
+	}
+}
+
+func TestServer_Enrichers(t *testing.T) {
+	var country string
+	mm := MockMilter{
+		ConnResp: RespContinue,
+		MailResp: RespContinue,
+		MailMod: func(m *Modifier) {
+			country = m.Macros["{geoip_country}"]
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+		Enrichers: []Enricher{
+			EnricherFunc(func(ctx context.Context, addr net.IP) (map[string]string, error) {
+				return map[string]string{"{geoip_country}": "FR"}, nil
+			}),
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Conn("host", FamilyInet, 25, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Macros(CodeMail, "i", "ABCDEF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if country != "FR" {
+		t.Fatal("Wrong country:", country)
+	}
+}
+
+func TestServer_NewMilterWithConn(t *testing.T) {
+	infos := make(chan ConnInfo, 1)
+	s := Server{
+		NewMilterWithConn: func(conn ConnInfo) Milter {
+			infos <- conn
+			return NoOpMilter{}
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	info := <-infos
+	if info.Listener != s.listeners[0].Listener {
+		t.Fatal("Wrong listener:", info.Listener)
+	}
+	if info.RemoteAddr == nil || info.RemoteAddr.String() != session.conn.LocalAddr().String() {
+		t.Fatal("Wrong remote address:", info.RemoteAddr)
+	}
+}
+
+func TestServer_SetMilterFactory(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter { return NoOpMilter{} },
+		Actions:   OptAddHeader,
+	}
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	before := s.newSession(conn, nil)
+
+	var mm MockMilter
+	done := make(chan struct{})
+	go func() {
+		s.SetMilterFactory(MilterFactory{
+			NewMilter: func(ConnInfo) Milter { return &mm },
+			Actions:   OptChangeFrom,
+			Protocol:  OptNoHelo,
+		})
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		s.newSession(conn, nil)
+	}
+	<-done
+	after := s.newSession(conn, nil)
+
+	if _, ok := before.backend.(NoOpMilter); !ok || before.actions != OptAddHeader {
+		t.Errorf("Existing session changed: %T, actions 0x%x", before.backend, uint32(before.actions))
+	}
+	if before.factory.NewMilter(before.connInfo) != (NoOpMilter{}) {
+		t.Error("Existing session doesn't use the previous factory for new messages")
+	}
+	if after.backend != &mm || after.actions != OptChangeFrom || after.protocol != OptNoHelo {
+		t.Errorf("New session doesn't use the new factory: %T, actions 0x%x", after.backend, uint32(after.actions))
+	}
+}
+
+type rcptMilter struct {
+	NoOpMilter
+}
+
+func (rcptMilter) RcptTo(rcptTo string, m *Modifier) (Response, error) {
+	if strings.Trim(rcptTo, "<>") == "bad@example.org" {
+		return RespReject, nil
+	}
+	return RespContinue, nil
+}
+
+func (rcptMilter) Body(m *Modifier) (Response, error) {
+	if err := m.DeleteRecipient("<TO1@example.org>"); err != nil {
+		return nil, err
+	}
+	if err := m.AddRecipient("<to3@example.org>"); err != nil {
+		return nil, err
+	}
+	return RespAccept, nil
+}
+
+func TestResult_Recipients(t *testing.T) {
+	s := Server{
+		NewMilter: func() Milter {
+			return rcptMilter{}
+		},
+		Actions: OptAddRcpt | OptRemoveRcpt,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"to1@example.org", "bad@example.org", "to2@example.org"} {
+		if _, err := session.Rcpt(rcpt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := session.EndResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.ModifyActions) != 2 {
+		t.Fatal("Wrong amount of modify actions:", len(res.ModifyActions))
+	}
+	if expected := []string{"to2@example.org", "to3@example.org"}; !reflect.DeepEqual(res.Recipients, expected) {
+		t.Fatalf("Wrong recipients: %v", res.Recipients)
+	}
+}
+
+func TestResult_NoRcptPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy NoRcptPolicy
+		code   ActionCode
+		rcpts  []string
+		acts   int
+	}{
+		{"allow", NoRcptAllow, ActAccept, []string{}, 1},
+		{"keep-original", NoRcptKeepOriginal, ActAccept, []string{"to@example.org"}, 0},
+		{"discard", NoRcptDiscard, ActDiscard, []string{}, 1},
+		{"reject", NoRcptReject, ActReject, []string{}, 1},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			mm := MockMilter{
+				MailResp:      RespContinue,
+				RcptResp:      RespContinue,
+				HdrsResp:      RespContinue,
+				BodyChunkResp: RespContinue,
+				BodyResp:      RespAccept,
+				BodyMod: func(m *Modifier) {
+					m.DeleteRecipient("to@example.org")
+				},
+			}
+			s := Server{
+				NewMilter: func() Milter {
+					return &mm
+				},
+				Actions: OptRemoveRcpt,
+			}
+			defer s.Close()
+			session := startTestSession(t, &s, ClientOptions{
+				ActionMask:   OptRemoveRcpt,
+				NoRcptPolicy: tc.policy,
+			})
+			defer session.Close()
+
+			if _, err := session.Mail("from@example.org", nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := session.Rcpt("to@example.org", nil); err != nil {
+				t.Fatal(err)
+			}
+			res, err := session.EndResult()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.NoRcpts {
+				t.Fatal("Expected NoRcpts")
+			}
+			if res.Action.Code != tc.code {
+				t.Fatal("Wrong action:", res.Action.Code)
+			}
+			if !reflect.DeepEqual(res.Recipients, tc.rcpts) {
+				t.Fatalf("Wrong recipients: %v", res.Recipients)
+			}
+			if len(res.ModifyActions) != tc.acts {
+				t.Fatal("Wrong amount of modify actions:", len(res.ModifyActions))
+			}
+		})
+	}
+}
+
+type macrosMilter struct {
+	MockMilter
+	stages []Code
+	macros []map[string]string
+}
+
+func (m *macrosMilter) Macros(stage Code, macros map[string]string) error {
+	m.stages = append(m.stages, stage)
+	m.macros = append(m.macros, macros)
+	return nil
+}
+
+func TestServer_MacrosHandler(t *testing.T) {
+	mm := macrosMilter{
+		MockMilter: MockMilter{
+			ConnResp: RespContinue,
+			MailResp: RespContinue,
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if err := session.Macros(CodeConn, "j", "mx.example.org", "{daemon_name}", "smtpd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Conn("host", FamilyInet, 25, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Macros(CodeMail, "i", "ABCDEF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStages := []Code{CodeConn, CodeMail}
+	expectedMacros := []map[string]string{
+		{"j": "mx.example.org", "{daemon_name}": "smtpd"},
+		{"i": "ABCDEF"},
+	}
+	if !reflect.DeepEqual(mm.stages, expectedStages) {
+		t.Errorf("Wrong stages: %v", mm.stages)
+	}
+	if !reflect.DeepEqual(mm.macros, expectedMacros) {
+		t.Errorf("Wrong macros: %v", mm.macros)
+	}
+}
+
+func TestServer_MacroStages(t *testing.T) {
+	var macros, eohMacros map[string]string
+	mm := MockMilter{
+		ConnResp:      RespContinue,
+		MailResp:      RespContinue,
+		HdrsResp:      RespContinue,
+		BodyChunkResp: RespContinue,
+		BodyResp:      RespAccept,
+		BodyMod: func(m *Modifier) {
+			macros = m.Macros
+			eohMacros = m.StageMacros(CodeEOH)
+		},
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if err := session.Macros(CodeConn, "j", "mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Conn("host", FamilyInet, 25, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, queueID := range []string{"ABCDEF", ""} {
+		if queueID != "" {
+			if err := session.Macros(CodeMail, "i", queueID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := session.Mail("from@example.org", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Macros(CodeEOH, "x", "eoh"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := session.HeaderEnd(); err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Macros(CodeEOB, "x", "eom"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := session.End(); err != nil {
+			t.Fatal(err)
+		}
+
+		if macros["j"] != "mx.example.org" {
+			t.Fatalf("Message %v: missing connection macro: %v", i, macros)
+		}
+		if macros["i"] != queueID {
+			t.Fatalf("Message %v: wrong queue ID: %q", i, macros["i"])
+		}
+		if macros["x"] != "eom" || eohMacros["x"] != "eoh" {
+			t.Fatalf("Message %v: wrong stage macros: %v, %v", i, macros, eohMacros)
+		}
+	}
+}
+
+type failingConn struct {
+	net.Conn
+	err   error
+	limit int
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	if len(b) > c.limit {
+		return c.limit, c.err
+	}
+	return len(b), nil
+}
+
+func (c *failingConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err      error
+		limit    int
+		peerGone bool
+	}{
+		{err: syscall.EPIPE, peerGone: true},
+		{err: &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, peerGone: true},
+		{err: io.ErrClosedPipe, peerGone: true},
+		{err: os.ErrDeadlineExceeded, limit: 3, peerGone: false},
+	}
+	for _, tc := range tests {
+		s := &milterSession{server: &Server{}, conn: &failingConn{err: tc.err, limit: tc.limit}}
+		err := s.WritePacket(RespAccept.Response())
+		var werr *WriteError
+		if !errors.As(err, &werr) {
+			t.Fatalf("%v: expected *WriteError, got %v", tc.err, err)
+		}
+		if werr.PeerGone != tc.peerGone {
+			t.Errorf("%v: wrong PeerGone: %v", tc.err, werr.PeerGone)
+		}
+		if werr.Written != int64(tc.limit) {
+			t.Errorf("%v: wrong Written: %v", tc.err, werr.Written)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: error not wrapped: %v", tc.err, err)
+		}
+	}
+}
+
+type batchMilter struct {
+	NoOpMilter
+	rcpts []Recipient
+	total int
+}
+
+func (bm *batchMilter) RcptBatch(rcpts []Recipient, total int, m *Modifier) (Response, error) {
+	bm.rcpts = rcpts
+	bm.total = total
+	return RespContinue, nil
+}
+
+func TestServer_RcptBatch(t *testing.T) {
+	var bm batchMilter
+	store := memorySessionStore{states: make(map[string]*SessionState)}
+	s := Server{
+		NewMilter: func() Milter {
+			return &bm
+		},
+		MaxRecipients: 2,
+		SessionStore:  &store,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Mail("from@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"to1@example.org", "to2@example.org", "to3@example.org"} {
+		act, err := session.Rcpt(rcpt, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act.Code != ActContinue {
+			t.Fatal("Unexpected action:", act.Code)
+		}
+	}
+	if bm.rcpts != nil {
+		t.Fatal("RcptBatch called before the last recipient")
+	}
+
+	store.mu.Lock()
+	if len(store.states) != 1 {
+		t.Error("Wrong amount of checkpoints:", len(store.states))
+	}
+	for _, st := range store.states {
+		if len(st.Rcpts) != 2 {
+			t.Errorf("Wrong amount of checkpointed recipients: %v", st.Rcpts)
+		}
+	}
+	store.mu.Unlock()
+
+	if _, err := session.HeaderEnd(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Recipient{{Addr: "to1@example.org"}, {Addr: "to2@example.org"}}
+	if !reflect.DeepEqual(bm.rcpts, expected) {
+		t.Fatalf("Wrong recipients: %+v", bm.rcpts)
+	}
+	if bm.total != 3 {
+		t.Fatal("Wrong total:", bm.total)
+	}
+}
+
+type replaceBodyMilter struct {
+	NoOpMilter
+	chunks [][]byte
+}
+
+func (rm replaceBodyMilter) Body(m *Modifier) (Response, error) {
+	for _, chunk := range rm.chunks {
+		if err := m.ReplaceBody(chunk); err != nil {
+			return nil, err
+		}
+	}
+	return RespAccept, nil
+}
+
+func TestResult_ReplacementBody(t *testing.T) {
+	chunks := [][]byte{
+		bytes.Repeat([]byte("a"), MaxBodyChunk),
+		bytes.Repeat([]byte("b"), MaxBodyChunk),
+		[]byte("end\n"),
+	}
+	for _, tc := range []struct {
+		name   string
+		chunks [][]byte
+	}{{"none", nil}, {"chunks", chunks}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := Server{
+				NewMilter: func() Milter {
+					return replaceBodyMilter{chunks: tc.chunks}
+				},
+				Actions: OptChangeBody,
+			}
+			defer s.Close()
+			session := startTestSession(t, &s, ClientOptions{})
+			defer session.Close()
+
+			if _, err := session.Mail("from@example.org", nil); err != nil {
+				t.Fatal(err)
+			}
+			res, err := session.EndResult()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Action.Code != ActAccept {
+				t.Fatal("Unexpected action:", res.Action.Code)
+			}
+			if res.BodyReplaced() != (tc.chunks != nil) {
+				t.Fatal("Wrong BodyReplaced:", res.BodyReplaced())
+			}
+			r := res.ReplacementBody()
+			if tc.chunks == nil {
+				if r != nil {
+					t.Fatal("Unexpected replacement body")
+				}
+				return
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := bytes.Join(tc.chunks, nil); !bytes.Equal(b, expected) {
+				t.Fatalf("Wrong replacement body: %v bytes, expected %v", len(b), len(expected))
+			}
+		})
+	}
+}
+
+// flakyConn fails the first write without writing anything
+type flakyConn struct {
+	net.Conn
+	failed bool
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if !c.failed {
+		c.failed = true
+		return 0, os.ErrDeadlineExceeded
+	}
+	return len(b), nil
+}
+
+func (c *flakyConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestServer_ModifyFailResponse(t *testing.T) {
+	for _, batchSize := range []int{0, 10} {
+		var errs []error
+		logger := &testLogger{}
+		s := &Server{
+			NewMilter: func() Milter {
+				return &MockMilter{
+					BodyResp: RespAccept,
+					BodyMod: func(m *Modifier) {
+						errs = append(errs, m.AddHeader("X-A", "a"), m.AddHeader("X-B", "b"))
+					},
+				}
+			},
+			Actions:            OptAddHeader,
+			ModifyBatchSize:    batchSize,
+			ModifyFailResponse: RespTempFail,
+			Logger:             logger,
+		}
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		m := s.newSession(&flakyConn{Conn: c1}, nil)
+		resp, err := m.Process(&Message{Code: byte(CodeEOB)})
+		if err != nil {
+			t.Fatalf("batch size %v: unexpected error: %v", batchSize, err)
+		}
+		if resp != RespTempFail {
+			t.Errorf("batch size %v: wrong response: %v", batchSize, resp)
+		}
+		if batchSize == 0 && (errs[0] == nil || errs[1] != errs[0]) {
+			t.Errorf("batch size %v: modifications not abandoned: %v", batchSize, errs)
+		}
+		if len(logger.msgs) != 1 {
+			t.Errorf("batch size %v: expected failure to be logged: %v", batchSize, logger.msgs)
+		}
+	}
+}
@@ -3,35 +3,176 @@ package milter
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/textproto"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var errCloseSession = errors.New("Stop current milter processing")
 
+// PanicError is reported to Server.ErrorHook when a Milter callback panics.
+type PanicError struct {
+	// Value passed to panic.
+	Value interface{}
+	// Stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("milter: panic: %v", err.Value)
+}
+
+// WriteError is reported to Server.ErrorHook when the server fails to write a
+// packet to the MTA.
+type WriteError struct {
+	Err error
+	// PeerGone is set if the failure was caused by the MTA closing the
+	// connection, as opposed to a local error such as a timeout.
+	PeerGone bool
+	// Written is the amount of bytes of the packet sent before the failure.
+	// A partially written packet leaves the stream out of sync.
+	Written int64
+}
+
+func (err *WriteError) Error() string {
+	if err.PeerGone {
+		return "milter: write: peer gone: " + err.Err.Error()
+	}
+	return "milter: write: " + err.Err.Error()
+}
+
+func (err *WriteError) Unwrap() error {
+	return err.Err
+}
+
+func newWriteError(err error, written int64) *WriteError {
+	peerGone := errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+	return &WriteError{Err: err, PeerGone: peerGone, Written: written}
+}
+
 // milterSession keeps session state during MTA communication
 type milterSession struct {
+	id       string
+	start    time.Time
 	server   *Server
+	factory  *sessionFactory
+	state    ConnState
+	version  uint32
 	actions  OptAction
 	protocol OptProtocol
 	conn     net.Conn
-	headers  textproto.MIMEHeader
-	macros   map[string]string
-	backend  Milter
+	connInfo ConnInfo
+	// set for the sessions of Server.SelfTest
+	selfTest bool
+
+	nulPolicy NULPolicy
+	// command being processed
+	stage Code
+	// order of the commands, see Server.StrictProtocol
+	protoState protocolState
+	headers    textproto.MIMEHeader
+	// header fields of the current message, in order and as received
+	headerFields []HeaderField
+	macros       macroStore
+	// connection-scoped macros set by Server.Enrichers
+	pseudoMacros map[string]string
+	// values of Modifier.SessionValues and MessageValues
+	sessionValues *Values
+	messageValues *Values
+	backend       Milter
+
+	hasher         *bodyHasher
+	body           *bodyBuffer
+	bodyHashes     map[string][]byte
+	bodySize       int64
+	eomBodySize    int64
+	headerSnapshot []HeaderField
+	tempFiles      *tempFiles
+
+	connCtx    context.Context
+	connCancel context.CancelFunc
+	msgCtx     context.Context
+	msgCancel  context.CancelFunc
+	cmdCtx     context.Context
+	// profiler labels of the session, nil if disabled
+	labelCtx context.Context
+	// pending audit record, nil if Server.Audit is not set
+	audit *AuditRecord
+	// modifications of the message, nil if Server.BufferModifications is
+	// not set
+	modQueue *modQueue
+
+	// set while a message is in progress, accessed atomically
+	active int32
+
+	envFrom  string
+	mailArgs ESMTPArgs
+	envRcpts []string
+
+	skipBody     bool
+	rcpts        []Recipient
+	rcptCount    int
+	rcptsFlushed bool
+
+	// size of the state buffered for the last message, see memSize
+	msgMemSize int
+	// number of messages ended on the connection
+	messages int
 }
 
 // ReadPacket reads incoming milter packet
 func (c *milterSession) ReadPacket() (*Message, error) {
-	return readPacket(c.conn, 0)
+	d := c.server.ReadTimeout
+	if !c.inMessage() {
+		d = c.server.IdleTimeout
+	}
+	return readPacket(c.conn, timeout(d), maxPacketSize(c.server.MaxPacketSize))
 }
 
-func readPacket(conn net.Conn, timeout time.Duration) (*Message, error) {
+// Default maximum size of a packet, large enough for the biggest packets sent
+// by libmilter.
+const defaultMaxPacketSize = 1024 * 1024
+
+// PacketSizeError is returned when a packet received from the peer exceeds
+// the maximum packet size. The connection is closed.
+type PacketSizeError struct {
+	Size uint32
+	Max  uint32
+}
+
+func (err *PacketSizeError) Error() string {
+	if err.Size == 0 {
+		return "milter: empty packet"
+	}
+	return fmt.Sprintf("milter: packet too large: %v > %v bytes", err.Size, err.Max)
+}
+
+// maxPacketSize returns the effective value of a maximum packet size option
+func maxPacketSize(n int) uint32 {
+	switch {
+	case n == 0:
+		return defaultMaxPacketSize
+	case n < 0:
+		return 0
+	default:
+		return uint32(n)
+	}
+}
+
+// readPacket reads a packet. If maxSize is non-zero, packets larger than
+// maxSize are rejected.
+func readPacket(conn net.Conn, timeout time.Duration, maxSize uint32) (*Message, error) {
 	if timeout != 0 {
 		conn.SetReadDeadline(time.Now().Add(timeout))
 		defer conn.SetReadDeadline(time.Time{})
@@ -42,6 +183,9 @@ func readPacket(conn net.Conn, timeout time.Duration) (*Message, error) {
 	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
 		return nil, err
 	}
+	if length == 0 || (maxSize != 0 && length > maxSize) {
+		return nil, &PacketSizeError{Size: length, Max: maxSize}
+	}
 
 	// read packet data
 	data := make([]byte, length)
@@ -60,17 +204,57 @@ func readPacket(conn net.Conn, timeout time.Duration) (*Message, error) {
 
 // WritePacket sends a milter response packet to socket stream
 func (m *milterSession) WritePacket(msg *Message) error {
-	return writePacket(m.conn, msg, 0)
+	if err := checkResponse(msg); err != nil {
+		return newWriteError(err, 0)
+	}
+	n, err := writePacketN(m.conn, msg, timeout(m.server.WriteTimeout))
+	if err != nil {
+		return newWriteError(err, n)
+	}
+	return nil
 }
 
 func writePacket(conn net.Conn, msg *Message, timeout time.Duration) error {
+	_, err := writePacketN(conn, msg, timeout)
+	return err
+}
+
+// writePacketN is like writePacket, but also returns the amount of bytes
+// written to conn
+func writePacketN(conn net.Conn, msg *Message, timeout time.Duration) (int64, error) {
 	if timeout != 0 {
 		conn.SetWriteDeadline(time.Now().Add(timeout))
 		defer conn.SetWriteDeadline(time.Time{})
 	}
 
-	buffer := bufio.NewWriter(conn)
+	cw := &countingWriter{w: conn}
+	buffer := bufio.NewWriter(cw)
+
+	if err := encodePacket(buffer, msg); err != nil {
+		return cw.n, err
+	}
+
+	// flush data to network socket stream
+	if err := buffer.Flush(); err != nil {
+		return cw.n, err
+	}
 
+	return cw.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// encodePacket writes a milter packet to a buffer
+func encodePacket(buffer *bufio.Writer, msg *Message) error {
 	// calculate and write response length
 	length := uint32(len(msg.Data) + 1)
 	if err := binary.Write(buffer, binary.BigEndian, length); err != nil {
@@ -87,33 +271,126 @@ func writePacket(conn net.Conn, msg *Message, timeout time.Duration) error {
 		return err
 	}
 
-	// flush data to network socket stream
-	if err := buffer.Flush(); err != nil {
+	return nil
+}
+
+// eomWriter batches the modification actions written at end of message.
+// After each batch, a progress packet is sent and the writer pauses, so that
+// long bursts don't trip the MTA end-of-message timeout on slow links.
+type eomWriter struct {
+	conn    net.Conn
+	buffer  *bufio.Writer
+	size    int
+	delay   time.Duration
+	timeout time.Duration
+	n       int
+}
+
+func newEOMWriter(conn net.Conn, size int, delay, timeout time.Duration) *eomWriter {
+	return &eomWriter{
+		conn:    conn,
+		buffer:  bufio.NewWriter(conn),
+		size:    size,
+		delay:   delay,
+		timeout: timeout,
+	}
+}
+
+// WritePacket queues a packet and flushes the batch once it is complete
+func (w *eomWriter) WritePacket(msg *Message) error {
+	if err := encodePacket(w.buffer, msg); err != nil {
 		return err
 	}
+	w.n++
+	if w.n%w.size != 0 {
+		return nil
+	}
+
+	if err := encodePacket(w.buffer, &Message{Code: 'p' /* progress */}); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if w.delay != 0 {
+		time.Sleep(w.delay)
+	}
+	return nil
+}
 
+// Flush writes any queued packets. Errors are reported as *WriteError.
+func (w *eomWriter) Flush() error {
+	if w.timeout != 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		defer w.conn.SetWriteDeadline(time.Time{})
+	}
+	buffered := w.buffer.Buffered()
+	if err := w.buffer.Flush(); err != nil {
+		return newWriteError(err, int64(buffered-w.buffer.Buffered()))
+	}
 	return nil
 }
 
 // Process processes incoming milter commands
 func (m *milterSession) Process(msg *Message) (Response, error) {
+	m.stage = Code(msg.Code)
+	if h, ok := m.server.rawHandlers[Code(msg.Code)]; ok {
+		return callback(h(msg, newModifier(m)))
+	}
+
+	switch Code(msg.Code) {
+	case CodeData, CodeHeader, CodeEOH, CodeBody, CodeEOB:
+		// recipients are complete, deliver them if batched
+		resp, err := m.flushRcptBatch()
+		if err != nil || (resp != nil && !resp.Continue()) {
+			return resp, err
+		}
+	}
+
 	switch Code(msg.Code) {
 	case CodeAbort:
 		// abort current message and start over
 		defer func() {
 			m.headers = nil
-			m.macros = nil
+			m.resetMessage()
+			atomic.StoreInt32(&m.active, 0)
 		}()
-		return nil, m.backend.Abort(newModifier(m))
+		return callback(nil, m.handlers().Abort(newModifier(m)))
 
 	case CodeBody:
 		// body chunk
-		return m.backend.BodyChunk(msg.Data, newModifier(m))
+		m.hasher.Write(msg.Data)
+		m.bodySize += int64(len(msg.Data))
+		if m.body != nil {
+			// errors are reported by Modifier.BodyReader
+			m.body.Write(msg.Data)
+		}
+		if m.skipBody {
+			return RespContinue, nil
+		}
+		resp, err := callback(m.handlers().BodyChunk(msg.Data, newModifier(m)))
+		if resp == RespSkip {
+			m.skipBody = true
+			if m.protocol&OptSkip == 0 {
+				// the MTA doesn't support skipping, ignore remaining chunks
+				return RespContinue, err
+			}
+		}
+		return resp, err
 
 	case CodeConn:
+		if m.server.Draining() {
+			return RespTempFail, nil
+		}
 		// new connection, get hostname
-		hostname := readCString(msg.Data)
-		msg.Data = msg.Data[len(hostname)+1:]
+		hostname, data, err := m.nulPolicy.readCString(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = data
+		if len(msg.Data) == 0 {
+			return RespTempFail, nil
+		}
 		// get protocol family
 		protocolFamily := msg.Data[0]
 		msg.Data = msg.Data[1:]
@@ -127,7 +404,10 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 			msg.Data = msg.Data[2:]
 		}
 		// get address
-		address := readCString(msg.Data)
+		address, err := m.nulPolicy.readString(msg.Data)
+		if err != nil && protocolFamily != 'U' {
+			return nil, err
+		}
 		// convert address and port to human readable string
 		family := map[byte]string{
 			'U': "unknown",
@@ -135,27 +415,42 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 			'4': "tcp4",
 			'6': "tcp6",
 		}
+		addr := net.ParseIP(address)
+		m.enrich(addr)
 		// run handler and return
-		return m.backend.Connect(
+		return callback(m.handlers().Connect(
 			hostname,
 			family[protocolFamily],
 			port,
-			net.ParseIP(address),
-			newModifier(m))
+			addr,
+			newModifier(m)))
 
 	case CodeMacro:
-		// define macros
-		m.macros = make(map[string]string)
+		// define macros for the stage of the command in the first byte
+		if len(msg.Data) == 0 {
+			return nil, nil
+		}
 		// convert data to Go strings
-		data := decodeCStrings(msg.Data[1:])
-		if len(data) != 0 {
-			if len(data)%2 == 1 {
-				data = append(data, "")
+		data, err := m.nulPolicy.decodeCStrings(msg.Data[1:])
+		if err != nil {
+			return nil, err
+		}
+		if len(data)%2 == 1 {
+			data = append(data, "")
+		}
+		// store data in a map
+		macros := make(map[string]string, len(data)/2)
+		for i := 0; i < len(data); i += 2 {
+			macros[data[i]] = data[i+1]
+		}
+		m.macros.set(Code(msg.Data[0]), macros)
+		if h, ok := m.backend.(MacrosHandler); ok {
+			raw := make(map[string]string, len(macros))
+			for k, v := range macros {
+				raw[k] = v
 			}
-
-			// store data in a map
-			for i := 0; i < len(data); i += 2 {
-				m.macros[data[i]] = data[i+1]
+			if _, err := callback(nil, h.Macros(Code(msg.Data[0]), raw)); err != nil {
+				return nil, err
 			}
 		}
 		// do not send response
@@ -163,12 +458,64 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 
 	case CodeEOB:
 		// call and return milter handler
-		return m.backend.Body(newModifier(m))
+		m.bodyHashes = m.hasher.Sums()
+		m.eomBodySize = m.bodySize
+		m.headerSnapshot = append([]HeaderField(nil), m.headerFields...)
+		m.messages++
+		defer m.resetMessage()
+		mod := newModifier(m)
+		var w *eomWriter
+		if m.server.ModifyBatchSize != 0 {
+			w = newEOMWriter(m.conn, m.server.ModifyBatchSize, m.server.ModifyBatchDelay, timeout(m.server.WriteTimeout))
+			mod.writer = m.actionWriter(ActionWriterFunc(w.WritePacket))
+		}
+		var keepAlive *progressKeepAlive
+		if d := m.server.ProgressInterval; d > 0 {
+			keepAlive = m.startKeepAlive(d)
+			// stop before the response is written, even on panic
+			defer keepAlive.stop()
+			mod.writer = keepAlive.actionWriter(mod.writer)
+		}
+		// with soft-fail, the first failed write abandons the remaining
+		// modifications
+		var modifyErr error
+		if m.server.ModifyFailResponse != nil {
+			writer := mod.writer
+			mod.writer = ActionWriterFunc(func(msg *Message) error {
+				if modifyErr == nil {
+					modifyErr = writer.WriteAction(msg)
+				}
+				return modifyErr
+			})
+		}
+		resp, err := callback(m.backend.Body(mod))
+		if m.modQueue != nil && err == nil {
+			err = m.flushModifications(mod)
+		}
+		if keepAlive != nil {
+			if kaErr := keepAlive.stop(); kaErr != nil {
+				m.logf("Error sending progress: %v", kaErr)
+			}
+		}
+		if w != nil && modifyErr == nil {
+			if flushErr := w.Flush(); flushErr != nil && m.server.ModifyFailResponse != nil {
+				modifyErr = flushErr
+			} else if flushErr != nil && err == nil {
+				err = flushErr
+			}
+		}
+		if modifyErr != nil {
+			return m.modifyFailed(modifyErr)
+		}
+		return resp, err
 
 	case CodeHelo:
 		// helo command
-		name := strings.TrimSuffix(string(msg.Data), null)
-		return m.backend.Helo(name, newModifier(m))
+		name, err := m.nulPolicy.readString(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		return callback(m.handlers().Helo(name, newModifier(m)))
 
 	case CodeHeader:
 		// make sure headers is initialized
@@ -176,94 +523,664 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 			m.headers = make(textproto.MIMEHeader)
 		}
 		// add new header to headers map
-		headerData := decodeCStrings(msg.Data)
-		// headers with an empty body appear as `text\x00\x00`, decodeCStrings will drop the empty body
-		if len(headerData) == 1 {
-			headerData = append(headerData, "")
+		name, data, err := m.nulPolicy.readCString(msg.Data)
+		if err != nil {
+			return nil, err
 		}
-		if len(headerData) == 2 {
-			m.headers.Add(headerData[0], headerData[1])
-			// call and return milter handler
-			return m.backend.Header(headerData[0], headerData[1], newModifier(m))
+		value, err := m.nulPolicy.readString(data)
+		if err != nil {
+			return nil, err
 		}
+		m.headers.Add(name, value)
+		m.headerFields = append(m.headerFields, HeaderField{Key: name, Value: value})
+		// call and return milter handler
+		return callback(m.handlers().Header(name, value, newModifier(m)))
 
 	case CodeMail:
+		// the actions sent for the connection are audited separately
+		m.flushAudit()
+		// discard the modifications of a message rejected without abort
+		if m.modQueue != nil {
+			m.modQueue.reset()
+		}
+		if m.messagesExhausted() && m.protocol&OptNoMailReply != 0 {
+			// the temporary failure would be discarded, see checkNoReply
+			m.logf("Closing connection: %v messages processed", m.messages)
+			return nil, errCloseSession
+		}
+		if m.server.Draining() || m.server.LoadShedder.refuse() || m.messagesExhausted() {
+			return RespTempFail, nil
+		}
+		atomic.StoreInt32(&m.active, 1)
 		// envelope from address
-		from := readCString(msg.Data)
-		return m.backend.MailFrom(strings.Trim(from, "<>"), newModifier(m))
+		from, data, err := m.nulPolicy.readCString(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		args, err := m.nulPolicy.decodeCStrings(data)
+		if err != nil {
+			return nil, err
+		}
+		m.envFrom = strings.Trim(from, "<>")
+		m.mailArgs = args
+		return callback(m.handlers().MailFrom(m.envFrom, newModifier(m)))
 
 	case CodeEOH:
 		// end of headers
-		return m.backend.Headers(m.headers, newModifier(m))
+		if _, ok := unwrapMilter(m.backend).(OrderedHeadersHandler); ok {
+			return callback(m.handlers().OrderedHeaders(orderedHeader(m.headerFields, m.protocol), newModifier(m)))
+		}
+		return callback(m.handlers().Headers(m.headers, newModifier(m)))
 
 	case CodeOptNeg:
-		// ignore request and prepare response buffer
+		if len(msg.Data) < 4*3 {
+			return nil, fmt.Errorf("milter: negotiate: unexpected data size: %v", len(msg.Data))
+		}
+		mtaVersion := binary.BigEndian.Uint32(msg.Data)
+		mtaActions := OptAction(binary.BigEndian.Uint32(msg.Data[4:]))
+		mtaProtocol := OptProtocol(binary.BigEndian.Uint32(msg.Data[8:]))
+		negotiationError := func(err error) error {
+			return &NegotiationError{Err: err, Version: mtaVersion, Actions: mtaActions, Protocol: mtaProtocol}
+		}
+		if mtaVersion < minProtocolVersion {
+			return nil, negotiationError(fmt.Errorf("milter: negotiate: unsupported protocol version: %v", mtaVersion))
+		}
+		if mtaVersion < m.server.MinVersion {
+			return nil, negotiationError(fmt.Errorf("%w: version %v < %v", ErrNegotiationPolicy, mtaVersion, m.server.MinVersion))
+		}
+		if missing := m.server.RequiredActions &^ mtaActions; missing != 0 {
+			return nil, negotiationError(fmt.Errorf("%w: missing actions 0x%x", ErrNegotiationPolicy, uint32(missing)))
+		}
+		// use the lowest protocol version supported by both sides
+		m.version = serverProtocolVersion
+		if mtaVersion < m.version {
+			m.version = mtaVersion
+		}
+		// only keep what was requested by the server and offered by the MTA
+		actions, protocol := m.factory.Actions, m.factory.Protocol
+		macroRequests := m.server.MacroRequests
+		if m.server.Negotiate != nil {
+			reply, err := m.server.Negotiate(NegotiationOffer{
+				Conn:     m.connInfo,
+				Version:  mtaVersion,
+				Actions:  mtaActions,
+				Protocol: mtaProtocol,
+			})
+			if err != nil {
+				return nil, negotiationError(fmt.Errorf("milter: negotiate: %w", err))
+			}
+			if reply.Version != 0 {
+				if reply.Version < minProtocolVersion || reply.Version > m.version {
+					return nil, negotiationError(fmt.Errorf("milter: negotiate: invalid version: %v", reply.Version))
+				}
+				m.version = reply.Version
+			}
+			actions, protocol, macroRequests = reply.Actions, reply.Protocol, reply.MacroRequests
+		} else if _, ok := unwrapMilter(m.backend).(Negotiator); ok {
+			var err error
+			actions, protocol, err = m.handlers().Negotiate(mtaVersion, mtaActions, mtaProtocol)
+			if err != nil {
+				return nil, negotiationError(fmt.Errorf("milter: negotiate: %w", err))
+			}
+		}
+		if len(macroRequests) != 0 {
+			actions |= OptSetSymList
+		}
+		m.actions = actions & mtaActions
+		m.protocol = protocol & mtaProtocol
+		// v6 actions and protocol options are only available in v6
+		if m.version < 6 {
+			m.actions &= v2ActionMask
+			m.protocol &= v2ProtocolMask
+		}
+		// prepare response buffer
 		var buffer bytes.Buffer
 		// prepare response data
-		for _, value := range []uint32{serverProtocolVersion, uint32(m.actions), uint32(m.protocol)} {
+		for _, value := range []uint32{m.version, uint32(m.actions), uint32(m.protocol)} {
 			if err := binary.Write(&buffer, binary.BigEndian, value); err != nil {
 				return nil, err
 			}
 		}
+		data := buffer.Bytes()
+		// request the macros needed by the server
+		if m.actions&OptSetSymList != 0 {
+			var err error
+			data, err = appendMacroRequests(data, macroRequests)
+			if err != nil {
+				return nil, err
+			}
+		}
 		// build and send packet
-		return NewResponse('O', buffer.Bytes()), nil
+		return NewResponse('O', data), nil
 
 	case CodeQuit:
 		// client requested session close
 		return nil, errCloseSession
 
+	case CodeQuitNewConn:
+		// client closed the milter connection, a new one follows on the same
+		// socket: discard the connection state but keep negotiated options
+		if m.messagesExhausted() {
+			m.logf("Closing connection: %v messages processed", m.messages)
+			return nil, errCloseSession
+		}
+		m.headers = nil
+		m.macros.reset()
+		m.pseudoMacros = nil
+		m.sessionValues = &Values{}
+		m.resetMessage()
+		atomic.StoreInt32(&m.active, 0)
+		m.connCancel()
+		m.connCtx, m.connCancel = context.WithCancel(m.server.baseContext())
+		m.backend = m.factory.NewMilter(m.connInfo)
+		// do not send response
+		return nil, nil
+
 	case CodeRcpt:
 		// envelope to address
-		to := readCString(msg.Data)
-		return m.backend.RcptTo(strings.Trim(to, "<>"), newModifier(m))
+		to, data, err := m.nulPolicy.readCString(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		args, err := m.nulPolicy.decodeCStrings(data)
+		if err != nil {
+			return nil, err
+		}
+		to = strings.Trim(to, "<>")
+		if m.rcptRejected() {
+			// not a recipient of the message, always reported alone
+			mod := newModifier(m)
+			mod.RcptArgs = args
+			mod.rcptRejected = true
+			return callback(m.handlers().RcptTo(to, mod))
+		}
+		tracked := m.server.MaxRecipients == 0 || len(m.envRcpts) < m.server.MaxRecipients
+		if tracked {
+			m.envRcpts = append(m.envRcpts, to)
+		}
+		if _, ok := unwrapMilter(m.backend).(RcptBatcher); ok {
+			m.rcptCount++
+			if tracked {
+				m.rcpts = append(m.rcpts, Recipient{Addr: to, Args: args})
+			}
+			return RespContinue, nil
+		}
+		mod := newModifier(m)
+		mod.RcptArgs = args
+		return callback(m.handlers().RcptTo(to, mod))
 
 	case CodeData:
-		// data, ignore
+		return callback(m.handlers().Data(newModifier(m)))
+
+	case CodeUnknown:
+		// unrecognized SMTP command
+		cmd, err := m.nulPolicy.readString(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		return callback(m.handlers().Unknown(cmd, newModifier(m)))
 
 	default:
+		if h := m.server.OnUnknownMessage; h != nil {
+			return callback(h(msg))
+		}
 		// print error and close session
-		log.Printf("Unrecognized command code: %c", msg.Code)
+		m.logf("Unrecognized command code: %c", msg.Code)
 		return nil, errCloseSession
 	}
+}
+
+// processWatch is like processRecover, but the context of the connection is
+// cancelled if the MTA closes the connection while the command is processed
+func (m *milterSession) processWatch(msg *Message) (Response, error) {
+	wc, ok := m.conn.(*watchConn)
+	switch Code(msg.Code) {
+	case CodeOptNeg, CodeMacro, CodeQuit, CodeQuitNewConn:
+		// no callback involved
+		ok = false
+	}
+	if !ok {
+		return m.processRecover(msg)
+	}
+	stop := wc.watch(m.connCancel)
+	defer stop()
+	return m.processInPool(msg)
+}
+
+// processRecover is like Process, but panics are recovered and returned as
+// *PanicError
+func (m *milterSession) processRecover(msg *Message) (resp Response, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			resp = nil
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	defer m.setStageLabels(Code(msg.Code))()
+	endSpan := m.startStageSpan(Code(msg.Code))
+	defer func() {
+		endSpan(resp)
+	}()
+	if d := m.server.CommandTimeout; d != 0 {
+		var cancel context.CancelFunc
+		m.cmdCtx, cancel = context.WithTimeout(m.context(), d)
+		defer func() {
+			cancel()
+			m.cmdCtx = nil
+		}()
+	}
+	return m.Process(msg)
+}
 
-	// by default continue with next milter message
-	return RespContinue, nil
+// noReplyOpts maps commands to the protocol options disabling their response
+var noReplyOpts = map[Code]OptProtocol{
+	CodeConn:    OptNoConnReply,
+	CodeHelo:    OptNoHeloReply,
+	CodeMail:    OptNoMailReply,
+	CodeRcpt:    OptNoRcptReply,
+	CodeData:    OptNoDataReply,
+	CodeUnknown: OptNoUnknownReply,
+	CodeHeader:  OptNoHeaderReply,
+	CodeEOH:     OptNoEOHReply,
+	CodeBody:    OptNoBodyReply,
+}
+
+// checkNoReply discards the response to a command if a no-reply option was
+// negotiated for it. Responses other than continue can't be delivered to the
+// MTA in that case and are logged.
+func (m *milterSession) checkNoReply(code Code, resp Response) Response {
+	opt, ok := noReplyOpts[code]
+	if !ok || m.protocol&opt == 0 || resp == nil {
+		return resp
+	}
+	if !resp.Continue() {
+		m.logf("Discarding response %c to command %c: no reply negotiated", resp.Response().Code, code)
+	}
+	return nil
+}
+
+// resetMessage discards the per-message state of the session. The session
+// is still in a message until the caller clears m.active: at end of message,
+// only once the final response has been written.
+func (m *milterSession) resetMessage() {
+	m.msgMemSize = m.memSize()
+	if m.msgCancel != nil {
+		m.msgCancel()
+		m.msgCtx, m.msgCancel = nil, nil
+	}
+	m.hasher.Reset()
+	m.bodyHashes = nil
+	m.bodySize = 0
+	m.eomBodySize = -1
+	m.headers = nil
+	m.headerFields = nil
+	m.headerSnapshot = nil
+	m.tempFiles.Cleanup()
+	if m.body != nil {
+		m.body.Reset()
+	}
+	m.macros.resetMessage()
+	m.envFrom = ""
+	m.mailArgs = nil
+	m.envRcpts = nil
+	m.skipBody = false
+	m.rcpts = nil
+	m.rcptCount = 0
+	m.rcptsFlushed = false
+	m.messageValues = &Values{}
+	if m.modQueue != nil {
+		m.modQueue.reset()
+	}
+}
+
+// flushModifications sends the modifications queued during the message, at
+// end of message.
+func (m *milterSession) flushModifications(mod *Modifier) error {
+	for _, msg := range m.modQueue.take() {
+		if err := mod.send(ModifyActCode(msg.Code), msg.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memSize returns the approximate size in bytes of the state buffered by the
+// session
+func (m *milterSession) memSize() int {
+	n := len(m.envFrom)
+	for _, macros := range m.macros.stages {
+		for k, v := range macros {
+			n += len(k) + len(v)
+		}
+	}
+	for k, v := range m.pseudoMacros {
+		n += len(k) + len(v)
+	}
+	for k, values := range m.headers {
+		for _, v := range values {
+			n += len(k) + len(v)
+		}
+	}
+	for _, f := range m.headerFields {
+		n += len(f.Key) + len(f.Value)
+	}
+	for _, arg := range m.mailArgs {
+		n += len(arg)
+	}
+	if m.body != nil {
+		n += m.body.mem.Len()
+	}
+	if m.modQueue != nil {
+		for _, msg := range m.modQueue.msgs {
+			n += len(msg.Data)
+		}
+	}
+	for _, rcpt := range m.envRcpts {
+		n += len(rcpt)
+	}
+	for _, rcpt := range m.rcpts {
+		n += len(rcpt.Addr)
+		for _, arg := range rcpt.Args {
+			n += len(arg)
+		}
+	}
+	return n
+}
+
+// recycle reports whether the session should be closed between messages
+// because its buffered state grew too large
+func (m *milterSession) recycle() bool {
+	max := m.server.MaxSessionMemory
+	if max <= 0 || m.inMessage() || m.msgMemSize <= max {
+		return false
+	}
+	m.logf("Recycling session: %v bytes buffered, more than %v", m.msgMemSize, max)
+	return true
+}
+
+// messagesExhausted reports whether Server.MaxMessagesPerConn messages have
+// been processed on the connection
+func (m *milterSession) messagesExhausted() bool {
+	max := m.server.MaxMessagesPerConn
+	return max > 0 && m.messages >= max
+}
+
+// context returns the context of the current command if
+// Server.CommandTimeout is set, or else of the current message, derived from
+// the context of the connection
+func (m *milterSession) context() context.Context {
+	if m.cmdCtx != nil {
+		return m.cmdCtx
+	}
+	if m.msgCtx == nil {
+		m.msgCtx, m.msgCancel = context.WithCancel(m.connCtx)
+	}
+	return m.msgCtx
+}
+
+// inMessage reports whether a message is in progress
+func (m *milterSession) inMessage() bool {
+	return atomic.LoadInt32(&m.active) != 0
+}
+
+// rcptRejected reports whether the current recipient has been rejected by
+// the MTA, which is signaled with the "error" mailer
+func (m *milterSession) rcptRejected() bool {
+	return m.protocol&OptRcptRej != 0 && m.macros.stages[CodeRcpt]["{rcpt_mailer}"] == "error"
+}
+
+// handlers returns the callbacks of the backend, continuing the stages it
+// doesn't handle
+func (m *milterSession) handlers() Passthrough {
+	return Passthrough{m.backend}
+}
+
+// flushRcptBatch passes the recipients collected so far to the backend if it
+// implements RcptBatcher. It returns a nil Response if there is nothing to do.
+func (m *milterSession) flushRcptBatch() (Response, error) {
+	_, ok := unwrapMilter(m.backend).(RcptBatcher)
+	if !ok || m.rcptsFlushed || m.rcptCount == 0 {
+		return nil, nil
+	}
+	m.rcptsFlushed = true
+	return callback(m.handlers().RcptBatch(m.rcpts, m.rcptCount, newModifier(m)))
+}
+
+// modifyFailed is called when a modification action could not be written
+// to the MTA with Server.ModifyFailResponse set. The remaining modifications
+// have been abandoned; ModifyFailResponse is sent instead of the response of
+// the filter, unless the stream is out of sync or the MTA is gone.
+func (m *milterSession) modifyFailed(err error) (Response, error) {
+	werr, ok := err.(*WriteError)
+	if !ok || werr.PeerGone || werr.Written != 0 {
+		return nil, err
+	}
+	m.logf("Error writing modification, abandoning remaining modifications: %v", err)
+	return m.server.ModifyFailResponse, nil
+}
+
+// processChecked validates the order of a command, then processes it. Errors
+// of Milter callbacks and protocol violations are handled as configured by
+// Server.OnError and Server.ProtocolViolation.
+func (m *milterSession) processChecked(msg *Message) (Response, error) {
+	code := Code(msg.Code)
+	if err := m.checkProtocol(code); err != nil {
+		return m.handleError(m.server.ProtocolViolation, code, err)
+	}
+	resp, err := m.processWatch(msg)
+	if cerr, ok := err.(*callbackError); ok {
+		resp, err = m.handleError(m.server.OnError, code, cerr.err)
+	}
+	if err == nil {
+		m.protoState.update(code)
+	}
+	return resp, err
+}
+
+// callbackError wraps an error returned by a Milter callback, to tell it
+// apart from protocol errors.
+type callbackError struct {
+	err error
+}
+
+func (err *callbackError) Error() string {
+	return err.err.Error()
+}
+
+func (err *callbackError) Unwrap() error {
+	return err.err
+}
+
+// callback tags the error returned by a Milter callback, see callbackError.
+func callback(resp Response, err error) (Response, error) {
+	if err == nil && resp != nil {
+		err = checkResponse(resp.Response())
+	}
+	if err != nil {
+		err = &callbackError{err}
+	}
+	return resp, err
+}
+
+// handleError applies an error policy to the error of a command, e.g.
+// Server.OnError to the error returned by a Milter callback. A nil error is
+// returned unless the connection must be closed.
+func (m *milterSession) handleError(policy ErrorPolicy, code Code, err error) (Response, error) {
+	var resp Response
+	switch policy {
+	case ErrorTempFail:
+		resp = RespTempFail
+	case ErrorReject:
+		resp = RespReject
+	case ErrorAcceptAndLog:
+		resp = RespAccept
+	default:
+		return nil, err
+	}
+	m.logf("Error performing milter command, responding with %v: %v", policy, err)
+	m.reportError("", err)
+	switch code {
+	case CodeAbort, CodeMacro, CodeQuitNewConn:
+		// the MTA doesn't expect a response
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// handleWriteError is called when a response could not be written to the
+// MTA. The backend is given a chance to release the state of the message in
+// progress and, unless the MTA is gone or the stream is out of sync, a
+// temporary failure is sent so that it doesn't wait for a response forever.
+func (m *milterSession) handleWriteError(err error) {
+	werr, ok := err.(*WriteError)
+	if !ok {
+		werr = newWriteError(err, 0)
+	}
+	m.logf("Error writing packet: %v", werr)
+
+	// at end of message, the state of the message is already released
+	if m.inMessage() && m.stage != CodeEOB {
+		m.handlers().Abort(&Modifier{
+			Macros:  m.allMacros(),
+			Headers: m.headers,
+			writer: ActionWriterFunc(func(*Message) error {
+				return werr
+			}),
+			ctx:       m.context(),
+			tempFiles: m.tempFiles,
+			logf:      m.logf,
+		})
+	}
+
+	if !werr.PeerGone && werr.Written == 0 {
+		// Best effort, the connection may be unusable.
+		writePacket(m.conn, RespTempFail.Response(), time.Second)
+	}
+
+	m.reportError("write", werr)
+}
+
+// logf logs a message about the session through Server.Logger
+func (m *milterSession) logf(format string, v ...interface{}) {
+	if l := m.server.Logger; l != nil {
+		l.Logf(m.id, m.macros.get("i"), format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// reportError passes an error terminating the session to Server.ErrorHook,
+// as a *MilterError. op is "read" or "write" for I/O errors.
+func (m *milterSession) reportError(op string, err error) {
+	if m.server.ErrorHook != nil {
+		m.server.ErrorHook(m.stageError(op, err))
+	}
 }
 
 // HandleMilterComands processes all milter commands in the same connection
 func (m *milterSession) HandleMilterCommands() {
+	defer m.setState(StateClosed)
 	defer m.conn.Close()
+	defer m.tempFiles.Cleanup()
+	defer m.deleteCheckpoint()
+	defer m.startSessionSpan()()
+	defer m.flushAudit()
+	defer func() {
+		m.connCancel()
+	}()
+	m.setState(StateNew)
+	m.setSessionLabels()
+
+	if err := m.tlsHandshake(); err != nil {
+		m.logf("Error performing TLS handshake: %v", err)
+		m.reportError("", err)
+		return
+	}
+	if err := m.checkPeer(); err != nil {
+		m.logf("Closing connection: %v", err)
+		m.reportError("", err)
+		return
+	}
+
+	if m.server.Handshake != nil {
+		if err := m.server.Handshake.ServerHandshake(m.conn); err != nil {
+			m.logf("Error performing handshake: %v", err)
+			m.reportError("", err)
+			return
+		}
+	}
 
 	for {
 		msg, err := m.ReadPacket()
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading milter command: %v", err)
+			if err != io.EOF && !m.server.isShuttingDown() {
+				m.logf("Error reading milter command: %v", err)
+				m.reportError("read", err)
 			}
 			return
 		}
 
-		resp, err := m.Process(msg)
-		if err != nil {
+		resp, err := m.processChecked(msg)
+		if perr, ok := err.(*PanicError); ok {
+			m.logf("Panic performing milter command: %v\n%s", perr.Value, perr.Stack)
+			m.reportError("", perr)
+			resp := m.server.PanicResponse
+			if resp == nil {
+				resp = RespTempFail
+			}
+			if err := m.WritePacket(resp.Response()); err != nil {
+				m.handleWriteError(err)
+				return
+			}
+			m.auditResponse(Code(msg.Code), resp.Response())
+			return
+		} else if err != nil {
 			if err != errCloseSession {
 				// log error condition
-				log.Printf("Error performing milter command: %v", err)
+				m.logf("Error performing milter command: %v", err)
+				m.reportError("", err)
 			}
 			return
 		}
 
+		m.checkpoint(Code(msg.Code))
+
+		// the MTA doesn't expect a response for some stages
+		resp = m.checkNoReply(Code(msg.Code), resp)
+
 		// ignore empty responses
 		if resp != nil {
 			// send back response message
 			if err = m.WritePacket(resp.Response()); err != nil {
-				log.Printf("Error writing packet: %v", err)
+				m.handleWriteError(err)
 				return
 			}
+			m.auditResponse(Code(msg.Code), resp.Response())
 
-			if !resp.Continue() {
+			// rejecting a recipient doesn't end the message
+			if !resp.Continue() && Code(msg.Code) != CodeRcpt {
 				// prepare backend for next message
-				m.backend = m.server.NewMilter()
+				m.backend = m.factory.NewMilter(m.connInfo)
+				atomic.StoreInt32(&m.active, 0)
+				m.protoState.endMessage(Code(msg.Code))
 			}
 		}
+
+		switch Code(msg.Code) {
+		case CodeEOB:
+			// the message is over once its final response is written
+			atomic.StoreInt32(&m.active, 0)
+			m.flushAudit()
+		case CodeAbort, CodeQuitNewConn:
+			m.flushAudit()
+		}
+		m.updateState(Code(msg.Code))
+
+		if m.server.isShuttingDown() && !m.inMessage() {
+			return
+		}
+		if m.recycle() {
+			return
+		}
 	}
 }
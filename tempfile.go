@@ -0,0 +1,87 @@
+package milter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// ErrTempQuota is returned when writing to a temporary file would exceed
+// Server.TempQuota.
+var ErrTempQuota = errors.New("milter: temporary file quota exceeded")
+
+// TempFile is a temporary file allocated for the current message with
+// Modifier.TempFile. It is removed automatically at end of message, when the
+// message is aborted and when the connection is closed.
+type TempFile struct {
+	f     *os.File
+	files *tempFiles
+}
+
+// Name returns the path of the file.
+func (f *TempFile) Name() string {
+	return f.f.Name()
+}
+
+// Read implements io.Reader.
+func (f *TempFile) Read(b []byte) (int, error) {
+	return f.f.Read(b)
+}
+
+// Seek implements io.Seeker.
+func (f *TempFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+// Write implements io.Writer. It fails with ErrTempQuota if the total size
+// written to the temporary files of the message would exceed
+// Server.TempQuota.
+func (f *TempFile) Write(b []byte) (int, error) {
+	if f.files.quota != 0 && f.files.size+int64(len(b)) > f.files.quota {
+		return 0, ErrTempQuota
+	}
+	n, err := f.f.Write(b)
+	f.files.size += int64(n)
+	return n, err
+}
+
+// tempFiles keeps track of the temporary files allocated for the current
+// message.
+type tempFiles struct {
+	dir   string
+	quota int64
+	size  int64
+	files []*os.File
+}
+
+func newTempFiles(dir string, quota int64) *tempFiles {
+	return &tempFiles{dir: dir, quota: quota}
+}
+
+// Create allocates a new temporary file.
+func (t *tempFiles) Create() (*TempFile, error) {
+	f, err := ioutil.TempFile(t.dir, "milter-")
+	if err != nil {
+		return nil, err
+	}
+	t.files = append(t.files, f)
+	return &TempFile{f: f, files: t}, nil
+}
+
+// Cleanup closes and removes all temporary files.
+func (t *tempFiles) Cleanup() {
+	for _, f := range t.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	t.files = nil
+	t.size = 0
+}
+
+// TempFile allocates a temporary file in Server.TempDir, for instance to
+// spill a large body to disk or to extract attachments. The file is removed
+// automatically at end of message, when the message is aborted and when the
+// connection is closed.
+func (m *Modifier) TempFile() (*TempFile, error) {
+	return m.tempFiles.Create()
+}
@@ -0,0 +1,101 @@
+package milter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for 127.0.0.1, usable by
+// both servers and clients.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "milter test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+
+	peerCerts := make(chan int, 1)
+	s := Server{
+		NewMilterWithConn: func(info ConnInfo) Milter {
+			if info.TLS != nil {
+				peerCerts <- len(info.TLS.PeerCertificates)
+			}
+			return NoOpMilter{}
+		},
+	}
+	defer s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}))
+
+	cl := NewClientWithOptions("tcp", ln.Addr().String(), ClientOptions{
+		TLSConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{cert},
+		},
+	})
+	session, err := cl.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	act, err := session.Helo("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != ActContinue {
+		t.Fatal("Unexpected action:", act.Code)
+	}
+	if n := <-peerCerts; n != 1 {
+		t.Fatal("Wrong amount of peer certificates:", n)
+	}
+
+	// without a client certificate
+	cl = NewClientWithOptions("tcp", ln.Addr().String(), ClientOptions{
+		TLSConfig: &tls.Config{RootCAs: pool},
+	})
+	if session, err := cl.Session(); err == nil {
+		session.Close()
+		t.Fatal("Expected an error without client certificate")
+	}
+}
@@ -0,0 +1,70 @@
+package milter
+
+import (
+	"context"
+)
+
+// Tracer creates tracing spans for server sessions. It can be implemented on
+// top of a tracing library such as OpenTelemetry, without adding a
+// dependency to this package.
+//
+// A span is created for each session and a child span for each stage of the
+// milter protocol. The contexts returned by StartSpan are passed on to
+// callbacks by Modifier.Context, so filters can create their own child spans.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a tracing span created by a Tracer.
+type Span interface {
+	SetAttribute(key, value string)
+	End()
+}
+
+// spanNames maps commands to the names of their spans
+var spanNames = map[Code]string{
+	CodeConn:    "milter.connect",
+	CodeHelo:    "milter.helo",
+	CodeMail:    "milter.mail",
+	CodeRcpt:    "milter.rcpt",
+	CodeData:    "milter.data",
+	CodeEOH:     "milter.headers",
+	CodeBody:    "milter.body",
+	CodeEOB:     "milter.eom",
+	CodeUnknown: "milter.unknown",
+}
+
+// startSessionSpan starts the span of the session, if Server.Tracer is set.
+// The returned function ends it.
+func (m *milterSession) startSessionSpan() func() {
+	tracer := m.server.Tracer
+	if tracer == nil {
+		return func() {}
+	}
+	var span Span
+	m.connCtx, span = tracer.StartSpan(m.connCtx, "milter.session")
+	span.SetAttribute("milter.session_id", m.id)
+	return span.End
+}
+
+// startStageSpan starts the span of a command, if Server.Tracer is set. The
+// returned function ends it, recording the queue ID and the response.
+func (m *milterSession) startStageSpan(code Code) func(resp Response) {
+	tracer := m.server.Tracer
+	name, ok := spanNames[code]
+	if tracer == nil || !ok {
+		return func(Response) {}
+	}
+	var span Span
+	m.cmdCtx, span = tracer.StartSpan(m.context(), name)
+	return func(resp Response) {
+		m.cmdCtx = nil
+		if id := m.macros.get("i"); id != "" {
+			span.SetAttribute("milter.queue_id", id)
+		}
+		if resp != nil {
+			span.SetAttribute("milter.action", string(rune(resp.Response().Code)))
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,303 @@
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Transaction is an SMTP transaction which can be replayed to a milter, for
+// instance to reproduce a filter decision from a production log.
+type Transaction struct {
+	// Connection information.
+	Hostname string
+	Family   ProtoFamily
+	Port     uint16
+	Addr     string
+
+	Helo string
+
+	From     string
+	FromArgs []string
+	Rcpts    []TransactionRcpt
+
+	Header textproto.Header
+	Body   []byte
+}
+
+// TransactionRcpt is an envelope recipient of a Transaction.
+type TransactionRcpt struct {
+	Addr string
+	Args []string
+}
+
+// ParseTranscript parses the transcript of an SMTP session.
+//
+// Lines may be prefixed with "C: " for client commands and "S: " for server
+// replies, which are ignored. Lines without prefix are client commands. The
+// HELO/EHLO, MAIL, RCPT and DATA commands are used, other commands are
+// ignored. The connection information can be specified with a pseudo
+// command:
+//
+//	CONNECT <hostname> <address> [port]
+//
+// If missing, the connection is reported from localhost.
+func ParseTranscript(r io.Reader) (*Transaction, error) {
+	return parseTranscript(bufio.NewReader(r), true)
+}
+
+// ParseEnvelope parses a transaction stored as an envelope and a message,
+// for instance files saved by a quarantine. The envelope uses the transcript
+// syntax of ParseTranscript without the DATA command, e.g.:
+//
+//	CONNECT mail.example.com 192.0.2.1
+//	MAIL FROM:<from@example.com>
+//	RCPT TO:<to@example.org>
+//
+// The message is read as is, without dot-stuffing.
+func ParseEnvelope(envelope, msg io.Reader) (*Transaction, error) {
+	t, err := parseTranscript(bufio.NewReader(envelope), false)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.setMessage(bufio.NewReader(msg)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func parseTranscript(br *bufio.Reader, allowData bool) (*Transaction, error) {
+	t := &Transaction{
+		Hostname: "localhost",
+		Family:   FamilyInet,
+		Port:     25,
+		Addr:     "127.0.0.1",
+	}
+
+	prefixed := false
+	for {
+		line, hasPrefix, err := readTranscriptLine(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		prefixed = prefixed || hasPrefix
+		if line == "" {
+			continue
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "CONNECT":
+			if err := t.parseConnect(arg); err != nil {
+				return nil, err
+			}
+		case "HELO", "EHLO":
+			t.Helo = arg
+		case "MAIL":
+			addr, args, err := parseTranscriptPath(arg, "FROM:")
+			if err != nil {
+				return nil, err
+			}
+			t.From, t.FromArgs = addr, args
+		case "RCPT":
+			addr, args, err := parseTranscriptPath(arg, "TO:")
+			if err != nil {
+				return nil, err
+			}
+			t.Rcpts = append(t.Rcpts, TransactionRcpt{Addr: addr, Args: args})
+		case "DATA":
+			if !allowData {
+				return nil, fmt.Errorf("milter: transcript: unexpected DATA in envelope")
+			}
+			if err := t.readData(br, prefixed); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// readTranscriptLine reads the next client line, skipping server replies. It
+// reports whether the line had a "C:" or "S:" prefix.
+func readTranscriptLine(br *bufio.Reader) (line string, prefixed bool, err error) {
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return "", false, err
+		}
+		if strings.HasPrefix(line, "S:") {
+			prefixed = true
+			continue
+		}
+		if rest, ok := trimClientPrefix(line); ok {
+			return rest, true, nil
+		}
+		return line, prefixed, nil
+	}
+}
+
+// readLine reads a line without its line ending.
+func readLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// trimClientPrefix removes the "C:" prefix of a client line, and the space
+// following it.
+func trimClientPrefix(line string) (string, bool) {
+	if !strings.HasPrefix(line, "C:") {
+		return line, false
+	}
+	return strings.TrimPrefix(line[2:], " "), true
+}
+
+func (t *Transaction) parseConnect(arg string) error {
+	fields := strings.Fields(arg)
+	if len(fields) < 2 {
+		return fmt.Errorf("milter: transcript: malformed CONNECT: %q", arg)
+	}
+	t.Hostname, t.Addr = fields[0], fields[1]
+	if strings.Contains(t.Addr, ":") {
+		t.Family = FamilyInet6
+	} else {
+		t.Family = FamilyInet
+	}
+	if len(fields) > 2 {
+		port, err := strconv.ParseUint(fields[2], 10, 16)
+		if err != nil {
+			return fmt.Errorf("milter: transcript: malformed CONNECT port: %q", fields[2])
+		}
+		t.Port = uint16(port)
+	}
+	return nil
+}
+
+// parseTranscriptPath parses the argument of a MAIL or RCPT command.
+func parseTranscriptPath(arg, prefix string) (string, []string, error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, fmt.Errorf("milter: transcript: expected %v: %q", prefix, arg)
+	}
+	fields := strings.Fields(arg[len(prefix):])
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("milter: transcript: missing address: %q", arg)
+	}
+	return strings.Trim(fields[0], "<>"), fields[1:], nil
+}
+
+// readData reads the message up to the terminating dot line. Message lines
+// are read as is, except for the "C:" prefix if the transcript is prefixed.
+func (t *Transaction) readData(br *bufio.Reader, prefixed bool) error {
+	var msg bytes.Buffer
+	for {
+		line, err := readLine(br)
+		if err == io.EOF {
+			return fmt.Errorf("milter: transcript: unterminated DATA")
+		} else if err != nil {
+			return err
+		}
+		if prefixed {
+			line, _ = trimClientPrefix(line)
+		}
+		if line == "." {
+			break
+		}
+		line = strings.TrimPrefix(line, ".")
+		msg.WriteString(line + "\r\n")
+	}
+
+	return t.setMessage(bufio.NewReader(&msg))
+}
+
+// setMessage reads the header and body of the message.
+func (t *Transaction) setMessage(br *bufio.Reader) error {
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return fmt.Errorf("milter: transcript: %w", err)
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	t.Header, t.Body = hdr, body
+	return nil
+}
+
+// Replay sends the transaction to the milter. It stops at the first action
+// other than ActContinue, which is reported in Result.Action. Recipients
+// rejected by the milter are reported in Result.RejectedRcpts and the
+// transaction goes on with the remaining ones, as an MTA would; if all
+// recipients are rejected, Result.Action is the last rejection.
+func (t *Transaction) Replay(s *ClientSession) (*Result, error) {
+	steps := []func() (*Action, error){
+		func() (*Action, error) {
+			return s.Conn(t.Hostname, t.Family, t.Port, t.Addr)
+		},
+		func() (*Action, error) {
+			return s.Helo(t.Helo)
+		},
+		func() (*Action, error) {
+			return s.Mail(t.From, t.FromArgs)
+		},
+	}
+	for _, step := range steps {
+		act, err := step()
+		if err != nil {
+			return nil, err
+		}
+		if act.Code != ActContinue {
+			return &Result{Action: act}, nil
+		}
+	}
+
+	for _, rcpt := range t.Rcpts {
+		act, err := s.Rcpt(rcpt.Addr, rcpt.Args)
+		if err != nil {
+			return nil, err
+		}
+		switch act.Code {
+		case ActContinue, ActReject, ActTempFail, ActReplyCode:
+			continue
+		}
+		return &Result{Action: act, RejectedRcpts: s.rejectedRcpts}, nil
+	}
+	if len(t.Rcpts) > 0 && len(s.rcpts) == 0 {
+		rejected := s.rejectedRcpts
+		return &Result{
+			Action:        rejected[len(rejected)-1].Action,
+			RejectedRcpts: rejected,
+		}, nil
+	}
+
+	act, err := s.Header(t.Header)
+	if err != nil {
+		return nil, err
+	}
+	if act.Code != ActContinue {
+		return &Result{Action: act, RejectedRcpts: s.rejectedRcpts}, nil
+	}
+
+	rcpts, rejected := s.rcpts, s.rejectedRcpts
+	modifyActs, act, err := s.BodyReadFrom(bytes.NewReader(t.Body))
+	if err != nil {
+		return nil, err
+	}
+	return s.newResult(rcpts, rejected, modifyActs, act), nil
+}
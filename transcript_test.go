@@ -0,0 +1,172 @@
+package milter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTranscript = `S: 220 mx.example.org ESMTP
+C: CONNECT mail.example.com 192.0.2.1 4321
+C: EHLO mail.example.com
+S: 250 mx.example.org
+C: MAIL FROM:<from@example.com> SIZE=42
+S: 250 2.1.0 Ok
+C: RCPT TO:<to@example.org> NOTIFY=NEVER
+S: 250 2.1.5 Ok
+C: DATA
+S: 354 End data with <CR><LF>.<CR><LF>
+C: Subject: Hello
+C:
+C: ..dot
+C: .
+S: 250 2.0.0 Ok: queued
+C: QUIT
+`
+
+func TestParseTranscript(t *testing.T) {
+	tr, err := ParseTranscript(strings.NewReader(testTranscript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Hostname != "mail.example.com" || tr.Addr != "192.0.2.1" || tr.Port != 4321 {
+		t.Fatalf("Wrong connection: %v %v %v", tr.Hostname, tr.Addr, tr.Port)
+	}
+	if tr.Helo != "mail.example.com" {
+		t.Fatal("Wrong HELO:", tr.Helo)
+	}
+	if tr.From != "from@example.com" || !reflect.DeepEqual(tr.FromArgs, []string{"SIZE=42"}) {
+		t.Fatal("Wrong sender:", tr.From, tr.FromArgs)
+	}
+	expectedRcpts := []TransactionRcpt{{Addr: "to@example.org", Args: []string{"NOTIFY=NEVER"}}}
+	if !reflect.DeepEqual(tr.Rcpts, expectedRcpts) {
+		t.Fatal("Wrong recipients:", tr.Rcpts)
+	}
+	if tr.Header.Get("Subject") != "Hello" {
+		t.Fatal("Wrong subject:", tr.Header.Get("Subject"))
+	}
+	if string(tr.Body) != ".dot\r\n" {
+		t.Fatalf("Wrong body: %q", tr.Body)
+	}
+}
+
+func TestTransaction_Replay(t *testing.T) {
+	tr, err := ParseTranscript(strings.NewReader(testTranscript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mm := MockMilter{
+		ConnResp:      RespContinue,
+		HeloResp:      RespContinue,
+		MailResp:      RespContinue,
+		RcptResp:      RespReject,
+		HdrResp:       RespContinue,
+		HdrsResp:      RespContinue,
+		BodyChunkResp: RespContinue,
+		BodyResp:      RespAccept,
+	}
+	s := Server{
+		NewMilter: func() Milter {
+			return &mm
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	res, err := tr.Replay(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action.Code != ActReject {
+		t.Fatal("Unexpected code:", res.Action.Code)
+	}
+	if mm.Host != "mail.example.com" || mm.From != "from@example.com" {
+		t.Fatal("Wrong transaction:", mm.Host, mm.From)
+	}
+}
+
+func TestParseTranscript_Data(t *testing.T) {
+	for _, tc := range []struct {
+		name, transcript string
+	}{
+		{"prefixed", "C: MAIL FROM:<from@example.com>\nC: DATA\nC: Subject: Hello\nC:\nC: S: not a reply\nC:C: not a command\nC: .\n"},
+		{"unprefixed", "MAIL FROM:<from@example.com>\nDATA\nSubject: Hello\n\nS: not a reply\nC: not a command\n.\n"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tr, err := ParseTranscript(strings.NewReader(tc.transcript))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tr.Header.Get("Subject") != "Hello" {
+				t.Fatal("Wrong subject:", tr.Header.Get("Subject"))
+			}
+			if expected := "S: not a reply\r\nC: not a command\r\n"; string(tr.Body) != expected {
+				t.Fatalf("Wrong body: %q", tr.Body)
+			}
+		})
+	}
+}
+
+func TestParseEnvelope(t *testing.T) {
+	envelope := "CONNECT mail.example.com 192.0.2.1\nMAIL FROM:<from@example.com>\nRCPT TO:<to@example.org>\n"
+	msg := "Subject: Hello\r\n\r\n.dot\r\n"
+	tr, err := ParseEnvelope(strings.NewReader(envelope), strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Hostname != "mail.example.com" || tr.From != "from@example.com" || len(tr.Rcpts) != 1 {
+		t.Fatal("Wrong envelope:", tr.Hostname, tr.From, tr.Rcpts)
+	}
+	if tr.Header.Get("Subject") != "Hello" {
+		t.Fatal("Wrong subject:", tr.Header.Get("Subject"))
+	}
+	if string(tr.Body) != ".dot\r\n" {
+		t.Fatalf("Wrong body: %q", tr.Body)
+	}
+
+	if _, err := ParseEnvelope(strings.NewReader(envelope+"DATA\n.\n"), strings.NewReader(msg)); err == nil {
+		t.Fatal("Expected an error for DATA in envelope")
+	}
+}
+
+func TestTransaction_ReplayRejectedRcpt(t *testing.T) {
+	tr := &Transaction{
+		Hostname: "mail.example.com",
+		Family:   FamilyInet,
+		Port:     25,
+		Addr:     "192.0.2.1",
+		From:     "from@example.com",
+		Rcpts: []TransactionRcpt{
+			{Addr: "bad@example.org"},
+			{Addr: "to@example.org"},
+		},
+		Body: []byte("Hello\r\n"),
+	}
+
+	s := Server{
+		NewMilter: func() Milter {
+			return rcptMilter{}
+		},
+		Actions: OptAddRcpt | OptRemoveRcpt,
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	res, err := tr.Replay(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action.Code != ActAccept {
+		t.Fatal("Unexpected code:", res.Action.Code)
+	}
+	if len(res.RejectedRcpts) != 1 || res.RejectedRcpts[0].Addr != "bad@example.org" || res.RejectedRcpts[0].Action.Code != ActReject {
+		t.Fatalf("Wrong rejected recipients: %+v", res.RejectedRcpts)
+	}
+	if expected := []string{"to@example.org", "to3@example.org"}; !reflect.DeepEqual(res.Recipients, expected) {
+		t.Fatalf("Wrong recipients: %v", res.Recipients)
+	}
+}
@@ -0,0 +1,61 @@
+package milter
+
+import (
+	"sync"
+)
+
+// Values is a key/value store shared by the callbacks of a Milter, see
+// Modifier.SessionValues and Modifier.MessageValues. As with
+// context.WithValue, keys should be of a type defined by the filter to avoid
+// collisions. Values is safe for concurrent use.
+type Values struct {
+	mu sync.Mutex
+	m  map[interface{}]interface{}
+}
+
+// Get returns the value stored for key, nil if none.
+func (v *Values) Get(key interface{}) interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.m[key]
+}
+
+// Lookup returns the value stored for key and whether it is present.
+func (v *Values) Lookup(key interface{}) (interface{}, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	value, ok := v.m[key]
+	return value, ok
+}
+
+// Set stores value for key.
+func (v *Values) Set(key, value interface{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.m == nil {
+		v.m = make(map[interface{}]interface{})
+	}
+	v.m[key] = value
+}
+
+// Delete removes the value stored for key.
+func (v *Values) Delete(key interface{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.m, key)
+}
+
+// SessionValues returns the values of the SMTP connection, e.g. to keep the
+// reputation of the client from Connect to Body. They are kept across
+// messages and cleared when the MTA starts a new connection on the same
+// milter connection (QUIT_NC).
+func (m *Modifier) SessionValues() *Values {
+	return m.sessionValues
+}
+
+// MessageValues returns the values of the current message, e.g. to keep the
+// result of a sender check from MailFrom to Body. They are cleared at the
+// end of the message and when it is aborted.
+func (m *Modifier) MessageValues() *Values {
+	return m.messageValues
+}
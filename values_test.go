@@ -0,0 +1,65 @@
+package milter
+
+import (
+	"testing"
+)
+
+type valuesKey string
+
+type valuesMilter struct {
+	NoOpMilter
+	seen *[]interface{}
+}
+
+func (vm *valuesMilter) Helo(name string, m *Modifier) (Response, error) {
+	m.SessionValues().Set(valuesKey("helo"), name)
+	return RespContinue, nil
+}
+
+func (vm *valuesMilter) MailFrom(from string, m *Modifier) (Response, error) {
+	if _, ok := m.MessageValues().Lookup(valuesKey("from")); ok {
+		*vm.seen = append(*vm.seen, "leaked")
+	}
+	m.MessageValues().Set(valuesKey("from"), from)
+	return RespContinue, nil
+}
+
+func (vm *valuesMilter) Body(m *Modifier) (Response, error) {
+	*vm.seen = append(*vm.seen, m.SessionValues().Get(valuesKey("helo")), m.MessageValues().Get(valuesKey("from")))
+	return RespAccept, nil
+}
+
+func TestModifier_Values(t *testing.T) {
+	var seen []interface{}
+	s := Server{
+		// the Milter is created again after each message
+		NewMilter: func() Milter {
+			return &valuesMilter{seen: &seen}
+		},
+	}
+	defer s.Close()
+	session := startTestSession(t, &s, ClientOptions{})
+	defer session.Close()
+
+	if _, err := session.Helo("mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	for _, from := range []string{"a@example.org", "b@example.org"} {
+		if _, err := session.Mail(from, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := session.End(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []interface{}{"mx.example.org", "a@example.org", "mx.example.org", "b@example.org"}
+	if len(seen) != len(expected) {
+		t.Fatalf("Wrong values: %v", seen)
+	}
+	for i := range expected {
+		if seen[i] != expected[i] {
+			t.Fatalf("Wrong values: %v", seen)
+		}
+	}
+}
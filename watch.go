@@ -0,0 +1,69 @@
+package milter
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// aLongTimeAgo is a read deadline in the past, interrupting pending reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchConn is a connection on which a background read can detect the peer
+// closing the connection while a command is processed, as net/http does. A
+// byte consumed by the background read is returned by the next Read.
+type watchConn struct {
+	net.Conn
+
+	peeked   []byte
+	err      error
+	stopping int32
+}
+
+func (c *watchConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// watch starts a background read calling onClose if the connection is closed
+// or broken. The returned function stops the read, it must be called before
+// the next Read.
+func (c *watchConn) watch(onClose func()) (stop func()) {
+	if len(c.peeked) > 0 || c.err != nil {
+		// The next command is already there, or the connection is gone
+		return func() {}
+	}
+
+	atomic.StoreInt32(&c.stopping, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var b [1]byte
+		n, err := c.Conn.Read(b[:])
+		if n > 0 {
+			c.peeked = append(c.peeked[:0], b[0])
+		}
+		if err == nil {
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && atomic.LoadInt32(&c.stopping) != 0 {
+			// interrupted by stop
+			return
+		}
+		c.err = err
+		onClose()
+	}()
+	return func() {
+		atomic.StoreInt32(&c.stopping, 1)
+		c.Conn.SetReadDeadline(aLongTimeAgo)
+		<-done
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}